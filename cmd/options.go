@@ -15,6 +15,9 @@
 package cmd
 
 import (
+	"fmt"
+	"strings"
+
 	"github.com/raravena80/ya/common"
 	"github.com/spf13/viper"
 )
@@ -24,16 +27,74 @@ import (
 // applied to the Options struct.
 func BuildCommonOptions() []func(*common.Options) {
 	var options []func(*common.Options)
+	machines := viper.GetStringSlice("ya.machines")
+
+	// Inventory hosts are added to the machines, each with its own
+	// connection settings
+	if path := viper.GetString("ya.inventory"); path != "" {
+		hosts, err := resolveInventory(path, viper.GetStringSlice("ya.groups"))
+		if err != nil {
+			printfFunc("Error: %v\n", err)
+			exitFunc(1)
+		}
+		for _, h := range hosts {
+			machines = append(machines, h.Name)
+		}
+		options = append(options, common.SetHosts(hosts))
+	}
 	options = append(options,
-		common.SetMachines(viper.GetStringSlice("ya.machines")))
-	options = append(options,
-		common.SetUser(viper.GetString("ya.user")))
-	options = append(options,
-		common.SetPort(viper.GetInt("ya.port")))
-	options = append(options,
-		common.SetKey(viper.GetString("ya.key")))
+		common.SetMachines(uniqueMachines(machines)))
+
+	// User, port and key are only passed on when given explicitly, so
+	// settings from ~/.ssh/config apply to hosts otherwise
+	if viper.IsSet("ya.user") {
+		options = append(options,
+			common.SetUser(viper.GetString("ya.user")))
+	}
+	if viper.IsSet("ya.port") {
+		options = append(options,
+			common.SetPort(viper.GetInt("ya.port")))
+	}
+	if viper.IsSet("ya.key") {
+		options = append(options,
+			common.SetKeys(viper.GetStringSlice("ya.key")))
+	}
+	if sshConfig := viper.GetString("ya.ssh-config"); sshConfig != "" {
+		options = append(options, common.SetSSHConfig(sshConfig))
+	}
+	if jump := viper.GetString("ya.jump"); jump != "" {
+		options = append(options, common.SetJump(jump))
+	}
+
+	// Host key verification
+	if files := viper.GetStringSlice("ya.known-hosts"); len(files) > 0 {
+		options = append(options, common.SetKnownHosts(strings.Join(files, ",")))
+	}
+	if viper.GetBool("ya.insecure-host") {
+		options = append(options, common.SetInsecureHost(true))
+	}
+	if viper.GetBool("ya.accept-new-hosts") {
+		options = append(options, common.SetAcceptNewHosts(true))
+	}
+	if cas := viper.GetStringSlice("ya.host-ca"); len(cas) > 0 {
+		options = append(options, common.SetHostCAs(cas))
+	}
+
+	// Password and keyboard-interactive authentication
+	if viper.GetBool("ya.ask-pass") {
+		options = append(options, common.SetAskPass(true))
+	}
+	if file := viper.GetString("ya.password-file"); file != "" {
+		options = append(options, common.SetPasswordFile(file))
+	}
 	options = append(options,
 		common.SetUseAgent(viper.GetBool("ya.useagent")))
+	if sock := viper.GetString("ya.agentsock"); sock != "" {
+		options = append(options, common.SetAgentSock(sock))
+	}
+	if viper.GetBool("ya.forward-agent") {
+		options = append(options, common.SetForwardAgent(true))
+	}
 	options = append(options,
 		common.SetTimeout(viper.GetInt("ya.timeout")))
 
@@ -65,10 +126,65 @@ func BuildCommonOptions() []func(*common.Options) {
 		options = append(options, common.SetHostExcludes(excludes))
 	}
 
+	// Concurrency and rollout waves
+	if forks := viper.GetInt("ya.forks"); forks > 0 {
+		options = append(options, common.SetForks(forks))
+	}
+	if batch := viper.GetString("ya.batch"); batch != "" {
+		options = append(options, common.SetBatch(batch))
+	}
+	if viper.IsSet("ya.max-fail-percent") {
+		options = append(options, common.SetMaxFailPercent(viper.GetInt("ya.max-fail-percent")))
+	}
+
+	// File transfer protocol
+	if protocol := viper.GetString("ya.protocol"); protocol != "" {
+		options = append(options, common.SetProtocol(protocol))
+	}
+
 	// Progress indicators
 	if viper.GetBool("ya.show-progress") {
 		options = append(options, common.SetShowProgress(true))
 	}
 
+	// Bandwidth limits
+	if r := viper.GetString("ya.limit-rate"); r != "" {
+		options = append(options, common.SetLimitRate(r))
+	}
+	if r := viper.GetString("ya.total-rate"); r != "" {
+		options = append(options, common.SetTotalRate(r))
+	}
+
 	return options
 }
+
+// uniqueMachines returns machines without repeated entries, such as hosts
+// given with --machines that are also in the inventory, keeping the first.
+func uniqueMachines(machines []string) []string {
+	seen := make(map[string]bool, len(machines))
+	unique := make([]string, 0, len(machines))
+	for _, m := range machines {
+		if !seen[m] {
+			seen[m] = true
+			unique = append(unique, m)
+		}
+	}
+	return unique
+}
+
+// resolveInventory loads the inventory at path and returns the hosts of the
+// given groups, or of the whole inventory when no groups are given.
+func resolveInventory(path string, groups []string) ([]common.Host, error) {
+	inv, err := common.LoadInventory(path)
+	if err != nil {
+		return nil, err
+	}
+	hosts, err := inv.Resolve(groups)
+	if err != nil {
+		return nil, err
+	}
+	if len(hosts) == 0 {
+		return nil, fmt.Errorf("no hosts found in inventory %s", path)
+	}
+	return hosts, nil
+}
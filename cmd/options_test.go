@@ -15,9 +15,14 @@
 package cmd
 
 import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
 	"github.com/raravena80/ya/common"
+	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
-	"testing"
 )
 
 func TestBuildCommonOptions(t *testing.T) {
@@ -53,8 +58,8 @@ func TestBuildCommonOptions(t *testing.T) {
 	if opt.Port != 2222 {
 		t.Errorf("Expected port 2222, got %d", opt.Port)
 	}
-	if opt.Key != "/tmp/test.key" {
-		t.Errorf("Expected /tmp/test.key, got %s", opt.Key)
+	if !reflect.DeepEqual(opt.Keys, []string{"/tmp/test.key"}) {
+		t.Errorf("Expected /tmp/test.key, got %v", opt.Keys)
 	}
 	if !opt.UseAgent {
 		t.Error("Expected UseAgent to be true")
@@ -94,4 +99,191 @@ func TestBuildCommonOptionsDefaults(t *testing.T) {
 	if opt.UseAgent {
 		t.Error("Expected UseAgent to be false")
 	}
+	if opt.Protocol != "" {
+		t.Errorf("Expected empty protocol, got %s", opt.Protocol)
+	}
+}
+
+func TestBuildCommonOptionsProtocol(t *testing.T) {
+	viper.Reset()
+	viper.Set("ya.protocol", "sftp")
+
+	opt := common.Options{}
+	for _, option := range BuildCommonOptions() {
+		option(&opt)
+	}
+	if opt.Protocol != "sftp" {
+		t.Errorf("Expected protocol sftp, got %s", opt.Protocol)
+	}
+	viper.Reset()
+}
+
+func TestBuildCommonOptionsRates(t *testing.T) {
+	viper.Reset()
+	viper.Set("ya.limit-rate", "10M")
+	viper.Set("ya.total-rate", "100M")
+
+	opt := common.Options{}
+	for _, option := range BuildCommonOptions() {
+		option(&opt)
+	}
+	if opt.LimitRate != "10M" || opt.TotalRate != "100M" {
+		t.Errorf("Expected rates 10M and 100M, got %q and %q", opt.LimitRate, opt.TotalRate)
+	}
+	viper.Reset()
+}
+
+func TestBuildCommonOptionsRollout(t *testing.T) {
+	viper.Reset()
+	viper.Set("ya.forks", 20)
+	viper.Set("ya.batch", "10%")
+	viper.Set("ya.max-fail-percent", 0)
+
+	opt := common.Options{}
+	for _, option := range BuildCommonOptions() {
+		option(&opt)
+	}
+
+	if opt.Forks != 20 {
+		t.Errorf("Expected forks 20, got %d", opt.Forks)
+	}
+	if opt.Batch != "10%" {
+		t.Errorf("Expected batch 10%%, got %s", opt.Batch)
+	}
+	if opt.MaxFailPercent == nil || *opt.MaxFailPercent != 0 {
+		t.Errorf("Expected max fail percent 0, got %v", opt.MaxFailPercent)
+	}
+
+	viper.Reset()
+	opt = common.Options{}
+	for _, option := range BuildCommonOptions() {
+		option(&opt)
+	}
+	if opt.MaxFailPercent != nil {
+		t.Errorf("Expected no max fail percent when unset, got %v", *opt.MaxFailPercent)
+	}
+}
+
+func TestBuildCommonOptionsInventory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hosts")
+	content := "[web]\nweb1 ansible_port=2222\nweb2 ansible_user=admin\n[db]\ndb1\n"
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	viper.Reset()
+	defer viper.Reset()
+	viper.Set("ya.machines", []string{"extra", "web1", "extra"})
+	viper.Set("ya.inventory", path)
+	viper.Set("ya.groups", []string{"web"})
+
+	opt := common.Options{}
+	for _, option := range BuildCommonOptions() {
+		option(&opt)
+	}
+
+	if want := []string{"extra", "web1", "web2"}; !reflect.DeepEqual(opt.Machines, want) {
+		t.Errorf("Expected machines %v, got %v", want, opt.Machines)
+	}
+	if opt.Hosts["web1"].Port != 2222 {
+		t.Errorf("Expected web1 port 2222, got %d", opt.Hosts["web1"].Port)
+	}
+	if opt.Hosts["web2"].User != "admin" {
+		t.Errorf("Expected web2 user admin, got %q", opt.Hosts["web2"].User)
+	}
+	if _, ok := opt.Hosts["db1"]; ok {
+		t.Error("Expected db1 to be excluded by the group selection")
+	}
+}
+
+func TestBuildCommonOptionsInventoryError(t *testing.T) {
+	oldExit, oldPrintf := exitFunc, printfFunc
+	defer func() { exitFunc, printfFunc = oldExit, oldPrintf }()
+	exitCode := -1
+	exitFunc = func(code int) { exitCode = code }
+	printfFunc = func(string, ...interface{}) (int, error) { return 0, nil }
+
+	viper.Reset()
+	defer viper.Reset()
+	viper.Set("ya.inventory", filepath.Join(t.TempDir(), "missing"))
+	BuildCommonOptions()
+
+	if exitCode != 1 {
+		t.Errorf("Expected exit code 1 for a missing inventory, got %d", exitCode)
+	}
+}
+
+func TestBuildCommonOptionsConnection(t *testing.T) {
+	viper.Reset()
+	defer viper.Reset()
+	viper.Set("ya.ssh-config", "/tmp/ssh_config")
+	viper.Set("ya.jump", "admin@bastion:2200,inner")
+	viper.Set("ya.agentsock", "/tmp/agent.sock")
+	viper.Set("ya.forward-agent", true)
+
+	opt := common.Options{}
+	for _, option := range BuildCommonOptions() {
+		option(&opt)
+	}
+	if opt.SSHConfig != "/tmp/ssh_config" {
+		t.Errorf("Expected ssh config /tmp/ssh_config, got %q", opt.SSHConfig)
+	}
+	if opt.Jump != "admin@bastion:2200,inner" {
+		t.Errorf("Expected jump admin@bastion:2200,inner, got %q", opt.Jump)
+	}
+	if opt.AgentSock != "/tmp/agent.sock" || !opt.ForwardAgent {
+		t.Errorf("Expected agent socket /tmp/agent.sock forwarded, got %q %v", opt.AgentSock, opt.ForwardAgent)
+	}
+	// Unset user, port and key are left to ssh_config and the defaults
+	if opt.User != "" || opt.Port != 0 || len(opt.Keys) != 0 {
+		t.Errorf("Expected no user, port or key, got %q %d %v", opt.User, opt.Port, opt.Keys)
+	}
+}
+
+func TestBuildCommonOptionsHostKeys(t *testing.T) {
+	viper.Reset()
+	defer viper.Reset()
+	viper.Set("ya.known-hosts", []string{"~/.ssh/known_hosts", "/etc/ssh/ssh_known_hosts"})
+	viper.Set("ya.insecure-host", true)
+	viper.Set("ya.accept-new-hosts", true)
+	viper.Set("ya.host-ca", []string{"/etc/ssh/host_ca.pub"})
+
+	opt := common.Options{}
+	for _, option := range BuildCommonOptions() {
+		option(&opt)
+	}
+	if opt.KnownHosts != "~/.ssh/known_hosts,/etc/ssh/ssh_known_hosts" {
+		t.Errorf("Expected both known_hosts files, got %q", opt.KnownHosts)
+	}
+	if !opt.InsecureHost {
+		t.Error("Expected InsecureHost to be true")
+	}
+	if !opt.AcceptNewHosts {
+		t.Error("Expected AcceptNewHosts to be true")
+	}
+	if !reflect.DeepEqual(opt.HostCAs, []string{"/etc/ssh/host_ca.pub"}) {
+		t.Errorf("Expected host CA /etc/ssh/host_ca.pub, got %v", opt.HostCAs)
+	}
+}
+
+func TestBuildCommonOptionsKeys(t *testing.T) {
+	viper.Reset()
+	defer viper.Reset()
+	// --key may be given more than once
+	flag := RootCmd.PersistentFlags().Lookup("key")
+	defer func() {
+		flag.Value.(pflag.SliceValue).Replace([]string{})
+		flag.Changed = false
+	}()
+	RootCmd.PersistentFlags().Set("key", "/keys/a")
+	RootCmd.PersistentFlags().Set("key", "/keys/b")
+	viper.BindPFlag("ya.key", flag)
+
+	opt := common.Options{}
+	for _, option := range BuildCommonOptions() {
+		option(&opt)
+	}
+	if want := []string{"/keys/a", "/keys/b"}; !reflect.DeepEqual(opt.Keys, want) {
+		t.Errorf("Expected keys %v, got %v", want, opt.Keys)
+	}
 }
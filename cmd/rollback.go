@@ -0,0 +1,48 @@
+// Copyright © 2017 Ricardo Aravena <raravena80@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"github.com/raravena80/ya/common"
+	"github.com/raravena80/ya/ops"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// rollbackCmd represents the rollback command
+var rollbackCmd = &cobra.Command{
+	Use:   "rollback",
+	Short: "Restore the last backup on multiple servers",
+	Long: `Restore the last backup of a file or directory on
+multiple servers, as kept by ya scp --backup. The
+backup replaces the current version, so rolling back
+again restores the backup before it.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		options := BuildCommonOptions()
+		options = append(options,
+			common.SetDestination(viper.GetString("ya.rollback.dst")))
+		options = append(options,
+			common.SetOp("rollback"))
+		ops.SSHSession(options...)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(rollbackCmd)
+
+	// Local flags
+	rollbackCmd.Flags().StringP("dst", "d", "", "Path on the servers to restore, as copied to with --backup")
+	viper.BindPFlag("ya.rollback.dst", rollbackCmd.Flags().Lookup("dst"))
+}
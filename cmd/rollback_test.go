@@ -0,0 +1,44 @@
+// Copyright © 2017 Ricardo Aravena <raravena80@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"testing"
+
+	"github.com/spf13/cobra"
+)
+
+func TestRollbackCommand(t *testing.T) {
+	var rollbackCmd *cobra.Command
+	for _, cmd := range RootCmd.Commands() {
+		if cmd.Name() == "rollback" {
+			rollbackCmd = cmd
+			break
+		}
+	}
+	if rollbackCmd == nil {
+		t.Fatal("rollback command not found")
+	}
+	if rollbackCmd.Short == "" || rollbackCmd.Long == "" || rollbackCmd.Run == nil {
+		t.Error("rollback command is incomplete")
+	}
+	f := rollbackCmd.Flags().Lookup("dst")
+	if f == nil {
+		t.Fatal("dst flag not found")
+	}
+	if f.Shorthand != "d" {
+		t.Errorf("dst flag shorthand = %q, want d", f.Shorthand)
+	}
+}
@@ -17,8 +17,10 @@ package cmd
 import (
 	"fmt"
 	"os"
+	"strings"
 
 	homedir "github.com/mitchellh/go-homedir"
+	"github.com/raravena80/ya/ops"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
@@ -38,7 +40,7 @@ var printlnFunc = fmt.Println
 var (
 	cfgFile       string
 	user          string
-	key           string
+	keys          []string
 	port          int
 	timeout       int
 	connectTimeout int
@@ -47,13 +49,48 @@ var (
 	machines      []string
 	Version       string
 	Gitcommit     string
-	outputFormat  string
+	outputFormat  = outputFormatValue("text")
 	dryRun        bool
 	hostPatterns  []string
 	hostExcludes  []string
 	showProgress  bool
+	forks         int
+	batch         string
+	maxFailPct    int
+	inventory     string
+	groups        []string
+	sshConfig     string
+	jump          string
+	knownHosts    []string
+	insecureHost  bool
+	acceptNew     bool
+	hostCAs       []string
+	askPass       bool
+	passwordFile  string
+	forwardAgent  bool
+	protocol      string
 )
 
+// outputFormatValue is a flag value that only accepts the output formats
+// supported by ops, so unknown names are rejected while parsing flags.
+type outputFormatValue string
+
+func (f *outputFormatValue) String() string {
+	return string(*f)
+}
+
+func (f *outputFormatValue) Set(s string) error {
+	if _, err := ops.NewFormatter(s); err != nil {
+		return err
+	}
+	*f = outputFormatValue(s)
+	return nil
+}
+
+func (f *outputFormatValue) Type() string {
+	return "string"
+}
+
 // RootCmd represents the base command when called without any subcommands
 var RootCmd = &cobra.Command{
 	Use:   "ya",
@@ -76,29 +113,41 @@ func init() {
 	cobra.OnInitialize(initConfig)
 
 	curUser := os.Getenv("LOGNAME")
-	home := os.Getenv("HOME")
-	if home == "" {
-		var err error
-		home, err = homedir.Dir()
-		if err != nil {
-			printfFunc("Error: could not determine home directory: %v\n", err)
-			exitFunc(1)
-		}
-	}
-	sshKey := home + "/.ssh/id_rsa"
 
 	// Persistent flags
 	RootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.ya.yaml)")
 	RootCmd.PersistentFlags().StringSliceVarP(&machines, "machines", "m", []string{}, "Hosts to run command on")
 	viper.BindPFlag("ya.machines", RootCmd.PersistentFlags().Lookup("machines"))
+	RootCmd.PersistentFlags().StringVarP(&inventory, "inventory", "i", "", "Inventory file (INI or YAML) to read hosts from")
+	viper.BindPFlag("ya.inventory", RootCmd.PersistentFlags().Lookup("inventory"))
+	RootCmd.PersistentFlags().StringSliceVarP(&groups, "group", "g", []string{}, "Inventory groups to run on (default all hosts)")
+	viper.BindPFlag("ya.groups", RootCmd.PersistentFlags().Lookup("group"))
 	RootCmd.PersistentFlags().IntVarP(&port, "port", "p", 22, "Ssh port to connect to")
 	viper.BindPFlag("ya.port", RootCmd.PersistentFlags().Lookup("port"))
 	RootCmd.PersistentFlags().StringVarP(&user, "user", "u", curUser, "User to run the command as")
 	viper.BindPFlag("ya.user", RootCmd.PersistentFlags().Lookup("user"))
-	RootCmd.PersistentFlags().StringVarP(&key, "key", "k", sshKey, "Ssh key to use for authentication, full path")
+	RootCmd.PersistentFlags().StringSliceVarP(&keys, "key", "k", []string{}, "Ssh keys to use for authentication, full path, tried in order (default is whichever of $HOME/.ssh/id_ed25519, id_ecdsa and id_rsa exist)")
 	viper.BindPFlag("ya.key", RootCmd.PersistentFlags().Lookup("key"))
+	RootCmd.PersistentFlags().StringVar(&sshConfig, "ssh-config", "", "OpenSSH client config file (default is $HOME/.ssh/config, \"none\" to ignore it)")
+	viper.BindPFlag("ya.ssh-config", RootCmd.PersistentFlags().Lookup("ssh-config"))
+	RootCmd.PersistentFlags().StringVarP(&jump, "jump", "J", "", "Jump hosts to connect through, as comma-separated [user@]host[:port] entries")
+	viper.BindPFlag("ya.jump", RootCmd.PersistentFlags().Lookup("jump"))
+	RootCmd.PersistentFlags().StringSliceVar(&knownHosts, "known-hosts", []string{}, "known_hosts files to verify host keys against (default is $HOME/.ssh/known_hosts)")
+	viper.BindPFlag("ya.known-hosts", RootCmd.PersistentFlags().Lookup("known-hosts"))
+	RootCmd.PersistentFlags().BoolVar(&insecureHost, "insecure-host", false, "Skip host key verification (not recommended)")
+	viper.BindPFlag("ya.insecure-host", RootCmd.PersistentFlags().Lookup("insecure-host"))
+	RootCmd.PersistentFlags().BoolVar(&acceptNew, "accept-new-hosts", false, "Add keys of hosts not in known_hosts to it, still rejecting changed keys")
+	viper.BindPFlag("ya.accept-new-hosts", RootCmd.PersistentFlags().Lookup("accept-new-hosts"))
+	RootCmd.PersistentFlags().StringSliceVar(&hostCAs, "host-ca", []string{}, "Files with CA public keys trusted to sign host certificates")
+	viper.BindPFlag("ya.host-ca", RootCmd.PersistentFlags().Lookup("host-ca"))
+	RootCmd.PersistentFlags().BoolVar(&askPass, "ask-pass", false, "Prompt once for a password to authenticate to every host with")
+	viper.BindPFlag("ya.ask-pass", RootCmd.PersistentFlags().Lookup("ask-pass"))
+	RootCmd.PersistentFlags().StringVar(&passwordFile, "password-file", "", "File whose first line is the password to authenticate to every host with")
+	viper.BindPFlag("ya.password-file", RootCmd.PersistentFlags().Lookup("password-file"))
 	RootCmd.PersistentFlags().BoolP("useagent", "a", false, "Use agent for authentication")
 	viper.BindPFlag("ya.useagent", RootCmd.PersistentFlags().Lookup("useagent"))
+	RootCmd.PersistentFlags().BoolVarP(&forwardAgent, "forward-agent", "A", false, "Forward the SSH agent so remote commands can use its keys")
+	viper.BindPFlag("ya.forward-agent", RootCmd.PersistentFlags().Lookup("forward-agent"))
 	RootCmd.PersistentFlags().IntVarP(&timeout, "timeout", "t", 5, "Timeout for connection")
 	viper.BindPFlag("ya.timeout", RootCmd.PersistentFlags().Lookup("timeout"))
 	RootCmd.PersistentFlags().StringVarP(&agentsock, "agentsock", "s", os.Getenv("SSH_AUTH_SOCK"), "SSH agent socket file. If using SSH agent")
@@ -109,7 +158,7 @@ func init() {
 	viper.BindPFlag("ya.connect-timeout", RootCmd.PersistentFlags().Lookup("connect-timeout"))
 	RootCmd.PersistentFlags().IntVar(&commandTimeout, "command-timeout", 0, "Command execution timeout override in seconds")
 	viper.BindPFlag("ya.command-timeout", RootCmd.PersistentFlags().Lookup("command-timeout"))
-	RootCmd.PersistentFlags().StringVarP(&outputFormat, "output-format", "o", "text", "Output format: text, json, yaml, table")
+	RootCmd.PersistentFlags().VarP(&outputFormat, "output-format", "o", "Output format: "+strings.Join(ops.OutputFormats, ", "))
 	viper.BindPFlag("ya.output-format", RootCmd.PersistentFlags().Lookup("output-format"))
 	RootCmd.PersistentFlags().BoolVarP(&dryRun, "dry-run", "n", false, "Preview operations without executing")
 	viper.BindPFlag("ya.dry-run", RootCmd.PersistentFlags().Lookup("dry-run"))
@@ -117,8 +166,20 @@ func init() {
 	viper.BindPFlag("ya.host-patterns", RootCmd.PersistentFlags().Lookup("host"))
 	RootCmd.PersistentFlags().StringSliceVar(&hostExcludes, "host-exclude", []string{}, "Host patterns to exclude")
 	viper.BindPFlag("ya.host-excludes", RootCmd.PersistentFlags().Lookup("host-exclude"))
+	RootCmd.PersistentFlags().StringVar(&protocol, "protocol", ops.ProtocolAuto, "File transfer protocol: "+strings.Join(ops.Protocols, ", ")+" (auto uses sftp when the server offers it)")
+	viper.BindPFlag("ya.protocol", RootCmd.PersistentFlags().Lookup("protocol"))
 	RootCmd.PersistentFlags().BoolVarP(&showProgress, "progress", "P", false, "Show progress indicators for file transfers")
 	viper.BindPFlag("ya.show-progress", RootCmd.PersistentFlags().Lookup("progress"))
+	RootCmd.PersistentFlags().String("limit-rate", "", "Limit transfers to and from each server to this many bytes per second (K, M and G suffixes)")
+	viper.BindPFlag("ya.limit-rate", RootCmd.PersistentFlags().Lookup("limit-rate"))
+	RootCmd.PersistentFlags().String("total-rate", "", "Limit transfers to and from all servers together to this many bytes per second (K, M and G suffixes)")
+	viper.BindPFlag("ya.total-rate", RootCmd.PersistentFlags().Lookup("total-rate"))
+	RootCmd.PersistentFlags().IntVar(&forks, "forks", 0, "Maximum number of hosts to run on concurrently (0 for no limit)")
+	viper.BindPFlag("ya.forks", RootCmd.PersistentFlags().Lookup("forks"))
+	RootCmd.PersistentFlags().StringVar(&batch, "batch", "", "Run hosts in waves of this many hosts or percentage, e.g. 10 or 25%")
+	viper.BindPFlag("ya.batch", RootCmd.PersistentFlags().Lookup("batch"))
+	RootCmd.PersistentFlags().IntVar(&maxFailPct, "max-fail-percent", 0, "Stop the rollout when more than this percentage of a wave fails")
+	viper.BindPFlag("ya.max-fail-percent", RootCmd.PersistentFlags().Lookup("max-fail-percent"))
 
 }
 
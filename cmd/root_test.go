@@ -123,6 +123,30 @@ func TestRootCmdFlags(t *testing.T) {
 		{name: "Timeout flag",
 			flag:     "timeout",
 			expected: "ya.timeout"},
+		{name: "Known hosts flag",
+			flag:     "known-hosts",
+			expected: "ya.known-hosts"},
+		{name: "Insecure host flag",
+			flag:     "insecure-host",
+			expected: "ya.insecure-host"},
+		{name: "Forward agent flag",
+			flag:     "forward-agent",
+			expected: "ya.forward-agent"},
+		{name: "Ask pass flag",
+			flag:     "ask-pass",
+			expected: "ya.ask-pass"},
+		{name: "Password file flag",
+			flag:     "password-file",
+			expected: "ya.password-file"},
+		{name: "Protocol flag",
+			flag:     "protocol",
+			expected: "ya.protocol"},
+		{name: "Limit rate flag",
+			flag:     "limit-rate",
+			expected: "ya.limit-rate"},
+		{name: "Total rate flag",
+			flag:     "total-rate",
+			expected: "ya.total-rate"},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -250,3 +274,33 @@ func TestInitConfigExitPath(t *testing.T) {
 		// We're just verifying it doesn't panic
 	})
 }
+
+func TestOutputFormatFlag(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		wantErr bool
+	}{
+		{name: "Text format", value: "text", wantErr: false},
+		{name: "JSON format", value: "json", wantErr: false},
+		{name: "YAML format", value: "yaml", wantErr: false},
+		{name: "Table format", value: "table", wantErr: false},
+		{name: "Unknown format", value: "xml", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flag := RootCmd.PersistentFlags().Lookup("output-format")
+			if flag == nil {
+				t.Fatal("output-format flag not found")
+			}
+			err := flag.Value.Set(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Set(%q) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+			}
+			if !tt.wantErr && flag.Value.String() != tt.value {
+				t.Errorf("Value = %q, want %q", flag.Value.String(), tt.value)
+			}
+		})
+	}
+	RootCmd.PersistentFlags().Lookup("output-format").Value.Set("text")
+}
@@ -15,6 +15,8 @@
 package cmd
 
 import (
+	"strings"
+
 	"github.com/raravena80/ya/common"
 	"github.com/raravena80/ya/ops"
 	"github.com/spf13/cobra"
@@ -33,7 +35,9 @@ var scpCmd = &cobra.Command{
 	Long: `Copy files to multiple servers.
 You can specify the source and destination files,
 the source files are local and the destination files
-are in the remote servers.`,
+are in the remote servers. With --from-remote the
+source is on the servers and is copied into
+<destination>/<server> locally.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		options := BuildCommonOptions()
 		options = append(options,
@@ -42,6 +46,24 @@ are in the remote servers.`,
 			common.SetDestination(viper.GetString("ya.scp.dst")))
 		options = append(options,
 			common.SetIsRecursive(viper.GetBool("ya.scp.recursive")))
+		options = append(options,
+			common.SetFromRemote(viper.GetBool("ya.scp.from-remote")))
+		options = append(options,
+			common.SetPreserve(viper.GetBool("ya.scp.preserve")))
+		options = append(options,
+			common.SetSymlinks(viper.GetString("ya.scp.symlinks")))
+		options = append(options,
+			common.SetVerify(viper.GetString("ya.scp.verify")))
+		options = append(options,
+			common.SetRelay(viper.GetInt("ya.scp.relay")))
+		options = append(options,
+			common.SetAtomic(viper.GetBool("ya.scp.atomic")))
+		options = append(options,
+			common.SetBackup(viper.GetBool("ya.scp.backup")))
+		options = append(options,
+			common.SetRetries(viper.GetInt("ya.scp.retries")))
+		options = append(options,
+			common.SetRetryDelay(viper.GetInt("ya.scp.retry-delay")))
 		options = append(options,
 			common.SetOp("scp"))
 		ops.SSHSession(options...)
@@ -57,4 +79,22 @@ func init() {
 	viper.BindPFlag("ya.scp.dst", scpCmd.Flags().Lookup("dst"))
 	scpCmd.Flags().BoolP("recursive", "r", false, "Set recursive copy")
 	viper.BindPFlag("ya.scp.recursive", scpCmd.Flags().Lookup("recursive"))
+	scpCmd.Flags().Bool("from-remote", false, "Copy the source from the servers into a directory per server under the destination")
+	viper.BindPFlag("ya.scp.from-remote", scpCmd.Flags().Lookup("from-remote"))
+	scpCmd.Flags().Bool("preserve", false, "Keep access and modification times, and ownership when copying over sftp")
+	viper.BindPFlag("ya.scp.preserve", scpCmd.Flags().Lookup("preserve"))
+	scpCmd.Flags().String("symlinks", ops.SymlinksFollow, "How to copy symlinks in directories: "+strings.Join(ops.SymlinkModes, ", ")+" (link needs sftp)")
+	viper.BindPFlag("ya.scp.symlinks", scpCmd.Flags().Lookup("symlinks"))
+	scpCmd.Flags().String("verify", "", "Check every copy against the source with this digest after the transfer: "+ops.VerifySHA256)
+	viper.BindPFlag("ya.scp.verify", scpCmd.Flags().Lookup("verify"))
+	scpCmd.Flags().Int("relay", 0, "Send the file to this many servers, then have every server that has it send it on to as many more")
+	viper.BindPFlag("ya.scp.relay", scpCmd.Flags().Lookup("relay"))
+	scpCmd.Flags().Bool("atomic", false, "Copy to a temporary name on the servers and rename it into place once complete")
+	viper.BindPFlag("ya.scp.atomic", scpCmd.Flags().Lookup("atomic"))
+	scpCmd.Flags().Bool("backup", false, "Keep the replaced version as <destination>.ya-bak.<time>, implies --atomic")
+	viper.BindPFlag("ya.scp.backup", scpCmd.Flags().Lookup("backup"))
+	scpCmd.Flags().Int("retries", 0, "Retry a failed copy to a server this many times, resuming partial files over sftp")
+	viper.BindPFlag("ya.scp.retries", scpCmd.Flags().Lookup("retries"))
+	scpCmd.Flags().Int("retry-delay", 1, "Seconds to wait before the first retry, doubled for every further one")
+	viper.BindPFlag("ya.scp.retry-delay", scpCmd.Flags().Lookup("retry-delay"))
 }
@@ -59,6 +59,15 @@ func TestSCPCommand(t *testing.T) {
 	if recursiveFlag.Shorthand != "r" {
 		t.Errorf("recursive flag shorthand = %s, want r", recursiveFlag.Shorthand)
 	}
+
+	for _, name := range []string{"from-remote", "preserve", "symlinks", "verify", "relay", "atomic", "backup", "retries", "retry-delay"} {
+		if scpCmd.Flags().Lookup(name) == nil {
+			t.Errorf("%s flag not found", name)
+		}
+	}
+	if f := scpCmd.Flags().Lookup("symlinks"); f != nil && f.DefValue != "follow" {
+		t.Errorf("symlinks flag default = %s, want follow", f.DefValue)
+	}
 }
 
 func TestSCPCommandArgsValidation(t *testing.T) {
@@ -33,6 +33,10 @@ using SSH.`,
 		options := BuildCommonOptions()
 		options = append(options,
 			common.SetCmd(viper.GetString("ya.ssh.command")))
+		options = append(options,
+			common.SetStream(viper.GetBool("ya.ssh.stream")))
+		options = append(options,
+			common.SetColor(viper.GetBool("ya.ssh.color")))
 		options = append(options,
 			common.SetOp("ssh"))
 		ops.SSHSession(options...)
@@ -45,4 +49,8 @@ func init() {
 	// Local flags
 	sshCmd.Flags().StringVarP(&command, "command", "c", "", "Command to run")
 	viper.BindPFlag("ya.ssh.command", sshCmd.Flags().Lookup("command"))
+	sshCmd.Flags().Bool("stream", false, "Print remote output live, prefixed with the hostname")
+	viper.BindPFlag("ya.ssh.stream", sshCmd.Flags().Lookup("stream"))
+	sshCmd.Flags().Bool("color", false, "Colorize hostname prefixes of streamed output")
+	viper.BindPFlag("ya.ssh.color", sshCmd.Flags().Lookup("color"))
 }
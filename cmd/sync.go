@@ -0,0 +1,68 @@
+// Copyright © 2017 Ricardo Aravena <raravena80@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"strings"
+
+	"github.com/raravena80/ya/common"
+	"github.com/raravena80/ya/ops"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// syncCmd represents the sync command
+var syncCmd = &cobra.Command{
+	Use:   "sync",
+	Short: "Sync a directory to multiple servers",
+	Long: `Make a directory on multiple servers a copy of a
+local directory, sending only the files that are new
+or changed. Files are compared by size and modification
+time, or by SHA-256 with --checksum. With --delete,
+files on the servers that are not in the local
+directory are removed.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		options := BuildCommonOptions()
+		options = append(options,
+			common.SetSource(viper.GetString("ya.sync.src")))
+		options = append(options,
+			common.SetDestination(viper.GetString("ya.sync.dst")))
+		options = append(options,
+			common.SetChecksum(viper.GetBool("ya.sync.checksum")))
+		options = append(options,
+			common.SetDelete(viper.GetBool("ya.sync.delete")))
+		options = append(options,
+			common.SetSymlinks(viper.GetString("ya.sync.symlinks")))
+		options = append(options,
+			common.SetOp("sync"))
+		ops.SSHSession(options...)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(syncCmd)
+
+	// Local flags
+	syncCmd.Flags().StringP("src", "f", "", "Local source directory")
+	viper.BindPFlag("ya.sync.src", syncCmd.Flags().Lookup("src"))
+	syncCmd.Flags().StringP("dst", "d", "", "Destination directory on the servers")
+	viper.BindPFlag("ya.sync.dst", syncCmd.Flags().Lookup("dst"))
+	syncCmd.Flags().Bool("checksum", false, "Compare files by SHA-256 instead of size and modification time")
+	viper.BindPFlag("ya.sync.checksum", syncCmd.Flags().Lookup("checksum"))
+	syncCmd.Flags().Bool("delete", false, "Remove files on the servers that are not in the source directory")
+	viper.BindPFlag("ya.sync.delete", syncCmd.Flags().Lookup("delete"))
+	syncCmd.Flags().String("symlinks", ops.SymlinksFollow, "How to sync symlinks in the source: "+strings.Join([]string{ops.SymlinksFollow, ops.SymlinksSkip}, ", "))
+	viper.BindPFlag("ya.sync.symlinks", syncCmd.Flags().Lookup("symlinks"))
+}
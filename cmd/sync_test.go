@@ -0,0 +1,63 @@
+// Copyright © 2017 Ricardo Aravena <raravena80@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"testing"
+
+	"github.com/spf13/cobra"
+)
+
+func TestSyncCommand(t *testing.T) {
+	var syncCmd *cobra.Command
+	for _, cmd := range RootCmd.Commands() {
+		if cmd.Name() == "sync" {
+			syncCmd = cmd
+			break
+		}
+	}
+	if syncCmd == nil {
+		t.Fatal("sync command not found")
+	}
+	if syncCmd.Short == "" || syncCmd.Long == "" || syncCmd.Run == nil {
+		t.Error("sync command is incomplete")
+	}
+
+	tests := []struct {
+		flag      string
+		shorthand string
+		defValue  string
+	}{
+		{flag: "src", shorthand: "f"},
+		{flag: "dst", shorthand: "d"},
+		{flag: "checksum", defValue: "false"},
+		{flag: "delete", defValue: "false"},
+		{flag: "symlinks", defValue: "follow"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.flag, func(t *testing.T) {
+			f := syncCmd.Flags().Lookup(tt.flag)
+			if f == nil {
+				t.Fatalf("%s flag not found", tt.flag)
+			}
+			if f.Shorthand != tt.shorthand {
+				t.Errorf("%s flag shorthand = %q, want %q", tt.flag, f.Shorthand, tt.shorthand)
+			}
+			if f.DefValue != tt.defValue {
+				t.Errorf("%s flag default = %q, want %q", tt.flag, f.DefValue, tt.defValue)
+			}
+		})
+	}
+}
@@ -15,10 +15,14 @@
 package common
 
 import (
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"net"
 	"os"
+	"sync"
+	"time"
 
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
@@ -56,38 +60,140 @@ func makeSigner(keyname string) (signer ssh.Signer, err error) {
 	}
 
 	signer, err = ssh.ParsePrivateKey(buf)
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) {
+		return decryptSigner(keyname, buf)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse private key %s: %w", keyname, err)
 	}
 	return signer, nil
 }
 
+// decryptedSigners caches the signers of passphrase-protected keys by file
+// name, so the passphrase is asked for only once per run.
+var decryptedSigners sync.Map
+
+// decryptSigner parses the passphrase-protected private key buf read from
+// keyname, obtaining the passphrase with ReadSecret.
+func decryptSigner(keyname string, buf []byte) (ssh.Signer, error) {
+	if signer, ok := decryptedSigners.Load(keyname); ok {
+		return signer.(ssh.Signer), nil
+	}
+	passphrase, err := ReadSecret(fmt.Sprintf("Enter passphrase for key '%s': ", keyname), PassphraseEnv)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get passphrase for key %s: %w", keyname, err)
+	}
+	signer, err := ssh.ParsePrivateKeyWithPassphrase(buf, passphrase)
+	clear(passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt private key %s: %w", keyname, err)
+	}
+	decryptedSigners.Store(keyname, signer)
+	return signer, nil
+}
+
+// certTime formats a certificate validity bound for error messages.
+func certTime(t uint64) string {
+	return time.Unix(int64(t), 0).UTC().Format(time.RFC3339)
+}
+
+// CheckCertTime returns an error if cert is not valid at now, naming when
+// it expired or when it becomes valid.
+func CheckCertTime(cert *ssh.Certificate, now time.Time) error {
+	unix := uint64(now.Unix())
+	if unix < cert.ValidAfter {
+		return fmt.Errorf("certificate %q is not valid before %s", cert.KeyId, certTime(cert.ValidAfter))
+	}
+	if cert.ValidBefore != ssh.CertTimeInfinity && unix >= cert.ValidBefore {
+		return fmt.Errorf("certificate %q expired at %s", cert.KeyId, certTime(cert.ValidBefore))
+	}
+	return nil
+}
+
+// makeCertSigner returns a signer presenting the OpenSSH user certificate
+// stored next to keyname as <keyname>-cert.pub, or nil if there is none.
+func makeCertSigner(keyname string, signer ssh.Signer) (ssh.Signer, error) {
+	certFile := keyname + "-cert.pub"
+	data, err := os.ReadFile(certFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read certificate %s: %w", certFile, err)
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse certificate %s: %w", certFile, err)
+	}
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok || cert.CertType != ssh.UserCert {
+		return nil, fmt.Errorf("%s is not an SSH user certificate", certFile)
+	}
+	if err := CheckCertTime(cert, time.Now()); err != nil {
+		return nil, fmt.Errorf("user %w (%s)", err, certFile)
+	}
+	certSigner, err := ssh.NewCertSigner(cert, signer)
+	if err != nil {
+		return nil, fmt.Errorf("certificate %s does not match key %s: %w", certFile, keyname, err)
+	}
+	return certSigner, nil
+}
+
 // MakeKeyring creates an SSH keyring for authentication.
 // It attempts to use the SSH agent if useAgent is true, and also tries to load
-// the key from the specified key file. Returns a slice of SSH signers.
+// the key from the specified key file. Returns a slice of SSH signers. The
+// agent connection stays open for the agent's signers to use.
+//
+// Deprecated: Use LoadKeyring, which takes several keys, and DialAgent,
+// whose connection can be closed.
 func MakeKeyring(key, agentSock string, useAgent bool) []ssh.Signer {
 	signers := []ssh.Signer{}
 
 	if useAgent {
-		aConn, err := net.Dial("unix", agentSock)
+		sshAgent, err := DialAgent(agentSock)
 		if err == nil {
-			defer aConn.Close()
-			sshAgent := agent.NewClient(aConn)
 			aSigners, err := sshAgent.Signers()
 			if err == nil {
-				for _, signer := range aSigners {
-					signers = append(signers, signer)
-				}
+				signers = append(signers, aSigners...)
 			}
 		}
 		// Continue with key-based auth even if agent fails
 	}
 
-	keys := []string{key}
+	keySigners, certErr := LoadKeyring([]string{key})
+	if certErr != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %v\n", certErr)
+	}
+	signers = append(signers, keySigners...)
+
+	if len(signers) == 0 {
+		fmt.Fprintln(os.Stderr, "Warning: No valid SSH authentication methods available")
+	}
+
+	return signers
+}
+
+// LoadKeyring creates an SSH keyring for authentication.
+// It tries to load each of the given key files in order, along with its
+// OpenSSH user certificate if one is stored next to it. Keys held by the SSH
+// agent are not included; see DialAgent. Returns a slice of SSH signers and
+// the errors of the certificates left out, such as expired ones, for the
+// caller to report with the authentication failures they may cause.
+func LoadKeyring(keys []string) ([]ssh.Signer, error) {
+	signers := []ssh.Signer{}
+	var certErrs []error
 
 	for _, keyname := range keys {
 		signer, err := makeSigner(keyname)
 		if err == nil {
+			// Offer the user certificate, if any, before the plain key
+			certSigner, certErr := makeCertSigner(keyname, signer)
+			if certErr != nil {
+				certErrs = append(certErrs, certErr)
+			} else if certSigner != nil {
+				signers = append(signers, certSigner)
+			}
 			signers = append(signers, signer)
 		}
 		// Log error but don't fail - user may have provided an invalid key
@@ -96,9 +202,29 @@ func MakeKeyring(key, agentSock string, useAgent bool) []ssh.Signer {
 		}
 	}
 
-	if len(signers) == 0 {
-		fmt.Fprintln(os.Stderr, "Warning: No valid SSH authentication methods available")
+	return signers, errors.Join(certErrs...)
+}
+
+// Agent is a connection to a running SSH agent. The connection stays open
+// until Close, so the agent can sign for every connection of a session.
+type Agent struct {
+	agent.ExtendedAgent
+	conn net.Conn
+}
+
+// DialAgent connects to the SSH agent listening on the unix socket sock.
+func DialAgent(sock string) (*Agent, error) {
+	if sock == "" {
+		return nil, errors.New("no SSH agent socket, set SSH_AUTH_SOCK or --agentsock")
+	}
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to SSH agent: %w", err)
 	}
+	return &Agent{ExtendedAgent: agent.NewClient(conn), conn: conn}, nil
+}
 
-	return signers
+// Close closes the connection to the agent.
+func (a *Agent) Close() error {
+	return a.conn.Close()
 }
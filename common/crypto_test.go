@@ -15,6 +15,8 @@
 package common
 
 import (
+	crand "crypto/rand"
+	"encoding/pem"
 	"fmt"
 	"github.com/raravena80/ya/test"
 	"golang.org/x/crypto/ssh"
@@ -22,8 +24,11 @@ import (
 	"golang.org/x/crypto/ssh/testdata"
 	"math/rand"
 	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 var (
@@ -188,6 +193,14 @@ func TestMakeKeyring(t *testing.T) {
 			}
 			signers := MakeKeyring(tt.key.Keyname, sshAgentSocket, tt.useagent)
 			returned := signers[0].PublicKey().Marshal()
+			// The agent connection must still be open to sign
+			sig, err := signers[0].Sign(crand.Reader, []byte("data"))
+			if err != nil {
+				t.Fatalf("Sign() error: %v", err)
+			}
+			if err := signers[0].PublicKey().Verify([]byte("data"), sig); err != nil {
+				t.Errorf("Verify() error: %v", err)
+			}
 			// DeepEqual always returns false for functions unless nil
 			// hence converting to string to compare
 			if !reflect.DeepEqual(returned, tt.expected) {
@@ -251,29 +264,23 @@ func TestMakeSignerErrors(t *testing.T) {
 	}
 }
 
-func TestMakeKeyringErrors(t *testing.T) {
+func TestLoadKeyringErrors(t *testing.T) {
 	tests := []struct {
 		name        string
 		key         string
-		agentSock   string
-		useAgent    bool
 		expectEmpty bool
 	}{
 		{name: "Invalid key file",
 			key:         "/tmp/nonexistent_key_xyz",
-			agentSock:   "",
-			useAgent:    false,
 			expectEmpty: true},
-		{name: "Empty key with agent",
+		{name: "Empty key",
 			key:         "",
-			agentSock:   "/tmp/nonexistent_agent",
-			useAgent:    true,
 			expectEmpty: true},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			signers := MakeKeyring(tt.key, tt.agentSock, tt.useAgent)
+			signers, _ := LoadKeyring([]string{tt.key})
 			if tt.expectEmpty && len(signers) != 0 {
 				t.Errorf("Expected empty signers for %s, got %d", tt.name, len(signers))
 			}
@@ -281,6 +288,14 @@ func TestMakeKeyringErrors(t *testing.T) {
 	}
 }
 
+func TestDialAgentErrors(t *testing.T) {
+	for _, sock := range []string{"", "/tmp/nonexistent_agent"} {
+		if _, err := DialAgent(sock); err == nil {
+			t.Errorf("DialAgent(%q) expected an error, got nil", sock)
+		}
+	}
+}
+
 func TestMakeSignerPermissions(t *testing.T) {
 	tests := []struct {
 		name        string
@@ -337,3 +352,122 @@ func TestMakeSignerLargeFile(t *testing.T) {
 		t.Errorf("Unexpected error for large file: %v", err)
 	}
 }
+
+func TestLoadKeyringCertificate(t *testing.T) {
+	now := time.Now()
+	ca := testSigners["ed25519"]
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "id_rsa")
+	if err := os.WriteFile(keyFile, testdata.PEMBytes["rsa"], 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		key     ssh.PublicKey
+		before  time.Time
+		signers int
+		errPart string
+	}{
+		{name: "Valid certificate", key: testPublicKeys["rsa"], before: now.Add(time.Hour), signers: 2},
+		{name: "Expired certificate", key: testPublicKeys["rsa"], before: now.Add(-time.Minute), signers: 1,
+			errPart: `user certificate "user" expired at`},
+		{name: "Certificate for another key", key: testPublicKeys["ecdsa"], before: now.Add(time.Hour), signers: 1,
+			errPart: "does not match key"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cert := &ssh.Certificate{
+				Key:             tt.key,
+				KeyId:           "user",
+				CertType:        ssh.UserCert,
+				ValidPrincipals: []string{"testuser"},
+				ValidAfter:      uint64(now.Add(-time.Hour).Unix()),
+				ValidBefore:     uint64(tt.before.Unix()),
+			}
+			if err := cert.SignCert(crand.Reader, ca); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(keyFile+"-cert.pub", ssh.MarshalAuthorizedKey(cert), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			signers, err := LoadKeyring([]string{keyFile})
+			if (err == nil) != (tt.errPart == "") || (err != nil && !strings.Contains(err.Error(), tt.errPart)) {
+				t.Errorf("LoadKeyring() error = %v, want %q", err, tt.errPart)
+			}
+			if len(signers) != tt.signers {
+				t.Fatalf("LoadKeyring() returned %d signers, want %d", len(signers), tt.signers)
+			}
+			_, isCert := signers[0].PublicKey().(*ssh.Certificate)
+			if isCert != (tt.signers == 2) {
+				t.Errorf("First signer is a certificate: %v, want %v", isCert, tt.signers == 2)
+			}
+		})
+	}
+}
+
+func TestCheckCertTime(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	tests := []struct {
+		name      string
+		after     uint64
+		before    uint64
+		expectErr bool
+	}{
+		{name: "Within validity", after: 1600000000, before: 1800000000},
+		{name: "Forever", after: 0, before: ssh.CertTimeInfinity},
+		{name: "Expired", after: 1600000000, before: 1650000000, expectErr: true},
+		{name: "Not yet valid", after: 1750000000, before: 1800000000, expectErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cert := &ssh.Certificate{ValidAfter: tt.after, ValidBefore: tt.before}
+			if err := CheckCertTime(cert, now); (err != nil) != tt.expectErr {
+				t.Errorf("CheckCertTime() = %v, expectErr %v", err, tt.expectErr)
+			}
+		})
+	}
+}
+
+func TestLoadKeyringEncrypted(t *testing.T) {
+	block, err := ssh.MarshalPrivateKeyWithPassphrase(testPrivateKeys["ed25519"], "", []byte("s3cret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	promptFunc = func(string) ([]byte, error) { return nil, errNoTerminal }
+	defer func() { promptFunc = promptTTY }()
+	t.Setenv(AskpassEnv, "")
+	t.Setenv(sshAskpassEnv, "")
+
+	tests := []struct {
+		name       string
+		passphrase string
+		signers    int
+	}{
+		{name: "Correct passphrase", passphrase: "s3cret", signers: 2},
+		{name: "Wrong passphrase", passphrase: "wrong", signers: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			plain := filepath.Join(dir, "id_rsa")
+			encrypted := filepath.Join(dir, "id_ed25519")
+			if err := os.WriteFile(plain, testdata.PEMBytes["rsa"], 0600); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(encrypted, pem.EncodeToMemory(block), 0600); err != nil {
+				t.Fatal(err)
+			}
+			t.Setenv(PassphraseEnv, tt.passphrase)
+
+			signers, _ := LoadKeyring([]string{encrypted, plain})
+			if len(signers) != tt.signers {
+				t.Fatalf("LoadKeyring() returned %d signers, want %d", len(signers), tt.signers)
+			}
+			if tt.signers == 2 && !reflect.DeepEqual(signers[0].PublicKey().Marshal(), testPublicKeys["ed25519"].Marshal()) {
+				t.Error("Expected the decrypted key to be offered first")
+			}
+		})
+	}
+}
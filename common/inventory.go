@@ -0,0 +1,478 @@
+// Copyright © 2017 Ricardo Aravena <raravena80@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	homedir "github.com/mitchellh/go-homedir"
+	"go.yaml.in/yaml/v3"
+)
+
+// Host holds the connection settings and variables of a single host.
+// Empty connection fields fall back to the global options.
+type Host struct {
+	Name    string            // Name the host is known by in the inventory
+	Address string            // Address to connect to, if different from Name
+	User    string            // User to connect as
+	Port    int               // Port to connect to
+	Key     string            // Private key file to authenticate with
+	Vars    map[string]string // All variables that apply to the host
+}
+
+// Group is a named set of hosts and child groups sharing variables.
+type Group struct {
+	Name     string
+	Hosts    []string
+	Children []string
+	Vars     map[string]string
+}
+
+// Inventory is a set of hosts organised in (possibly nested) groups.
+// It supports a subset of the Ansible INI and YAML inventory formats.
+type Inventory struct {
+	hosts  []string
+	vars   map[string]map[string]string
+	groups map[string]*Group
+}
+
+// Inventory variables that set connection parameters, and their
+// legacy Ansible aliases.
+var (
+	hostVars = []string{"ansible_host", "ansible_ssh_host"}
+	userVars = []string{"ansible_user", "ansible_ssh_user"}
+	portVars = []string{"ansible_port", "ansible_ssh_port"}
+	keyVars  = []string{"ansible_ssh_private_key_file", "ansible_private_key_file"}
+)
+
+// newInventory creates an empty inventory with the implicit "all" group.
+func newInventory() *Inventory {
+	return &Inventory{
+		vars:   map[string]map[string]string{},
+		groups: map[string]*Group{"all": {Name: "all", Vars: map[string]string{}}},
+	}
+}
+
+// LoadInventory reads an inventory file. Files ending in .yaml, .yml or
+// .json are parsed as YAML inventories, anything else as INI.
+func LoadInventory(path string) (*Inventory, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read inventory %s: %w", path, err)
+	}
+	var inv *Inventory
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml", ".json":
+		inv, err = parseYAMLInventory(data)
+	default:
+		inv, err = parseINIInventory(data)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse inventory %s: %w", path, err)
+	}
+	return inv, nil
+}
+
+// group returns the named group, creating it if needed.
+func (inv *Inventory) group(name string) *Group {
+	g, ok := inv.groups[name]
+	if !ok {
+		g = &Group{Name: name, Vars: map[string]string{}}
+		inv.groups[name] = g
+	}
+	return g
+}
+
+// addHost adds host to group with the given host variables.
+func (inv *Inventory) addHost(group, host string, vars map[string]string) {
+	if _, ok := inv.vars[host]; !ok {
+		inv.hosts = append(inv.hosts, host)
+		inv.vars[host] = map[string]string{}
+	}
+	for k, v := range vars {
+		inv.vars[host][k] = v
+	}
+	g := inv.group(group)
+	for _, h := range g.Hosts {
+		if h == host {
+			return
+		}
+	}
+	g.Hosts = append(g.Hosts, host)
+}
+
+// addChild makes child a child group of parent.
+func (inv *Inventory) addChild(parent, child string) {
+	g := inv.group(parent)
+	inv.group(child)
+	for _, c := range g.Children {
+		if c == child {
+			return
+		}
+	}
+	g.Children = append(g.Children, child)
+}
+
+// Groups returns the names of all groups in the inventory, sorted.
+func (inv *Inventory) Groups() []string {
+	names := make([]string, 0, len(inv.groups))
+	for name := range inv.groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// groupHosts adds the hosts of group and its descendants to seen.
+func (inv *Inventory) groupHosts(name string, seen map[string]bool, visiting map[string]bool) error {
+	if name == "all" {
+		for _, h := range inv.hosts {
+			seen[h] = true
+		}
+		return nil
+	}
+	g, ok := inv.groups[name]
+	if !ok {
+		return fmt.Errorf("unknown inventory group %q", name)
+	}
+	if visiting[name] {
+		return fmt.Errorf("inventory group %q is its own descendant", name)
+	}
+	visiting[name] = true
+	defer delete(visiting, name)
+
+	for _, h := range g.Hosts {
+		seen[h] = true
+	}
+	for _, c := range g.Children {
+		if err := inv.groupHosts(c, seen, visiting); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// depth returns how deeply nested group is below "all". Variables of deeper
+// groups take precedence over those of their parents.
+func (inv *Inventory) depth(name string, visiting map[string]bool) int {
+	if visiting[name] {
+		return 0
+	}
+	visiting[name] = true
+	defer delete(visiting, name)
+
+	d := 0
+	for _, g := range inv.groups {
+		for _, c := range g.Children {
+			if c == name && g.Name != "all" {
+				if pd := inv.depth(g.Name, visiting) + 1; pd > d {
+					d = pd
+				}
+			}
+		}
+	}
+	return d
+}
+
+// hostGroups returns the groups host belongs to directly or through child
+// groups, ordered from least to most specific.
+func (inv *Inventory) hostGroups(host string) []string {
+	var names []string
+	for name := range inv.groups {
+		if name == "all" {
+			continue
+		}
+		seen := map[string]bool{}
+		if inv.groupHosts(name, seen, map[string]bool{}) == nil && seen[host] {
+			names = append(names, name)
+		}
+	}
+	depths := make(map[string]int, len(names))
+	for _, n := range names {
+		depths[n] = inv.depth(n, map[string]bool{})
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if depths[names[i]] != depths[names[j]] {
+			return depths[names[i]] < depths[names[j]]
+		}
+		return names[i] < names[j]
+	})
+	return names
+}
+
+// Resolve returns the hosts in the given groups (every host when no group is
+// given) in inventory order. Each host's variables are merged from the "all"
+// group, its parent groups, its own groups and finally its host variables,
+// and its connection settings are taken from the resulting variables.
+func (inv *Inventory) Resolve(groups []string) ([]Host, error) {
+	if len(groups) == 0 {
+		groups = []string{"all"}
+	}
+	selected := map[string]bool{}
+	for _, name := range groups {
+		if err := inv.groupHosts(name, selected, map[string]bool{}); err != nil {
+			return nil, err
+		}
+	}
+
+	var hosts []Host
+	for _, name := range inv.hosts {
+		if !selected[name] {
+			continue
+		}
+		vars := map[string]string{}
+		for k, v := range inv.groups["all"].Vars {
+			vars[k] = v
+		}
+		for _, g := range inv.hostGroups(name) {
+			for k, v := range inv.groups[g].Vars {
+				vars[k] = v
+			}
+		}
+		for k, v := range inv.vars[name] {
+			vars[k] = v
+		}
+		vars["inventory_hostname"] = name
+
+		host, err := newHost(name, vars)
+		if err != nil {
+			return nil, err
+		}
+		hosts = append(hosts, host)
+	}
+	return hosts, nil
+}
+
+// newHost builds a Host from its resolved variables.
+func newHost(name string, vars map[string]string) (Host, error) {
+	h := Host{
+		Name:    name,
+		Address: lookupVar(vars, hostVars),
+		User:    lookupVar(vars, userVars),
+		Key:     lookupVar(vars, keyVars),
+		Vars:    vars,
+	}
+	if h.Key != "" {
+		key, err := homedir.Expand(h.Key)
+		if err != nil {
+			return Host{}, fmt.Errorf("invalid private key %q for inventory host %s: %w", h.Key, name, err)
+		}
+		h.Key = key
+	}
+	if p := lookupVar(vars, portVars); p != "" {
+		port, err := strconv.Atoi(p)
+		if err != nil || port <= 0 || port > 65535 {
+			return Host{}, fmt.Errorf("invalid port %q for inventory host %s", p, name)
+		}
+		h.Port = port
+	}
+	return h, nil
+}
+
+// lookupVar returns the value of the first of names set in vars.
+func lookupVar(vars map[string]string, names []string) string {
+	for _, n := range names {
+		if v, ok := vars[n]; ok {
+			return v
+		}
+	}
+	return ""
+}
+
+// parseINIInventory parses an Ansible style INI inventory:
+//
+//	host0 ansible_port=2222
+//	[web]
+//	web1 ansible_host=10.0.0.1 ansible_user=deploy
+//	[web:vars]
+//	http_port=8080
+//	[prod:children]
+//	web
+func parseINIInventory(data []byte) (*Inventory, error) {
+	inv := newInventory()
+	section, kind := "ungrouped", ""
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") {
+				return nil, fmt.Errorf("line %d: malformed section %q", lineNo, line)
+			}
+			section, kind = strings.TrimSuffix(strings.TrimPrefix(line, "["), "]"), ""
+			if i := strings.Index(section, ":"); i >= 0 {
+				section, kind = section[:i], section[i+1:]
+			}
+			if kind != "" && kind != "vars" && kind != "children" {
+				return nil, fmt.Errorf("line %d: unknown section type %q", lineNo, kind)
+			}
+			inv.group(section)
+			continue
+		}
+
+		fields, err := splitFields(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+		switch kind {
+		case "vars":
+			k, v, ok := strings.Cut(line, "=")
+			if !ok {
+				return nil, fmt.Errorf("line %d: expected key=value, got %q", lineNo, line)
+			}
+			inv.group(section).Vars[strings.TrimSpace(k)] = unquote(strings.TrimSpace(v))
+		case "children":
+			inv.addChild(section, fields[0])
+		default:
+			vars := map[string]string{}
+			for _, f := range fields[1:] {
+				k, v, ok := strings.Cut(f, "=")
+				if !ok {
+					return nil, fmt.Errorf("line %d: expected key=value, got %q", lineNo, f)
+				}
+				vars[k] = unquote(v)
+			}
+			inv.addHost(section, fields[0], vars)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return inv, nil
+}
+
+// splitFields splits an INI host line on whitespace, keeping quoted values
+// together.
+func splitFields(line string) ([]string, error) {
+	var fields []string
+	var cur strings.Builder
+	var quote rune
+	for _, r := range line {
+		switch {
+		case quote != 0:
+			cur.WriteRune(r)
+			if r == quote {
+				quote = 0
+			}
+		case r == '"' || r == '\'':
+			quote = r
+			cur.WriteRune(r)
+		case r == ' ' || r == '\t':
+			if cur.Len() > 0 {
+				fields = append(fields, cur.String())
+				cur.Reset()
+			}
+		default:
+			cur.WriteRune(r)
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quote in %q", line)
+	}
+	if cur.Len() > 0 {
+		fields = append(fields, cur.String())
+	}
+	return fields, nil
+}
+
+// unquote strips matching single or double quotes around s.
+func unquote(s string) string {
+	if len(s) >= 2 && (s[0] == '"' || s[0] == '\'') && s[len(s)-1] == s[0] {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
+
+// yamlGroup is a group in a YAML inventory.
+type yamlGroup struct {
+	Hosts    map[string]map[string]interface{} `yaml:"hosts"`
+	Vars     map[string]interface{}            `yaml:"vars"`
+	Children map[string]*yamlGroup             `yaml:"children"`
+}
+
+// parseYAMLInventory parses an Ansible style YAML inventory:
+//
+//	all:
+//	  vars:
+//	    ansible_user: deploy
+//	  children:
+//	    web:
+//	      hosts:
+//	        web1:
+//	          ansible_host: 10.0.0.1
+func parseYAMLInventory(data []byte) (*Inventory, error) {
+	var top map[string]*yamlGroup
+	if err := yaml.Unmarshal(data, &top); err != nil {
+		return nil, err
+	}
+	inv := newInventory()
+	for _, name := range sortedKeys(top) {
+		inv.addYAMLGroup(name, top[name])
+	}
+	return inv, nil
+}
+
+// addYAMLGroup adds a YAML group and its descendants to the inventory.
+func (inv *Inventory) addYAMLGroup(name string, g *yamlGroup) {
+	group := inv.group(name)
+	if g == nil {
+		return
+	}
+	for k, v := range g.Vars {
+		group.Vars[k] = yamlString(v)
+	}
+	for _, host := range sortedKeys(g.Hosts) {
+		vars := map[string]string{}
+		for k, v := range g.Hosts[host] {
+			vars[k] = yamlString(v)
+		}
+		inv.addHost(name, host, vars)
+	}
+	for _, child := range sortedKeys(g.Children) {
+		inv.addChild(name, child)
+		inv.addYAMLGroup(child, g.Children[child])
+	}
+}
+
+// yamlString converts a scalar YAML value to its string form.
+func yamlString(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+	return fmt.Sprint(v)
+}
+
+// sortedKeys returns the keys of m in sorted order.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,216 @@
+// Copyright © 2017 Ricardo Aravena <raravena80@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	homedir "github.com/mitchellh/go-homedir"
+)
+
+const iniInventory = `
+# Ungrouped hosts
+bastion ansible_port=2200 ansible_ssh_private_key_file=~/.ssh/prod_key
+
+[web]
+web1 ansible_host=10.0.0.1
+web2 ansible_user=admin http_port=9090
+
+[db]
+db1 ansible_ssh_private_key_file="/keys/db key"
+
+[web:vars]
+http_port=8080
+ansible_user=www
+
+[prod:children]
+web
+db
+
+[prod:vars]
+ansible_user=deploy
+env=prod
+
+[all:vars]
+env=dev
+ansible_port=22
+`
+
+const yamlInventory = `
+all:
+  vars:
+    env: dev
+    ansible_port: 22
+  hosts:
+    bastion:
+      ansible_port: 2200
+      ansible_ssh_private_key_file: ~/.ssh/prod_key
+  children:
+    prod:
+      vars:
+        ansible_user: deploy
+        env: prod
+      children:
+        web:
+          vars:
+            http_port: 8080
+            ansible_user: www
+          hosts:
+            web1:
+              ansible_host: 10.0.0.1
+            web2:
+              ansible_user: admin
+              http_port: 9090
+        db:
+          hosts:
+            db1:
+              ansible_ssh_private_key_file: /keys/db key
+`
+
+// writeInventory writes an inventory to a temporary file named name.
+func writeInventory(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadInventory(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+	}{
+		{name: "INI inventory", file: "hosts", content: iniInventory},
+		{name: "YAML inventory", file: "hosts.yaml", content: yamlInventory},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inv, err := LoadInventory(writeInventory(t, tt.file, tt.content))
+			if err != nil {
+				t.Fatalf("LoadInventory() error: %v", err)
+			}
+
+			hosts, err := inv.Resolve([]string{"prod"})
+			if err != nil {
+				t.Fatalf("Resolve() error: %v", err)
+			}
+			byName := map[string]Host{}
+			for _, h := range hosts {
+				byName[h.Name] = h
+			}
+			if len(byName) != 3 {
+				t.Fatalf("Expected web1, web2 and db1 in prod, got %v", hosts)
+			}
+
+			web1 := byName["web1"]
+			if web1.Address != "10.0.0.1" || web1.User != "www" || web1.Port != 22 {
+				t.Errorf("web1 = %+v, want address 10.0.0.1, user www, port 22", web1)
+			}
+			if web1.Vars["http_port"] != "8080" || web1.Vars["env"] != "prod" {
+				t.Errorf("web1 vars = %v, want group and parent vars applied", web1.Vars)
+			}
+
+			web2 := byName["web2"]
+			if web2.User != "admin" || web2.Vars["http_port"] != "9090" {
+				t.Errorf("web2 = %+v, want host vars to override group vars", web2)
+			}
+
+			db1 := byName["db1"]
+			if db1.User != "deploy" || db1.Key != "/keys/db key" || db1.Address != "" {
+				t.Errorf("db1 = %+v, want user deploy and key /keys/db key", db1)
+			}
+
+			all, err := inv.Resolve(nil)
+			if err != nil {
+				t.Fatalf("Resolve(nil) error: %v", err)
+			}
+			if len(all) != 4 {
+				t.Errorf("Expected 4 hosts in the inventory, got %d", len(all))
+			}
+			home, err := homedir.Dir()
+			if err != nil {
+				t.Fatal(err)
+			}
+			key := filepath.Join(home, ".ssh", "prod_key")
+			for _, h := range all {
+				if h.Name == "bastion" && (h.Port != 2200 || h.Vars["env"] != "dev" || h.Key != key) {
+					t.Errorf("bastion = %+v, want port 2200, env dev and key %s", h, key)
+				}
+			}
+		})
+	}
+}
+
+func TestInventoryOrder(t *testing.T) {
+	inv, err := parseINIInventory([]byte("[web]\nweb3\nweb1\nweb2\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts, err := inv.Resolve([]string{"web"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, h := range hosts {
+		names = append(names, h.Name)
+	}
+	if want := []string{"web3", "web1", "web2"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("Resolve() order = %v, want %v", names, want)
+	}
+}
+
+func TestInventoryErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		groups  []string
+	}{
+		{name: "Malformed section", content: "[web\nhost1\n"},
+		{name: "Unknown section type", content: "[web:hosts]\nhost1\n"},
+		{name: "Host variable without value", content: "host1 ansible_port\n"},
+		{name: "Group variable without value", content: "[web:vars]\nhttp_port\n"},
+		{name: "Unterminated quote", content: "host1 ansible_user='deploy\n"},
+		{name: "Invalid port", content: "host1 ansible_port=ssh\n", groups: []string{"all"}},
+		{name: "Unknown group", content: "host1\n", groups: []string{"missing"}},
+		{name: "Cyclic children", content: "[a:children]\nb\n[b:children]\na\n", groups: []string{"a"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inv, err := parseINIInventory([]byte(tt.content))
+			if err == nil {
+				_, err = inv.Resolve(tt.groups)
+			}
+			if err == nil {
+				t.Error("Expected an error, got nil")
+			}
+		})
+	}
+}
+
+func TestLoadInventoryMissing(t *testing.T) {
+	if _, err := LoadInventory(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Error("Expected error for missing inventory file")
+	}
+	if _, err := LoadInventory(writeInventory(t, "bad.yml", "all: [")); err == nil {
+		t.Error("Expected error for invalid YAML inventory")
+	}
+}
@@ -24,21 +24,48 @@ type Options struct {
 	CommandTimeout *int // Optional override for command execution timeout in seconds
 	User           string
 	Cmd            string
-	Key            string
+	Keys           []string // Private key files to try in order, empty to use the default keys
 	Src            string
 	Dst            string
 	AgentSock      string
 	Op             string
 	UseAgent       bool
 	IsRecursive    bool
+	FromRemote     bool   // Copy Src from the remote hosts into Dst instead
+	Protocol       string // Transfer protocol: "auto" (default), "scp" or "sftp"
+	Preserve       bool   // Keep access and modification times, and ownership over SFTP
+	Symlinks       string // Symlinks in copied trees: "follow" (default), "link" or "skip"
+	Checksum       bool   // Sync compares files by SHA-256 instead of size and mtime
+	Delete         bool   // Sync removes remote files missing from the source
+	Verify         string // Digest to check copies with after the transfer: "sha256", empty to not check
+	Relay          int    // Hosts every host with the file sends it on to, 0 to send it to all hosts from here
+	Retries        int    // Times a failed copy to a host is retried
+	RetryDelay     int    // Seconds before the first retry, doubled for every further one
+	LimitRate      string // Transfer rate limit per host in bytes per second, such as "10M"
+	TotalRate      string // Transfer rate limit shared by all hosts, such as "100M"
+	Atomic         bool   // Copy to a staging path and rename it into place once complete
+	Backup         bool   // Keep the replaced version as <dst>.ya-bak.<time>, implies Atomic
 	IsVerbose      bool
-	KnownHosts     string
-	InsecureHost   bool
+	KnownHosts     string // Comma-separated known_hosts files, empty for ~/.ssh/known_hosts
+	InsecureHost   bool   // Skip host key verification
+	AcceptNewHosts bool   // Trust and record keys of hosts missing from known_hosts
+	HostCAs        []string // Files with CA keys trusted to sign host certificates
 	OutputFormat   string // Output format: "text", "json", "yaml", "table"
 	DryRun         bool   // Preview operations without executing
 	HostPatterns   []string // Host patterns to include
 	HostExcludes   []string // Host patterns to exclude
 	ShowProgress   bool   // Show progress indicators for transfers
+	Forks          int    // Maximum number of hosts to run on concurrently, 0 means no limit
+	Batch          string // Hosts per wave as a count ("10") or percentage ("25%")
+	MaxFailPercent *int   // Optional failure percentage per wave above which the rollout stops
+	Stream         bool   // Write remote output live, one prefixed line at a time
+	Color          bool   // Colorize the hostname prefix of streamed output
+	Hosts          map[string]Host // Per-host connection settings, keyed by machine name
+	SSHConfig      string          // OpenSSH client config file, "none" to ignore ~/.ssh/config
+	Jump           string          // Comma-separated jump hosts to connect through
+	AskPass        bool            // Prompt once for a password used with every host
+	PasswordFile   string          // File holding the password used with every host
+	ForwardAgent   bool            // Forward the SSH agent to remote commands
 }
 
 // SetUser Sets user for ssh session
@@ -70,10 +97,103 @@ func SetMachines(m []string) func(*Options) {
 	}
 }
 
-// SetKey Sets the key we are going to use to ssh connect
+// SetHosts Sets per-host connection settings, such as those resolved
+// from an inventory, keyed by host name
+func SetHosts(hosts []Host) func(*Options) {
+	return func(e *Options) {
+		e.Hosts = make(map[string]Host, len(hosts))
+		for _, h := range hosts {
+			e.Hosts[h.Name] = h
+		}
+	}
+}
+
+// SetSSHConfig Sets the OpenSSH client config file to read host settings
+// from, or "none" to not read any
+func SetSSHConfig(c string) func(*Options) {
+	return func(e *Options) {
+		e.SSHConfig = c
+	}
+}
+
+// SetJump Sets the comma-separated chain of jump hosts, as
+// [user@]host[:port] entries, that every host is reached through
+func SetJump(j string) func(*Options) {
+	return func(e *Options) {
+		e.Jump = j
+	}
+}
+
+// SetForwardAgent Sets whether remote commands can use our SSH agent
+func SetForwardAgent(f bool) func(*Options) {
+	return func(e *Options) {
+		e.ForwardAgent = f
+	}
+}
+
+// SetAskPass Sets whether to prompt for a password to authenticate with
+func SetAskPass(a bool) func(*Options) {
+	return func(e *Options) {
+		e.AskPass = a
+	}
+}
+
+// SetPasswordFile Sets the file the password to authenticate with is read from
+func SetPasswordFile(f string) func(*Options) {
+	return func(e *Options) {
+		e.PasswordFile = f
+	}
+}
+
+// SetForks Sets the maximum number of hosts to run on concurrently
+func SetForks(f int) func(*Options) {
+	return func(e *Options) {
+		e.Forks = f
+	}
+}
+
+// SetBatch Sets the number ("10") or percentage ("25%") of hosts per wave
+func SetBatch(b string) func(*Options) {
+	return func(e *Options) {
+		e.Batch = b
+	}
+}
+
+// SetMaxFailPercent Sets the failure percentage per wave that stops the rollout
+func SetMaxFailPercent(p int) func(*Options) {
+	return func(e *Options) {
+		e.MaxFailPercent = &p
+	}
+}
+
+// SetStream Enables live, line-prefixed output while commands run
+func SetStream(s bool) func(*Options) {
+	return func(e *Options) {
+		e.Stream = s
+	}
+}
+
+// SetColor Enables colorized hostname prefixes for streamed output
+func SetColor(c bool) func(*Options) {
+	return func(e *Options) {
+		e.Color = c
+	}
+}
+
+// SetKey Adds a key we are going to use to ssh connect, it can be given
+// more than once to try several keys
 func SetKey(k string) func(*Options) {
 	return func(e *Options) {
-		e.Key = k
+		if k != "" {
+			e.Keys = append(e.Keys, k)
+		}
+	}
+}
+
+// SetKeys Sets the keys we are going to use to ssh connect, tried in order
+func SetKeys(k []string) func(*Options) {
+	return func(e *Options) {
+		e.Keys = k
 	}
 }
 
@@ -126,6 +246,99 @@ func SetIsRecursive(r bool) func(*Options) {
 	}
 }
 
+// SetFromRemote Sets whether to copy files from the remote hosts, into a
+// local directory per host, instead of to them
+func SetFromRemote(f bool) func(*Options) {
+	return func(e *Options) {
+		e.FromRemote = f
+	}
+}
+
+// SetProtocol Sets the protocol files are transferred with: "sftp", "scp"
+// or "auto" to use SFTP when the server offers it
+func SetProtocol(p string) func(*Options) {
+	return func(e *Options) {
+		e.Protocol = p
+	}
+}
+
+// SetPreserve Sets whether copies keep the access and modification times
+// of the source files, and their ownership where the protocol allows it
+func SetPreserve(p bool) func(*Options) {
+	return func(e *Options) {
+		e.Preserve = p
+	}
+}
+
+// SetSymlinks Sets how symlinks in copied trees are handled: "follow" to
+// copy what they point to, "link" to recreate them or "skip"
+func SetSymlinks(s string) func(*Options) {
+	return func(e *Options) {
+		e.Symlinks = s
+	}
+}
+
+// SetChecksum Sets whether sync compares files of the same size by their
+// SHA-256 rather than by their modification time
+func SetChecksum(c bool) func(*Options) {
+	return func(e *Options) {
+		e.Checksum = c
+	}
+}
+
+// SetDelete Sets whether sync removes remote files that are not in the
+// source directory
+func SetDelete(d bool) func(*Options) {
+	return func(e *Options) {
+		e.Delete = d
+	}
+}
+
+// SetVerify Sets the digest, "sha256", used to check every copy once it
+// has been transferred
+func SetVerify(v string) func(*Options) {
+	return func(e *Options) {
+		e.Verify = v
+	}
+}
+
+// SetRelay Sets how many hosts each host that has the file sends it on to,
+// 0 to send it to every host directly
+func SetRelay(r int) func(*Options) {
+	return func(e *Options) {
+		e.Relay = r
+	}
+}
+
+// SetAtomic Sets whether copies are put in place only once complete
+func SetAtomic(a bool) func(*Options) {
+	return func(e *Options) {
+		e.Atomic = a
+	}
+}
+
+// SetBackup Sets whether copies keep the version they replace as a backup
+func SetBackup(b bool) func(*Options) {
+	return func(e *Options) {
+		e.Backup = b
+	}
+}
+
+// SetRetries Sets how many times a failed copy to a host is retried
+func SetRetries(r int) func(*Options) {
+	return func(e *Options) {
+		e.Retries = r
+	}
+}
+
+// SetRetryDelay Sets the seconds to wait before retrying a failed copy,
+// doubled for every further retry
+func SetRetryDelay(d int) func(*Options) {
+	return func(e *Options) {
+		e.RetryDelay = d
+	}
+}
+
 // SetVerbose Sets high verbosity
 func SetVerbose(v bool) func(*Options) {
 	return func(e *Options) {
@@ -133,7 +346,8 @@ func SetVerbose(v bool) func(*Options) {
 	}
 }
 
-// SetKnownHosts Sets the known_hosts file path for SSH host key verification
+// SetKnownHosts Sets the known_hosts file path, or comma-separated paths,
+// for SSH host key verification
 func SetKnownHosts(k string) func(*Options) {
 	return func(e *Options) {
 		e.KnownHosts = k
@@ -147,6 +361,22 @@ func SetInsecureHost(i bool) func(*Options) {
 	}
 }
 
+// SetAcceptNewHosts Sets whether keys of hosts not yet in known_hosts are
+// accepted and added to it, while changed keys are still rejected
+func SetAcceptNewHosts(a bool) func(*Options) {
+	return func(e *Options) {
+		e.AcceptNewHosts = a
+	}
+}
+
+// SetHostCAs Sets the files holding the CA public keys trusted to sign
+// host certificates
+func SetHostCAs(c []string) func(*Options) {
+	return func(e *Options) {
+		e.HostCAs = c
+	}
+}
+
 // SetConnectTimeout Sets the connection timeout in seconds (overrides default Timeout)
 func SetConnectTimeout(t int) func(*Options) {
 	return func(e *Options) {
@@ -195,3 +425,19 @@ func SetShowProgress(p bool) func(*Options) {
 		e.ShowProgress = p
 	}
 }
+
+// SetLimitRate Sets the transfer rate limit of every host, in bytes per
+// second with an optional K, M or G suffix
+func SetLimitRate(r string) func(*Options) {
+	return func(e *Options) {
+		e.LimitRate = r
+	}
+}
+
+// SetTotalRate Sets the transfer rate limit shared by all hosts, in bytes
+// per second with an optional K, M or G suffix
+func SetTotalRate(r string) func(*Options) {
+	return func(e *Options) {
+		e.TotalRate = r
+	}
+}
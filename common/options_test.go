@@ -328,3 +328,49 @@ func TestSetShowProgress(t *testing.T) {
 		})
 	}
 }
+
+func TestSetRolloutOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		forks   int
+		batch   string
+		maxFail int
+	}{
+		{name: "Limit forks with fixed batch", forks: 10, batch: "5", maxFail: 0},
+		{name: "Percentage batch", forks: 0, batch: "25%", maxFail: 50},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opt := Options{}
+			SetForks(tt.forks)(&opt)
+			SetBatch(tt.batch)(&opt)
+			SetMaxFailPercent(tt.maxFail)(&opt)
+			if opt.Forks != tt.forks {
+				t.Errorf("SetForks() = %v, want %v", opt.Forks, tt.forks)
+			}
+			if opt.Batch != tt.batch {
+				t.Errorf("SetBatch() = %v, want %v", opt.Batch, tt.batch)
+			}
+			if opt.MaxFailPercent == nil || *opt.MaxFailPercent != tt.maxFail {
+				t.Errorf("SetMaxFailPercent() = %v, want %v", opt.MaxFailPercent, tt.maxFail)
+			}
+		})
+	}
+}
+
+func TestSetHosts(t *testing.T) {
+	opt := Options{}
+	SetHosts([]Host{
+		{Name: "web1", User: "deploy", Port: 2222},
+		{Name: "db1", Key: "/keys/db"},
+	})(&opt)
+	if len(opt.Hosts) != 2 {
+		t.Fatalf("SetHosts() = %v, want 2 hosts", opt.Hosts)
+	}
+	if h := opt.Hosts["web1"]; h.User != "deploy" || h.Port != 2222 {
+		t.Errorf("Hosts[web1] = %+v, want user deploy and port 2222", h)
+	}
+	if h := opt.Hosts["db1"]; h.Key != "/keys/db" {
+		t.Errorf("Hosts[db1] = %+v, want key /keys/db", h)
+	}
+}
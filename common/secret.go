@@ -0,0 +1,98 @@
+// Copyright © 2017 Ricardo Aravena <raravena80@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+
+	"golang.org/x/term"
+)
+
+const (
+	// PassphraseEnv is the environment variable holding the passphrase of
+	// encrypted private keys
+	PassphraseEnv = "YA_KEY_PASSPHRASE"
+	// AskpassEnv is the environment variable naming a helper program that
+	// prints a secret, called with the prompt as its only argument
+	AskpassEnv = "YA_ASKPASS"
+	// sshAskpassEnv is the OpenSSH askpass helper, used when there is no
+	// terminal to prompt on
+	sshAskpassEnv = "SSH_ASKPASS"
+)
+
+// errNoTerminal is returned by promptTTY when there is no terminal.
+var errNoTerminal = errors.New("no terminal to prompt on")
+
+// promptFunc reads a secret from the terminal. It can be replaced for testing.
+var promptFunc = promptTTY
+
+// ReadSecret obtains a secret, such as a key passphrase or a password. It is
+// taken from the environment variable env if set, otherwise from the
+// $YA_ASKPASS helper, a terminal prompt or the $SSH_ASKPASS helper, in that
+// order. The secret is never echoed.
+func ReadSecret(prompt, env string) ([]byte, error) {
+	if env != "" {
+		if v, ok := os.LookupEnv(env); ok {
+			return []byte(v), nil
+		}
+	}
+	if helper := os.Getenv(AskpassEnv); helper != "" {
+		return askpass(helper, prompt)
+	}
+	secret, err := promptFunc(prompt)
+	if errors.Is(err, errNoTerminal) {
+		if helper := os.Getenv(sshAskpassEnv); helper != "" {
+			return askpass(helper, prompt)
+		}
+	}
+	return secret, err
+}
+
+// askpass runs an askpass-style helper with prompt as its argument and
+// returns the first line it prints.
+func askpass(helper, prompt string) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command(helper, prompt)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("askpass helper %s failed: %w %s", helper, err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	if i := bytes.IndexByte(out, '\n'); i >= 0 {
+		out = out[:i]
+	}
+	return bytes.TrimSuffix(out, []byte("\r")), nil
+}
+
+// promptTTY writes prompt to the controlling terminal and reads a line from
+// it with echo turned off.
+func promptTTY(prompt string) ([]byte, error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return nil, errNoTerminal
+	}
+	defer tty.Close()
+	if !term.IsTerminal(int(tty.Fd())) {
+		return nil, errNoTerminal
+	}
+	fmt.Fprint(tty, prompt)
+	secret, err := term.ReadPassword(int(tty.Fd()))
+	fmt.Fprintln(tty)
+	return secret, err
+}
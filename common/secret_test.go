@@ -0,0 +1,92 @@
+// Copyright © 2017 Ricardo Aravena <raravena80@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeAskpass writes an askpass helper script printing out.
+func writeAskpass(t *testing.T, out string) string {
+	path := filepath.Join(t.TempDir(), "askpass")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\nprintf '"+out+"'\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadSecret(t *testing.T) {
+	tests := []struct {
+		name       string
+		env        string
+		askpass    string
+		sshAskpass string
+		tty        bool
+		want       string
+		expectErr  bool
+	}{
+		{name: "Environment variable wins", env: "from-env", askpass: "from-askpass\\n", tty: true, want: "from-env"},
+		{name: "Askpass helper", askpass: "from-askpass\\nignored\\n", tty: true, want: "from-askpass"},
+		{name: "Terminal prompt", sshAskpass: "from-ssh-askpass", tty: true, want: "from-tty"},
+		{name: "SSH_ASKPASS without a terminal", sshAskpass: "from-ssh-askpass\\r\\n", want: "from-ssh-askpass"},
+		{name: "Nothing to read from", expectErr: true},
+	}
+	defer func() { promptFunc = promptTTY }()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.env != "" {
+				t.Setenv("YA_TEST_SECRET", tt.env)
+			}
+			t.Setenv(AskpassEnv, "")
+			if tt.askpass != "" {
+				t.Setenv(AskpassEnv, writeAskpass(t, tt.askpass))
+			}
+			t.Setenv(sshAskpassEnv, "")
+			if tt.sshAskpass != "" {
+				t.Setenv(sshAskpassEnv, writeAskpass(t, tt.sshAskpass))
+			}
+			promptFunc = func(prompt string) ([]byte, error) {
+				if !tt.tty {
+					return nil, errNoTerminal
+				}
+				return []byte("from-tty"), nil
+			}
+
+			got, err := ReadSecret("Secret: ", "YA_TEST_SECRET")
+			if tt.expectErr {
+				if err == nil {
+					t.Errorf("Expected an error, got %q", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ReadSecret() error: %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("ReadSecret() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadSecretAskpassFailure(t *testing.T) {
+	t.Setenv(AskpassEnv, filepath.Join(t.TempDir(), "missing"))
+	if _, err := ReadSecret("Secret: ", ""); err == nil {
+		t.Error("Expected an error for a missing askpass helper")
+	}
+}
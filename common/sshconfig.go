@@ -0,0 +1,245 @@
+// Copyright © 2017 Ricardo Aravena <raravena80@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	homedir "github.com/mitchellh/go-homedir"
+)
+
+// maxIncludeDepth limits nested Include directives, as OpenSSH does.
+const maxIncludeDepth = 16
+
+// SSHHostConfig holds the OpenSSH client settings that apply to one host.
+type SSHHostConfig struct {
+	HostName      string
+	User          string
+	Port          int
+	IdentityFiles []string
+	ProxyJump     string
+}
+
+// SSHConfig is a parsed OpenSSH client configuration file. Only Host
+// stanzas (including wildcard and negated patterns) and Include directives
+// are supported; Match stanzas are skipped.
+type SSHConfig struct {
+	blocks []sshConfigBlock
+}
+
+// sshConfigBlock is a Host stanza with its settings in file order.
+// A nil pattern list matches every host, for settings before any Host line.
+type sshConfigBlock struct {
+	patterns []string
+	match    bool // False for Match stanzas, which never apply
+	settings [][2]string
+}
+
+// LoadSSHConfig parses the OpenSSH client config file at path. Relative
+// Include paths are resolved against ~/.ssh, as for the user config file.
+func LoadSSHConfig(path string) (*SSHConfig, error) {
+	cfg := &SSHConfig{blocks: []sshConfigBlock{{match: true}}}
+	if err := cfg.parseFile(path, 0); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// parseFile adds the stanzas of the file at name to the config.
+func (c *SSHConfig) parseFile(name string, depth int) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return fmt.Errorf("failed to read ssh config: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value := splitConfigLine(line)
+		if value == "" {
+			return fmt.Errorf("%s:%d: missing value for %s", name, lineNo, key)
+		}
+
+		switch strings.ToLower(key) {
+		case "host":
+			patterns, err := configArgs(value)
+			if err != nil {
+				return fmt.Errorf("%s:%d: %w", name, lineNo, err)
+			}
+			c.blocks = append(c.blocks, sshConfigBlock{patterns: patterns, match: true})
+		case "match":
+			c.blocks = append(c.blocks, sshConfigBlock{})
+		case "include":
+			if depth >= maxIncludeDepth {
+				return fmt.Errorf("%s:%d: too many nested includes", name, lineNo)
+			}
+			patterns, err := configArgs(value)
+			if err != nil {
+				return fmt.Errorf("%s:%d: %w", name, lineNo, err)
+			}
+			enclosing, n := c.blocks[len(c.blocks)-1], len(c.blocks)
+			for _, pattern := range patterns {
+				if err := c.include(pattern, depth+1); err != nil {
+					return fmt.Errorf("%s:%d: %w", name, lineNo, err)
+				}
+			}
+			// Settings after the Include belong to the enclosing stanza again
+			if len(c.blocks) != n {
+				c.blocks = append(c.blocks, sshConfigBlock{patterns: enclosing.patterns, match: enclosing.match})
+			}
+		default:
+			b := &c.blocks[len(c.blocks)-1]
+			b.settings = append(b.settings, [2]string{strings.ToLower(key), unquote(value)})
+		}
+	}
+	return scanner.Err()
+}
+
+// include parses every file matching pattern. Patterns matching no files
+// are ignored, as they are by OpenSSH.
+func (c *SSHConfig) include(pattern string, depth int) error {
+	pattern, err := homedir.Expand(pattern)
+	if err != nil {
+		return err
+	}
+	if !filepath.IsAbs(pattern) {
+		home, err := homedir.Dir()
+		if err != nil {
+			return err
+		}
+		pattern = filepath.Join(home, ".ssh", pattern)
+	}
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return fmt.Errorf("bad include pattern %q: %w", pattern, err)
+	}
+	for _, f := range files {
+		if err := c.parseFile(f, depth); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// splitConfigLine splits a config line into its keyword and argument,
+// which may be separated by whitespace or an equals sign.
+func splitConfigLine(line string) (string, string) {
+	i := strings.IndexAny(line, " \t=")
+	if i < 0 {
+		return line, ""
+	}
+	key, rest := line[:i], strings.TrimSpace(line[i:])
+	rest = strings.TrimSpace(strings.TrimPrefix(rest, "="))
+	return key, rest
+}
+
+// configArgs splits the argument of a config line holding several values,
+// such as Host, on whitespace, keeping quoted values together and removing
+// their quotes.
+func configArgs(value string) ([]string, error) {
+	args, err := splitFields(value)
+	if err != nil {
+		return nil, err
+	}
+	for i, a := range args {
+		args[i] = unquote(a)
+	}
+	return args, nil
+}
+
+// matches reports whether alias matches the stanza's Host patterns. A
+// negated pattern that matches excludes the host even if others match.
+func (b sshConfigBlock) matches(alias string) bool {
+	if !b.match {
+		return false
+	}
+	if b.patterns == nil {
+		return true
+	}
+	matched := false
+	for _, p := range b.patterns {
+		negate := strings.HasPrefix(p, "!")
+		ok, _ := path.Match(strings.ToLower(strings.TrimPrefix(p, "!")), strings.ToLower(alias))
+		if ok && negate {
+			return false
+		}
+		if ok {
+			matched = true
+		}
+	}
+	return matched
+}
+
+// Lookup returns the settings that apply to alias. As with OpenSSH, the
+// first value found for each setting wins, except IdentityFile which
+// accumulates. The %h and %% tokens are expanded, as is ~ in IdentityFile.
+func (c *SSHConfig) Lookup(alias string) SSHHostConfig {
+	var hc SSHHostConfig
+	if c == nil {
+		return hc
+	}
+	seen := map[string]bool{}
+	for _, b := range c.blocks {
+		if !b.matches(alias) {
+			continue
+		}
+		for _, s := range b.settings {
+			key, value := s[0], s[1]
+			if key == "identityfile" {
+				file, err := homedir.Expand(expandTokens(value, alias))
+				if err == nil {
+					hc.IdentityFiles = append(hc.IdentityFiles, file)
+				}
+				continue
+			}
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			switch key {
+			case "hostname":
+				hc.HostName = expandTokens(value, alias)
+			case "user":
+				hc.User = value
+			case "port":
+				if p, err := strconv.Atoi(value); err == nil {
+					hc.Port = p
+				}
+			case "proxyjump":
+				if !strings.EqualFold(value, "none") {
+					hc.ProxyJump = value
+				}
+			}
+		}
+	}
+	return hc
+}
+
+// expandTokens expands the %h (alias) and %% tokens of a config value.
+func expandTokens(value, alias string) string {
+	return strings.NewReplacer("%%", "%", "%h", alias).Replace(value)
+}
@@ -0,0 +1,142 @@
+// Copyright © 2017 Ricardo Aravena <raravena80@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSSHConfigLookup(t *testing.T) {
+	dir := t.TempDir()
+	included := filepath.Join(dir, "conf.d", "web.conf")
+	if err := os.MkdirAll(filepath.Dir(included), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(included, []byte(`
+Host web-*
+    User www
+    ProxyJump bastion
+`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config := `
+# Global settings apply to every host
+IdentityFile ~/.ssh/global_key
+
+Host db
+    HostName 10.0.0.5
+    Port=2200
+    User dbadmin
+    IdentityFile "/keys/db key"
+
+Include ` + filepath.Join(dir, "conf.d", "*.conf") + `
+
+Host *.internal !secret.internal
+    HostName %h.example.com
+    Port 2222
+
+Match host foo
+    User ignored
+
+Host web-1 web-2
+    User ignored
+    ProxyJump none
+
+Host "cache*" 'blob store'
+    Port 2022
+
+Host *
+    User default
+    Port 22
+`
+	path := filepath.Join(dir, "config")
+	if err := os.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := LoadSSHConfig(path)
+	if err != nil {
+		t.Fatalf("LoadSSHConfig() error: %v", err)
+	}
+	home, _ := os.UserHomeDir()
+	globalKey := filepath.Join(home, ".ssh", "global_key")
+
+	tests := []struct {
+		alias string
+		want  SSHHostConfig
+	}{
+		{alias: "db",
+			want: SSHHostConfig{HostName: "10.0.0.5", User: "dbadmin", Port: 2200,
+				IdentityFiles: []string{globalKey, "/keys/db key"}}},
+		{alias: "web-1",
+			want: SSHHostConfig{User: "www", Port: 22, ProxyJump: "bastion",
+				IdentityFiles: []string{globalKey}}},
+		{alias: "app.internal",
+			want: SSHHostConfig{HostName: "app.internal.example.com", User: "default", Port: 2222,
+				IdentityFiles: []string{globalKey}}},
+		{alias: "secret.internal",
+			want: SSHHostConfig{User: "default", Port: 22, IdentityFiles: []string{globalKey}}},
+		{alias: "cache-1",
+			want: SSHHostConfig{User: "default", Port: 2022, IdentityFiles: []string{globalKey}}},
+		{alias: "blob store",
+			want: SSHHostConfig{User: "default", Port: 2022, IdentityFiles: []string{globalKey}}},
+		{alias: "foo",
+			want: SSHHostConfig{User: "default", Port: 22, IdentityFiles: []string{globalKey}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.alias, func(t *testing.T) {
+			if got := cfg.Lookup(tt.alias); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Lookup(%q) = %+v, want %+v", tt.alias, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSSHConfigNil(t *testing.T) {
+	var cfg *SSHConfig
+	if got := cfg.Lookup("host1"); !reflect.DeepEqual(got, SSHHostConfig{}) {
+		t.Errorf("Lookup() on nil config = %+v, want empty", got)
+	}
+}
+
+func TestLoadSSHConfigErrors(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{name: "missing-value", content: "Host web\n  User\n"},
+		{name: "include-loop", content: "Include " + filepath.Join(dir, "include-loop") + "\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, tt.name)
+			if err := os.WriteFile(path, []byte(tt.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := LoadSSHConfig(path); err == nil {
+				t.Error("Expected an error, got nil")
+			}
+		})
+	}
+	if _, err := LoadSSHConfig(filepath.Join(dir, "missing")); err == nil {
+		t.Error("Expected error for a missing config file")
+	}
+}
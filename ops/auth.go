@@ -0,0 +1,142 @@
+// Copyright © 2017 Ricardo Aravena <raravena80@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ops
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/raravena80/ya/common"
+	"golang.org/x/crypto/ssh"
+)
+
+// publicKeyAuth returns public key authentication offering the keys held by
+// ag, if not nil, followed by signers. The agent is asked for its keys on
+// every connection, so keys added to it during a run are offered too.
+func publicKeyAuth(ag *common.Agent, signers []ssh.Signer) ssh.AuthMethod {
+	return ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+		if ag == nil {
+			return signers, nil
+		}
+		agentSigners, err := ag.Signers()
+		if err != nil {
+			return signers, nil
+		}
+		return append(agentSigners, signers...), nil
+	})
+}
+
+// secretAnswers answers password and keyboard-interactive prompts for every
+// host of a run. Each distinct question is only asked once; the answer is
+// reused for the other hosts. Secrets are never echoed or logged.
+type secretAnswers struct {
+	password string // Password from --ask-pass or --password-file, if any
+
+	mu      sync.Mutex
+	answers map[string]string // Answers to keyboard-interactive questions
+}
+
+// readPasswordFile returns the first line of the password file at path.
+func readPasswordFile(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read password file: %w", err)
+	}
+	if perm := info.Mode().Perm(); perm&0077 != 0 {
+		fmt.Fprintf(os.Stderr, "Warning: password file has insecure permissions: %03o (expected 0600 or 0400)\n", perm)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read password file: %w", err)
+	}
+	if i := bytes.IndexByte(data, '\n'); i >= 0 {
+		data = data[:i]
+	}
+	return string(bytes.TrimSuffix(data, []byte("\r"))), nil
+}
+
+// passwordAuth returns the password and keyboard-interactive auth methods
+// enabled by opt, asking for the password up front with --ask-pass. It
+// returns no methods when neither --ask-pass nor a password file is set.
+func passwordAuth(opt common.Options) ([]ssh.AuthMethod, error) {
+	s := &secretAnswers{}
+	switch {
+	case opt.PasswordFile != "":
+		password, err := readPasswordFile(opt.PasswordFile)
+		if err != nil {
+			return nil, err
+		}
+		s.password = password
+	case opt.AskPass:
+		password, err := common.ReadSecret("Password: ", "")
+		if err != nil {
+			return nil, fmt.Errorf("failed to read password: %w", err)
+		}
+		s.password = string(password)
+	default:
+		return nil, nil
+	}
+	return []ssh.AuthMethod{
+		ssh.Password(s.password),
+		ssh.KeyboardInteractive(s.challenge),
+	}, nil
+}
+
+// isPasswordPrompt reports whether a keyboard-interactive question asks for
+// the account password rather than, say, a one-time code.
+func isPasswordPrompt(question string) bool {
+	return strings.Contains(strings.ToLower(question), "password")
+}
+
+// challenge answers a keyboard-interactive challenge. Password questions get
+// the password; other questions are asked on the terminal the first time
+// they are seen. Concurrent hosts wait for the first answer to a question
+// instead of prompting again.
+func (s *secretAnswers) challenge(name, instruction string, questions []string, echos []bool) ([]string, error) {
+	answers := make([]string, len(questions))
+	for i, q := range questions {
+		if s.password != "" && isPasswordPrompt(q) {
+			answers[i] = s.password
+			continue
+		}
+		answer, err := s.ask(q)
+		if err != nil {
+			return nil, err
+		}
+		answers[i] = answer
+	}
+	return answers, nil
+}
+
+// ask returns the answer to question, prompting for it if needed.
+func (s *secretAnswers) ask(question string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if answer, ok := s.answers[question]; ok {
+		return answer, nil
+	}
+	answer, err := common.ReadSecret(question, "")
+	if err != nil {
+		return "", fmt.Errorf("failed to answer %q: %w", strings.TrimSpace(question), err)
+	}
+	if s.answers == nil {
+		s.answers = map[string]string{}
+	}
+	s.answers[question] = string(answer)
+	return string(answer), nil
+}
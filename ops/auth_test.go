@@ -0,0 +1,200 @@
+// Copyright © 2017 Ricardo Aravena <raravena80@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ops
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/raravena80/ya/common"
+	"github.com/raravena80/ya/test"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// writeSecretFile writes content to a temporary file named name.
+func writeSecretFile(t *testing.T, name, content string, perm os.FileMode) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), perm); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadPasswordFile(t *testing.T) {
+	tests := []struct {
+		name      string
+		content   string
+		want      string
+		expectErr bool
+	}{
+		{name: "Single line", content: "s3cret", want: "s3cret"},
+		{name: "Only the first line", content: "s3cret\r\nignored\n", want: "s3cret"},
+		{name: "Missing file", expectErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "missing")
+			if !tt.expectErr {
+				path = writeSecretFile(t, "password", tt.content, 0600)
+			}
+			got, err := readPasswordFile(path)
+			if tt.expectErr {
+				if err == nil {
+					t.Error("Expected an error, got nil")
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("readPasswordFile() = %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestSSHSessionPassword(t *testing.T) {
+	port := test.StartSSHServerForPassword("s3cret", "")
+	tests := []struct {
+		name     string
+		password string
+		expected bool
+	}{
+		{name: "Correct password", password: "s3cret\n", expected: true},
+		{name: "Wrong password", password: "wrong\n", expected: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok := SSHSession(
+				common.SetMachines([]string{fmt.Sprintf("127.0.0.1:%d", port)}),
+				common.SetUser("testuser"),
+				common.SetKey("/nonexistent/key"),
+				common.SetPasswordFile(writeSecretFile(t, "password", tt.password, 0600)),
+				common.SetInsecureHost(true),
+				common.SetTimeout(5),
+				common.SetCmd("true"),
+				common.SetOp("ssh"),
+			)
+			if ok != tt.expected {
+				t.Errorf("SSHSession() = %v, want %v", ok, tt.expected)
+			}
+		})
+	}
+}
+
+func TestSSHSessionKeyboardInteractive(t *testing.T) {
+	port := test.StartSSHServerForPassword("s3cret", "123456")
+
+	// The askpass helper logs every question it is asked, so the test can
+	// check each one is asked once for both hosts.
+	dir := t.TempDir()
+	asked := filepath.Join(dir, "asked")
+	helper := filepath.Join(dir, "askpass")
+	script := fmt.Sprintf("#!/bin/sh\necho \"$1\" >> %s\ncase \"$1\" in\n*assword*) echo s3cret ;;\n*) echo 123456 ;;\nesac\n", asked)
+	if err := os.WriteFile(helper, []byte(script), 0700); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(common.AskpassEnv, helper)
+
+	ok := SSHSession(
+		common.SetMachines([]string{
+			fmt.Sprintf("127.0.0.1:%d", port),
+			fmt.Sprintf("localhost:%d", port),
+		}),
+		common.SetUser("testuser"),
+		common.SetKey("/nonexistent/key"),
+		common.SetAskPass(true),
+		common.SetInsecureHost(true),
+		common.SetTimeout(5),
+		common.SetCmd("true"),
+		common.SetOp("ssh"),
+	)
+	if !ok {
+		t.Fatal("Expected keyboard-interactive authentication to succeed on both hosts")
+	}
+	data, err := os.ReadFile(asked)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "Password: \nVerification code: \n"
+	if string(data) != want {
+		t.Errorf("Questions asked = %q, want each asked once: %q", data, want)
+	}
+	if strings.Contains(string(data), "s3cret") {
+		t.Error("Secret leaked into the prompts")
+	}
+}
+
+// startTestAgent starts an SSH agent holding the rsa test key and returns
+// its socket.
+func startTestAgent(t *testing.T) string {
+	sock := filepath.Join(t.TempDir(), "agent.sock")
+	test.SetupSSHAgent(sock)
+	test.AddKeytoSSHAgent(agent.AddedKey{PrivateKey: testPrivateKeys["rsa"]}, sock)
+	return sock
+}
+
+func TestSSHSessionAgent(t *testing.T) {
+	sock := startTestAgent(t)
+	port := execTestServer()
+	tests := []struct {
+		name     string
+		options  []func(*common.Options)
+		expected bool
+	}{
+		{name: "Authenticate with the agent",
+			options:  []func(*common.Options){common.SetUseAgent(true), common.SetAgentSock(sock)},
+			expected: true},
+		{name: "Forward the agent",
+			options: []func(*common.Options){common.SetUseAgent(true), common.SetAgentSock(sock),
+				common.SetForwardAgent(true), common.SetCmd("ssh-add -l")},
+			expected: true},
+		{name: "Forwarding without an agent socket",
+			options:  []func(*common.Options){common.SetForwardAgent(true), common.SetAgentSock("")},
+			expected: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			options := append([]func(*common.Options){
+				common.SetMachines([]string{fmt.Sprintf("127.0.0.1:%d", port), fmt.Sprintf("localhost:%d", port)}),
+				common.SetUser("testuser"),
+				common.SetKey("/nonexistent/key"),
+				common.SetInsecureHost(true),
+				common.SetTimeout(5),
+				common.SetCmd("true"),
+				common.SetOp("ssh"),
+			}, tt.options...)
+			if ok := SSHSession(options...); ok != tt.expected {
+				t.Errorf("SSHSession() = %v, want %v", ok, tt.expected)
+			}
+		})
+	}
+}
+
+func TestExecuteCmd_ForwardAgent(t *testing.T) {
+	sock := startTestAgent(t)
+	opt := common.Options{ForwardAgent: true, AgentSock: sock, Cmd: "ssh-add -L"}
+	res := executeCmd(opt, testTarget(t, opt, fmt.Sprintf("127.0.0.1:%d", execTestServer())),
+		&runEnv{config: execTestConfig()})
+	if res.err != nil {
+		t.Fatalf("executeCmd() error: %v %s", res.err, res.stderr)
+	}
+	want := string(ssh.MarshalAuthorizedKey(testPublicKeys["rsa"]))
+	if !strings.HasPrefix(res.stdout, strings.TrimSpace(want)) {
+		t.Errorf("Forwarded agent lists %q, want the rsa test key %q", res.stdout, want)
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright © 2017 Ricardo Aravena <raravena80@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ops
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// batchSize converts a batch specification into the number of hosts per wave.
+// The specification is either a host count ("10") or a percentage of the
+// total number of hosts ("25%"). Percentages round down but never below one
+// host. An empty specification runs every host in a single wave.
+func batchSize(spec string, total int) (int, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" || total == 0 {
+		return total, nil
+	}
+
+	if strings.HasSuffix(spec, "%") {
+		pct, err := strconv.Atoi(strings.TrimSuffix(spec, "%"))
+		if err != nil || pct <= 0 || pct > 100 {
+			return 0, fmt.Errorf("invalid batch percentage %q: must be between 1%% and 100%%", spec)
+		}
+		size := total * pct / 100
+		if size < 1 {
+			size = 1
+		}
+		return size, nil
+	}
+
+	size, err := strconv.Atoi(spec)
+	if err != nil || size <= 0 {
+		return 0, fmt.Errorf("invalid batch size %q: must be a positive number or percentage", spec)
+	}
+	if size > total {
+		size = total
+	}
+	return size, nil
+}
+
+// makeWaves splits hosts into consecutive waves of at most size hosts.
+func makeWaves(hosts []string, size int) [][]string {
+	if size <= 0 {
+		size = len(hosts)
+	}
+	var waves [][]string
+	for start := 0; start < len(hosts); start += size {
+		end := start + size
+		if end > len(hosts) {
+			end = len(hosts)
+		}
+		waves = append(waves, hosts[start:end])
+	}
+	return waves
+}
+
+// exceedsFailThreshold reports whether failed out of total hosts is above the
+// maximum failure percentage. A nil threshold never aborts.
+func exceedsFailThreshold(failed, total int, maxFailPercent *int) bool {
+	if maxFailPercent == nil || total == 0 {
+		return false
+	}
+	return failed*100 > *maxFailPercent*total
+}
+
+// runWave runs fn for every host using a pool of at most forks workers
+// (0 means one worker per host). It returns the number of hosts for which fn
+// reported failure, and false if ctx was cancelled before all hosts completed.
+// fn is still called for the hosts not started by the time ctx is cancelled,
+// so it can report them as cancelled without running them.
+func runWave(ctx context.Context, hosts []string, forks int, fn func(string) bool) (int, bool) {
+	workers := forks
+	if workers <= 0 || workers > len(hosts) {
+		workers = len(hosts)
+	}
+
+	jobs := make(chan string)
+	done := make(chan bool, len(hosts))
+
+	go func() {
+		defer close(jobs)
+		for _, h := range hosts {
+			jobs <- h
+		}
+	}()
+
+	for w := 0; w < workers; w++ {
+		go func() {
+			for h := range jobs {
+				done <- fn(h)
+			}
+		}()
+	}
+
+	failed := 0
+	for i := 0; i < len(hosts); i++ {
+		if success := <-done; !success {
+			failed++
+		}
+	}
+	return failed, ctx.Err() == nil
+}
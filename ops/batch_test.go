@@ -0,0 +1,236 @@
+// Copyright © 2017 Ricardo Aravena <raravena80@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ops
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/raravena80/ya/common"
+)
+
+func TestBatchSize(t *testing.T) {
+	tests := []struct {
+		name      string
+		spec      string
+		total     int
+		expected  int
+		expectErr bool
+	}{
+		{name: "Empty spec runs all hosts", spec: "", total: 7, expected: 7},
+		{name: "Fixed count", spec: "3", total: 10, expected: 3},
+		{name: "Count larger than total", spec: "50", total: 10, expected: 10},
+		{name: "Percentage", spec: "25%", total: 10, expected: 2},
+		{name: "Small percentage rounds up to one", spec: "1%", total: 10, expected: 1},
+		{name: "Full percentage", spec: "100%", total: 10, expected: 10},
+		{name: "Zero count", spec: "0", total: 10, expectErr: true},
+		{name: "Negative count", spec: "-2", total: 10, expectErr: true},
+		{name: "Percentage over 100", spec: "150%", total: 10, expectErr: true},
+		{name: "Not a number", spec: "lots", total: 10, expectErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			size, err := batchSize(tt.spec, tt.total)
+			if tt.expectErr {
+				if err == nil {
+					t.Errorf("batchSize(%q, %d) expected error, got %d", tt.spec, tt.total, size)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("batchSize(%q, %d) unexpected error: %v", tt.spec, tt.total, err)
+			}
+			if size != tt.expected {
+				t.Errorf("batchSize(%q, %d) = %d, want %d", tt.spec, tt.total, size, tt.expected)
+			}
+		})
+	}
+}
+
+func TestMakeWaves(t *testing.T) {
+	hosts := []string{"h1", "h2", "h3", "h4", "h5"}
+	tests := []struct {
+		name     string
+		size     int
+		expected [][]string
+	}{
+		{name: "Single wave", size: 5, expected: [][]string{hosts}},
+		{name: "Even waves", size: 1, expected: [][]string{{"h1"}, {"h2"}, {"h3"}, {"h4"}, {"h5"}}},
+		{name: "Uneven last wave", size: 2, expected: [][]string{{"h1", "h2"}, {"h3", "h4"}, {"h5"}}},
+		{name: "Zero size is a single wave", size: 0, expected: [][]string{hosts}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			waves := makeWaves(hosts, tt.size)
+			if len(waves) != len(tt.expected) {
+				t.Fatalf("makeWaves() returned %d waves, want %d", len(waves), len(tt.expected))
+			}
+			for i := range waves {
+				if !equalStringSlices(waves[i], tt.expected[i]) {
+					t.Errorf("wave %d = %v, want %v", i, waves[i], tt.expected[i])
+				}
+			}
+		})
+	}
+}
+
+func TestExceedsFailThreshold(t *testing.T) {
+	zero, half := 0, 50
+	tests := []struct {
+		name      string
+		failed    int
+		total     int
+		threshold *int
+		expected  bool
+	}{
+		{name: "No threshold", failed: 5, total: 5, threshold: nil, expected: false},
+		{name: "Zero threshold no failures", failed: 0, total: 5, threshold: &zero, expected: false},
+		{name: "Zero threshold one failure", failed: 1, total: 5, threshold: &zero, expected: true},
+		{name: "At threshold", failed: 2, total: 4, threshold: &half, expected: false},
+		{name: "Above threshold", failed: 3, total: 4, threshold: &half, expected: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := exceedsFailThreshold(tt.failed, tt.total, tt.threshold); got != tt.expected {
+				t.Errorf("exceedsFailThreshold(%d, %d) = %v, want %v", tt.failed, tt.total, got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestRunWaveForks(t *testing.T) {
+	hosts := []string{"h1", "h2", "h3", "h4", "h5", "h6", "h7", "h8"}
+	var running, peak int32
+	var mu sync.Mutex
+
+	failed, completed := runWave(context.Background(), hosts, 3, func(h string) bool {
+		n := atomic.AddInt32(&running, 1)
+		mu.Lock()
+		if n > peak {
+			peak = n
+		}
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		atomic.AddInt32(&running, -1)
+		return h != "h2" && h != "h5"
+	})
+
+	if !completed {
+		t.Error("Expected wave to complete")
+	}
+	if failed != 2 {
+		t.Errorf("Expected 2 failures, got %d", failed)
+	}
+	if peak > 3 {
+		t.Errorf("Expected at most 3 concurrent hosts, got %d", peak)
+	}
+}
+
+func TestRunWaveCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, completed := runWave(ctx, []string{"h1", "h2"}, 1, func(h string) bool {
+		time.Sleep(10 * time.Millisecond)
+		return true
+	})
+	if completed {
+		t.Error("Expected cancelled wave to report incomplete")
+	}
+
+	// Hosts not started when cancelled are still handed to fn to report
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	var mu sync.Mutex
+	var cancelled []string
+	_, completed = runWave(ctx, []string{"h1", "h2", "h3", "h4"}, 1, func(h string) bool {
+		if ctx.Err() != nil {
+			mu.Lock()
+			cancelled = append(cancelled, h)
+			mu.Unlock()
+			return false
+		}
+		cancel()
+		return true
+	})
+	if completed {
+		t.Error("Expected cancelled wave to report incomplete")
+	}
+	if want := []string{"h2", "h3", "h4"}; !reflect.DeepEqual(cancelled, want) {
+		t.Errorf("Hosts reported as cancelled = %v, want %v", cancelled, want)
+	}
+}
+
+func TestExecuteCmdCancelled(t *testing.T) {
+	opt := common.Options{Cmd: "sleep 30"}
+	entry := fmt.Sprintf("127.0.0.1:%d", execTestServer())
+
+	// A running command is stopped
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(200*time.Millisecond, cancel)
+	start := time.Now()
+	res := executeCmd(opt, testTarget(t, opt, entry), &runEnv{ctx: ctx, config: execTestConfig()})
+	if res.err == nil {
+		t.Error("Expected an error once cancelled")
+	}
+	if d := time.Since(start); d > 10*time.Second {
+		t.Errorf("executeCmd() took %v after being cancelled", d)
+	}
+
+	// A host is not dialed once cancelled
+	res = executeCmd(opt, testTarget(t, opt, entry), &runEnv{ctx: ctx, config: execTestConfig()})
+	if !errors.Is(res.err, context.Canceled) {
+		t.Errorf("executeCmd() error = %v, want %v", res.err, context.Canceled)
+	}
+}
+
+func TestSSHSessionBatchAbort(t *testing.T) {
+	marker, err := os.CreateTemp("", "ya_batch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	marker.Close()
+	defer os.Remove(marker.Name())
+
+	keyFile := writeTestKey(t)
+	defer os.Remove(keyFile)
+
+	returned := SSHSession(common.SetMachines([]string{"127.0.0.1", "localhost", "127.0.0.1"}),
+		common.SetUser("testuser"),
+		common.SetPort(execTestServer()),
+		common.SetKey(keyFile),
+		common.SetTimeout(5),
+		common.SetInsecureHost(true),
+		common.SetCmd("echo ran >> "+marker.Name()+"; exit 1"),
+		common.SetBatch("1"),
+		common.SetMaxFailPercent(0),
+		common.SetOp("ssh"))
+
+	if returned {
+		t.Error("Expected failed rollout to return false")
+	}
+	content, _ := os.ReadFile(marker.Name())
+	if runs := strings.Count(string(content), "ran"); runs != 1 {
+		t.Errorf("Expected rollout to stop after the first wave, command ran %d times", runs)
+	}
+}
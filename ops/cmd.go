@@ -17,35 +17,55 @@ package ops
 import (
 	"bytes"
 	"fmt"
+	"io"
+
 	"github.com/raravena80/ya/common"
-	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
 )
 
-func executeCmd(opt common.Options, hostname string, config *ssh.ClientConfig) executeResult {
-
-	port := fmt.Sprintf("%v", opt.Port)
-	conn, err := ssh.Dial("tcp", hostname+":"+port, config)
+func executeCmd(opt common.Options, t target, env *runEnv) executeResult {
 
+	conn, err := dialHost(opt, t, env)
 	if err != nil {
-		return executeResult{
-			result: hostname + ":\n",
-			err:    err,
+		return makeExecResult(t.name, "", err)
+	}
+	defer conn.Close()
+
+	if opt.ForwardAgent {
+		if err := agent.ForwardToRemote(conn, opt.AgentSock); err != nil {
+			return makeExecResult(t.name, "", fmt.Errorf("failed to forward SSH agent: %w", err))
 		}
 	}
 
 	session, err := conn.NewSession()
 	if err != nil {
 		//go:nocovline // NewSession failure hard to test without mock SSH server
-		return executeResult{
-			result: hostname + ":\n",
-			err:    fmt.Errorf("failed to create SSH session: %w", err),
-		}
+		return makeExecResult(t.name, "", fmt.Errorf("failed to create SSH session: %w", err))
 	}
 	defer session.Close()
 
-	var stdoutBuf bytes.Buffer
+	if opt.ForwardAgent {
+		if err := agent.RequestAgentForwarding(session); err != nil {
+			return makeExecResult(t.name, "", fmt.Errorf("failed to request agent forwarding: %w", err))
+		}
+	}
+
+	var stdoutBuf, stderrBuf bytes.Buffer
 	session.Stdout = &stdoutBuf
-	err = session.Run(opt.Cmd)
+	session.Stderr = &stderrBuf
+	if env.stream != nil {
+		liveOut, liveErr := env.stream.writers(t.name)
+		defer liveOut.Flush()
+		defer liveErr.Flush()
+		session.Stdout = io.MultiWriter(&stdoutBuf, liveOut)
+		session.Stderr = io.MultiWriter(&stderrBuf, liveErr)
+	}
+	err = session.Start(opt.Cmd)
+	if err == nil {
+		err = waitWithTimeout(sessionProcess{session, conn}, commandTimeout(opt), session.Wait)
+	}
 
-	return makeExecResult(hostname, stdoutBuf.String(), err)
+	res := makeExecResult(t.name, stdoutBuf.String(), err)
+	res.stderr = stderrBuf.String()
+	return res
 }
@@ -15,13 +15,68 @@
 package ops
 
 import (
+	"errors"
 	"fmt"
+	"io"
+	"os"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/raravena80/ya/common"
+	"github.com/raravena80/ya/test"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/testdata"
 )
 
+var (
+	execTestOnce sync.Once
+	execTestPort int
+)
+
+// execTestServer starts the in-process exec SSH server shared by tests on
+// first use and returns its port.
+func execTestServer() int {
+	execTestOnce.Do(func() {
+		execTestPort = test.StartSSHServerForExec(testPublicKeys)
+	})
+	return execTestPort
+}
+
+// writeTestKey writes the rsa test key to a temporary file and returns its path.
+func writeTestKey(t *testing.T) string {
+	f, err := os.CreateTemp("", "ya_testkey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Write(testdata.PEMBytes["rsa"]); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+// testTarget resolves a machine entry against opt, failing the test if the
+// entry is invalid.
+func testTarget(t *testing.T, opt common.Options, entry string) target {
+	t.Helper()
+	tgt, err := newTarget(opt, nil, entry)
+	if err != nil {
+		t.Fatalf("newTarget(%q) error: %v", entry, err)
+	}
+	return tgt
+}
+
+// execTestConfig returns a client config that authenticates against the
+// in-process exec SSH server.
+func execTestConfig() *ssh.ClientConfig {
+	return &ssh.ClientConfig{
+		User:            "testuser",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(testSigners["rsa"])},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+}
+
 func TestExecuteCmd_ErrorPaths(t *testing.T) {
 	// Test executeCmd with invalid hostname (will fail at Dial)
 	tests := []struct {
@@ -56,7 +111,7 @@ func TestExecuteCmd_ErrorPaths(t *testing.T) {
 				Auth: []ssh.AuthMethod{ssh.PublicKeys(nil)},
 			}
 
-			result := executeCmd(tt.options, tt.hostname, config)
+			result := executeCmd(tt.options, testTarget(t, tt.options, tt.hostname), &runEnv{config: config})
 
 			// Should return an error (connection will fail)
 			if result.err == nil {
@@ -64,8 +119,11 @@ func TestExecuteCmd_ErrorPaths(t *testing.T) {
 			}
 
 			// Result should contain hostname
-			if result.result == "" {
-				t.Error("Expected result to contain hostname")
+			if result.host != tt.hostname {
+				t.Errorf("Expected result host %q, got %q", tt.hostname, result.host)
+			}
+			if result.status() != statusError {
+				t.Errorf("Expected status %q, got %q", statusError, result.status())
 			}
 		})
 	}
@@ -96,14 +154,12 @@ func TestMakeExecResult_AllPaths(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			result := makeExecResult(tt.hostname, tt.output, tt.err)
 
-			// Check result format
-			expectedPrefix := tt.hostname + ":\n"
-			if tt.output != "" {
-				expectedPrefix = tt.hostname + ":\n" + tt.output
+			// Check result fields
+			if result.host != tt.hostname {
+				t.Errorf("Host = %q, want %q", result.host, tt.hostname)
 			}
-
-			if result.result != expectedPrefix {
-				t.Errorf("Result = %q, want %q", result.result, expectedPrefix)
+			if result.stdout != tt.output {
+				t.Errorf("Stdout = %q, want %q", result.stdout, tt.output)
 			}
 
 			// Check error is preserved
@@ -113,3 +169,154 @@ func TestMakeExecResult_AllPaths(t *testing.T) {
 		})
 	}
 }
+
+func TestExecuteCmd_ExitStatus(t *testing.T) {
+	tests := []struct {
+		name     string
+		cmd      string
+		stdout   string
+		stderr   string
+		exitCode int
+		status   string
+	}{
+		{name: "Successful command",
+			cmd:      "echo hello",
+			stdout:   "hello\n",
+			exitCode: 0,
+			status:   statusOK},
+		{name: "Stderr is captured separately",
+			cmd:      "echo out; echo err >&2",
+			stdout:   "out\n",
+			stderr:   "err\n",
+			exitCode: 0,
+			status:   statusOK},
+		{name: "Non-zero exit status",
+			cmd:      "echo failing >&2; exit 2",
+			stderr:   "failing\n",
+			exitCode: 2,
+			status:   statusFailed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opt := common.Options{Port: execTestServer(), Cmd: tt.cmd}
+			result := executeCmd(opt, testTarget(t, opt, "127.0.0.1"), &runEnv{config: execTestConfig()})
+
+			if result.stdout != tt.stdout {
+				t.Errorf("stdout = %q, want %q", result.stdout, tt.stdout)
+			}
+			if result.stderr != tt.stderr {
+				t.Errorf("stderr = %q, want %q", result.stderr, tt.stderr)
+			}
+			if result.exitCode != tt.exitCode {
+				t.Errorf("exitCode = %d, want %d", result.exitCode, tt.exitCode)
+			}
+			if result.status() != tt.status {
+				t.Errorf("status = %q, want %q (err %v)", result.status(), tt.status, result.err)
+			}
+		})
+	}
+}
+
+// fakeProcess records how waitWithTimeout stops a remote process.
+type fakeProcess struct {
+	signal ssh.Signal
+	closed bool
+}
+
+func (p *fakeProcess) Signal(sig ssh.Signal) error {
+	p.signal = sig
+	return nil
+}
+
+func (p *fakeProcess) Close() error {
+	p.closed = true
+	return nil
+}
+
+func TestWaitWithTimeout(t *testing.T) {
+	tests := []struct {
+		name      string
+		timeout   time.Duration
+		waitFor   time.Duration
+		waitErr   error
+		expectErr error
+		stopped   bool
+	}{
+		{name: "No timeout", timeout: 0, waitFor: 10 * time.Millisecond},
+		{name: "Finishes in time", timeout: time.Second, waitFor: 10 * time.Millisecond},
+		{name: "Error passed through", timeout: time.Second, waitErr: io.ErrUnexpectedEOF,
+			expectErr: io.ErrUnexpectedEOF},
+		{name: "Times out", timeout: 20 * time.Millisecond, waitFor: 200 * time.Millisecond,
+			expectErr: ErrCommandTimeout, stopped: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proc := &fakeProcess{}
+			err := waitWithTimeout(proc, tt.timeout, func() error {
+				time.Sleep(tt.waitFor)
+				return tt.waitErr
+			})
+			if !errors.Is(err, tt.expectErr) {
+				t.Errorf("waitWithTimeout() = %v, want %v", err, tt.expectErr)
+			}
+			if tt.stopped && (proc.signal != ssh.SIGTERM || !proc.closed) {
+				t.Errorf("Expected SIGTERM and close, got signal %q closed %v", proc.signal, proc.closed)
+			}
+			if !tt.stopped && (proc.signal != "" || proc.closed) {
+				t.Error("Process should not have been stopped")
+			}
+		})
+	}
+}
+
+func TestExecuteCmd_CommandTimeout(t *testing.T) {
+	timeout := 1
+	opt := common.Options{Port: execTestServer(), Cmd: "sleep 10", CommandTimeout: &timeout}
+
+	start := time.Now()
+	res := executeCmd(opt, testTarget(t, opt, "127.0.0.1"), &runEnv{config: execTestConfig()})
+	elapsed := time.Since(start)
+
+	if !errors.Is(res.err, ErrCommandTimeout) {
+		t.Fatalf("Expected command timeout error, got %v", res.err)
+	}
+	if res.status() != statusTimeout {
+		t.Errorf("status = %q, want %q", res.status(), statusTimeout)
+	}
+	if elapsed > 5*time.Second {
+		t.Errorf("Timed out command took %v to return", elapsed)
+	}
+}
+
+func TestExecuteCmd_HostOverrides(t *testing.T) {
+	keyFile := writeTestKey(t)
+	defer os.Remove(keyFile)
+
+	// The global port and key are wrong; the host entry fixes both and
+	// dials the server by address rather than by inventory name.
+	opt := common.Options{
+		Port: 1,
+		Keys: []string{"/nonexistent/key"},
+		Cmd:  "echo override",
+		Hosts: map[string]common.Host{
+			"web1": {Name: "web1", Address: "127.0.0.1", Port: execTestServer(), User: "deploy", Key: keyFile},
+		},
+	}
+	config := &ssh.ClientConfig{
+		User:            "testuser",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys()},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+
+	res := executeCmd(opt, testTarget(t, opt, "web1"), &runEnv{config: config})
+	if res.err != nil {
+		t.Fatalf("executeCmd() error: %v", res.err)
+	}
+	if res.host != "web1" || res.stdout != "override\n" {
+		t.Errorf("executeCmd() = host %q stdout %q, want web1 and override", res.host, res.stdout)
+	}
+	if config.User != "testuser" {
+		t.Errorf("Shared config was modified: user %q", config.User)
+	}
+}
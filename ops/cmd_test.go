@@ -133,6 +133,7 @@ func TestCmd(t *testing.T) {
 				common.SetKey(tt.key.Keyname),
 				common.SetUseAgent(tt.useagent),
 				common.SetTimeout(tt.timeout),
+				common.SetInsecureHost(true),
 				common.SetOp(tt.op))
 
 			if !(returned == tt.expected) {
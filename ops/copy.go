@@ -15,8 +15,10 @@
 package ops
 
 import (
+	"bufio"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"strings"
@@ -59,48 +61,113 @@ func processError(err error, message string, errPipe io.Writer, verbose bool) er
 	return err
 }
 
-func processDir(srcPath string, srcFileInfo os.FileInfo, procWriter, errPipe io.Writer, verbose bool) error {
+// scpSource sends files to the sink side of the scp protocol, as run by
+// `scp -t` on the remote host, reading its acknowledgement after every
+// record.
+type scpSource struct {
+	w        io.Writer
+	r        *bufio.Reader
+	errPipe  io.Writer
+	verbose  bool
+	preserve bool   // Send a T record with the times of every file and directory
+	symlinks string // How symlinks below a directory are sent
+	bytes    int64  // File contents sent so far
+	progress *hostProgress
+}
+
+// newSCPSource returns a source writing records to w and reading the
+// acknowledgements of the remote scp from r.
+func newSCPSource(w io.Writer, r io.Reader, errPipe io.Writer, verbose bool) *scpSource {
+	return &scpSource{w: w, r: bufio.NewReader(r), errPipe: errPipe, verbose: verbose}
+}
 
-	err := sendDir(srcPath, srcFileInfo, procWriter, errPipe)
+// readAck reads the remote scp's response to a record: a zero byte on
+// success, or a 1 (warning) or 2 (fatal error) byte followed by a message.
+func (s *scpSource) readAck() error {
+	b, err := s.r.ReadByte()
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to read scp acknowledgement: %w", err)
 	}
-	dir, err := os.Open(srcPath)
-	if err != nil {
-		return err
+	switch b {
+	case 0:
+		return nil
+	case 1, 2:
+		msg, _ := s.r.ReadString('\n')
+		msg = strings.TrimSpace(msg)
+		if b == 1 {
+			return fmt.Errorf("remote scp warning: %s", msg)
+		}
+		return fmt.Errorf("remote scp error: %s", msg)
 	}
-	fis, err := dir.Readdir(0)
-	if err != nil {
+	return fmt.Errorf("unexpected scp acknowledgement %q", b)
+}
+
+// record writes a record and waits for it to be acknowledged.
+func (s *scpSource) record(header string) error {
+	if _, err := io.WriteString(s.w, header); err != nil {
 		return err
 	}
-	for _, fi := range fis {
-		if fi.IsDir() {
-			err = processDir(filepath.Join(srcPath, fi.Name()), fi, procWriter, errPipe, verbose)
-			if err != nil {
-				return err
+	return s.readAck()
+}
+
+// processDir sends the directory srcPath and everything below it. The scp
+// protocol has no record for symlinks, so they can only be followed or
+// skipped.
+func (s *scpSource) processDir(srcPath string, srcFileInfo os.FileInfo) error {
+	return s.sendTree(srcPath, srcFileInfo, true, nil)
+}
+
+// sendTree sends the parts of the directory srcPath selected by filter. With
+// withRoot, srcPath itself is sent as a directory; otherwise its entries are
+// sent straight into the remote destination.
+func (s *scpSource) sendTree(srcPath string, srcFileInfo os.FileInfo, withRoot bool, filter *treeFilter) error {
+	return walkTree(localFS{}, srcPath, srcFileInfo, s.symlinks, treeVisitor{
+		enterDir: func(p, rel string, info fs.FileInfo) error {
+			if rel == "." && !withRoot {
+				return nil
 			}
-		} else {
-			err = sendFile(filepath.Join(srcPath, fi.Name()), fi, procWriter, errPipe, verbose)
-			if err != nil {
-				return err
+			if !filter.dir(rel) {
+				return fs.SkipDir
 			}
-		}
-	}
-	err = sendEndDir(procWriter, errPipe)
-	return err
+			return s.sendDir(p, info)
+		},
+		leaveDir: func(p, rel string, info fs.FileInfo) error {
+			if rel == "." && !withRoot {
+				return nil
+			}
+			return s.sendEndDir()
+		},
+		file: func(p, rel string, info fs.FileInfo) error {
+			if !filter.file(rel) {
+				return nil
+			}
+			return s.sendFile(p, info)
+		},
+		symlink: func(p, rel, target string, info fs.FileInfo) error {
+			return fmt.Errorf("cannot copy symlink %s as a link with scp, use --protocol sftp", p)
+		},
+	})
 }
 
-func sendEndDir(procWriter, errPipe io.Writer) error {
-	header := fmt.Sprintf("E\n")
-	_, err := procWriter.Write([]byte(header))
-	return err
+// sendTimes sends a T record with the modification and access times of
+// the file or directory described by info, to be applied to the next one.
+func (s *scpSource) sendTimes(info os.FileInfo) error {
+	return s.record(fmt.Sprintf("T%d 0 %d 0\n", info.ModTime().Unix(), fileAtime(info).Unix()))
+}
+
+func (s *scpSource) sendEndDir() error {
+	return s.record("E\n")
 }
 
-func sendDir(srcPath string, srcFileInfo os.FileInfo, procWriter, errPipe io.Writer) error {
+func (s *scpSource) sendDir(srcPath string, srcFileInfo os.FileInfo) error {
+	if s.preserve {
+		if err := s.sendTimes(srcFileInfo); err != nil {
+			return err
+		}
+	}
 	mode := uint32(srcFileInfo.Mode().Perm())
 	header := fmt.Sprintf("D%04o 0 %s\n", mode, filepath.Base(srcPath))
-	_, err := procWriter.Write([]byte(header))
-	return err
+	return s.record(header)
 }
 
 func sendByte(w io.Writer, val byte) error {
@@ -108,103 +175,216 @@ func sendByte(w io.Writer, val byte) error {
 	return err
 }
 
-func sendFile(srcFile string, srcFileInfo os.FileInfo, procWriter, errPipe io.Writer, verbose bool) error {
+func (s *scpSource) sendFile(srcFile string, srcFileInfo os.FileInfo) error {
 
 	mode := uint32(srcFileInfo.Mode().Perm())
 	fileReader, err := os.Open(srcFile)
 	if err != nil {
-		return processError(err, "Could not open source file "+srcFile, errPipe, verbose)
+		return processError(err, "Could not open source file "+srcFile, s.errPipe, s.verbose)
 	}
 	defer fileReader.Close()
 
+	if s.preserve {
+		if err := s.sendTimes(srcFileInfo); err != nil {
+			return processError(err, "Could not write scp times", s.errPipe, s.verbose)
+		}
+	}
+
 	size := srcFileInfo.Size()
 	header := fmt.Sprintf("C%04o %d %s\n", mode, size, filepath.Base(srcFile))
 
-	_, err = procWriter.Write([]byte(header))
+	err = s.record(header)
 	if err != nil {
-		return processError(err, "Could not write scp header", errPipe, verbose)
+		return processError(err, "Could not write scp header", s.errPipe, s.verbose)
 	}
 
-	_, err = io.Copy(procWriter, fileReader)
+	n, err := io.CopyN(s.progress.writer(s.w), fileReader, size)
+	s.bytes += n
 	if err != nil {
-		return processError(err, "Could not send file", errPipe, verbose)
+		return processError(err, "Could not send file", s.errPipe, s.verbose)
 	}
 	// terminate with null byte
-	err = sendByte(procWriter, 0)
-	return processError(err, "Could not send the last byte", errPipe, verbose)
+	err = sendByte(s.w, 0)
+	if err != nil {
+		return processError(err, "Could not send the last byte", s.errPipe, s.verbose)
+	}
+	return processError(s.readAck(), "Could not copy "+srcFile, s.errPipe, s.verbose)
 }
 
-func executeCopy(opt common.Options, hostname string, config *ssh.ClientConfig) executeResult {
+// executeCopy copies opt.Src to opt.Dst on the host, over SFTP or scp as
+// selected by opt.Protocol, through a staging path with opt.Atomic or
+// opt.Backup. A failed copy is retried opt.Retries times,
+// waiting longer before every retry; over SFTP the retries carry on from
+// the files and partial files the failed attempts left.
+func executeCopy(opt common.Options, t target, env *runEnv) executeResult {
 	// Validate source path for security
 	if err := validatePath(opt.Src); err != nil {
-		return makeExecResult(hostname, "", err)
+		return makeExecResult(t.name, "", err)
 	}
 	// Validate destination path for security
 	if err := validatePath(opt.Dst); err != nil {
-		return makeExecResult(hostname, "", err)
+		return makeExecResult(t.name, "", err)
 	}
-	// Validate SCP binary exists and is executable
-	if err := validateSCPPath(DefaultSCPPath); err != nil {
-		return makeExecResult(hostname, "", err)
+	// A source that cannot be sent is not worth retrying
+	info, err := os.Stat(opt.Src)
+	if err != nil {
+		return makeExecResult(t.name, "", err)
+	}
+	if info.IsDir() && !opt.IsRecursive {
+		return makeExecResult(t.name, "", fmt.Errorf("Not a regular file %v", opt.Src))
 	}
 
-	var targetDir string
+	var res executeResult
+	done := &copiedFiles{}
+	attempt := 0
+	for {
+		res = copyAttempt(opt, t, env, done, attempt)
+		if res.err == nil || attempt >= opt.Retries || env.sleep(retryDelay(opt, attempt)) != nil {
+			break
+		}
+		attempt++
+	}
+	res.retries = attempt
+	return res
+}
 
-	port := fmt.Sprintf("%v", opt.Port)
-	conn, err := ssh.Dial("tcp", hostname+":"+port, config)
+// copyAttempt makes the attempt of executeCopy numbered attempt, counted
+// from 0. Files copied over SFTP are recorded in done, which a retry skips,
+// and the partial file of a failed upload is only kept if a retry follows.
+func copyAttempt(opt common.Options, t target, env *runEnv, done *copiedFiles, attempt int) executeResult {
+	prog := env.progress.host(t.name)
+	if attempt > 0 {
+		prog.restart()
+	}
+	conn, err := dialHost(opt, t, env)
+	if err != nil {
+		return makeExecResult(t.name, "", err)
+	}
+	defer conn.Close()
 
+	stats := &transferStats{}
+	client, err := openSFTP(opt, conn)
 	if err != nil {
-		return makeExecResult(hostname, "", err)
+		return makeExecResult(t.name, "", err)
+	}
+	if client != nil {
+		defer client.Close()
 	}
+
+	// With --atomic or --backup the copy is only put in place once complete
+	up := opt
+	var deploy *deployment
+	if opt.Atomic || opt.Backup {
+		if deploy, err = newDeployment(opt, conn, client); err != nil {
+			return makeExecResult(t.name, "", err)
+		}
+		up.Dst = deploy.staging
+	}
+
+	if client != nil {
+		resume := newSFTPResume(opt, conn, done, attempt < opt.Retries)
+		err = waitWithTimeout(sftpProcess{client, conn}, commandTimeout(opt), func() error {
+			stats.bytes, err = sftpUpload(client, up, prog, resume)
+			return err
+		})
+	} else {
+		stats.bytes, err = scpUpload(up, conn, prog)
+	}
+	if deploy != nil {
+		if err == nil {
+			err = deploy.commit()
+		} else {
+			deploy.abort()
+		}
+	}
+	return transferResult(opt, t, conn, env, stats, err)
+}
+
+// scpUpload copies opt.Src to opt.Dst by running `scp -t` on the host. It
+// returns the number of bytes sent, which are also counted in prog.
+func scpUpload(opt common.Options, conn *ssh.Client, prog *hostProgress) (int64, error) {
+	// Validate SCP binary exists and is executable
+	if err := validateSCPPath(DefaultSCPPath); err != nil {
+		return 0, err
+	}
+
+	errPipe := os.Stderr
+	srcFileInfo, err := os.Stat(opt.Src)
+	if err != nil {
+		fmt.Fprintln(errPipe, "Could not stat source file "+opt.Src)
+		return 0, err
+	}
+
+	// The remote scp writes into opt.Dst if it is a directory, or to
+	// opt.Dst itself otherwise
+	flags := "-qrt"
+	if opt.Preserve {
+		flags = "-qprt"
+	}
+	scpCmd := fmt.Sprintf("%s %s %s", DefaultSCPPath, flags, shellQuote(opt.Dst))
+	var sent int64
+	err = runSCPSink(opt, conn, scpCmd, prog, func(source *scpSource) error {
+		defer func() { sent = source.bytes }()
+		if opt.IsRecursive {
+			if srcFileInfo.IsDir() {
+				return source.processDir(opt.Src, srcFileInfo)
+			}
+			return source.sendFile(opt.Src, srcFileInfo)
+		}
+		if srcFileInfo.IsDir() {
+			fmt.Fprintln(errPipe, "Not a regular file:", opt.Src, "specify recursive")
+			return fmt.Errorf("Not a regular file %v", opt.Src)
+		}
+		return source.sendFile(opt.Src, srcFileInfo)
+	})
+	return sent, err
+}
+
+// runSCPSink starts scpCmd, which runs `scp -t` on the host, and calls send
+// to send it records once it is ready, counting the file contents sent in
+// prog. It returns when the remote scp has exited, with an error if it
+// failed.
+func runSCPSink(opt common.Options, conn *ssh.Client, scpCmd string, prog *hostProgress, send func(*scpSource) error) error {
 	session, err := conn.NewSession()
 	if err != nil {
 		//go:nocovline // NewSession failure hard to test without mock SSH server
-		return makeExecResult(hostname, "", fmt.Errorf("failed to create SSH session: %w", err))
+		return fmt.Errorf("failed to create SSH session: %w", err)
 	}
 	defer session.Close()
 
-	errPipe := os.Stderr
 	procWriter, err := session.StdinPipe()
 	if err != nil {
 		//go:nocovline // StdinPipe failure hard to test without mock SSH server
-		return makeExecResult(hostname, "", fmt.Errorf("could not open stdin pipe: %w", err))
+		return fmt.Errorf("could not open stdin pipe: %w", err)
 	}
 	defer procWriter.Close()
-
-	srcFileInfo, err := os.Stat(opt.Src)
+	procReader, err := session.StdoutPipe()
 	if err != nil {
-		fmt.Fprintln(errPipe, "Could not stat source file "+opt.Src)
-		return makeExecResult(hostname, "", err)
+		//go:nocovline // StdoutPipe failure hard to test without mock SSH server
+		return fmt.Errorf("could not open stdout pipe: %w", err)
 	}
 
-	// Check if we are sending a directory or single file
-	// Dir is only valid with recursive mode
-	if srcFileInfo.Mode().IsRegular() {
-		targetDir = filepath.Dir(opt.Dst)
-	} else {
-		targetDir = opt.Dst
-	}
-	scpCmd := fmt.Sprintf("%s -qrt %s", DefaultSCPPath, targetDir)
-	err = session.Start(scpCmd)
-	if err != nil {
+	if err := session.Start(scpCmd); err != nil {
 		//go:nocovline // session.Start failure hard to test without mock SSH server
-		return makeExecResult(hostname, "", fmt.Errorf("could not start scp command: %w", err))
+		return fmt.Errorf("could not start scp command: %w", err)
 	}
 
-	if opt.IsRecursive {
-		if srcFileInfo.IsDir() {
-			err = processDir(opt.Src, srcFileInfo, procWriter, errPipe, opt.IsVerbose)
-		} else {
-			err = sendFile(opt.Src, srcFileInfo, procWriter, errPipe, opt.IsVerbose)
+	source := newSCPSource(procWriter, procReader, os.Stderr, opt.IsVerbose)
+	source.preserve = opt.Preserve
+	source.symlinks = opt.Symlinks
+	source.progress = prog
+	return waitWithTimeout(sessionProcess{session, conn}, commandTimeout(opt), func() error {
+		// The remote scp acknowledges that it is ready before any record
+		err := source.readAck()
+		if err == nil {
+			err = send(source)
 		}
-	} else {
-		if srcFileInfo.IsDir() {
-			fmt.Fprintln(errPipe, "Not a regular file:", opt.Src, "specify recursive")
-			err = fmt.Errorf("Not a regular file %v", opt.Src)
-		} else {
-			err = sendFile(opt.Src, srcFileInfo, procWriter, errPipe, opt.IsVerbose)
+		// Closing stdin lets the remote scp exit, with a non-zero status if
+		// anything failed on its side
+		procWriter.Close()
+		if waitErr := session.Wait(); err == nil {
+			err = waitErr
 		}
-	}
-
-	return makeExecResult(hostname, "Finished\n", err)
+		return err
+	})
 }
@@ -60,7 +60,7 @@ func TestExecuteCopy_ErrorPaths(t *testing.T) {
 				Auth: []ssh.AuthMethod{ssh.PublicKeys(nil)},
 			}
 
-			result := executeCopy(tt.options, tt.hostname, config)
+			result := executeCopy(tt.options, testTarget(t, tt.options, tt.hostname), &runEnv{config: config})
 
 			// Should return an error (connection will fail or file doesn't exist)
 			if result.err == nil && tt.options.Src != "" {
@@ -68,8 +68,8 @@ func TestExecuteCopy_ErrorPaths(t *testing.T) {
 			}
 
 			// Result should contain hostname
-			if result.result == "" {
-				t.Error("Expected result to contain hostname")
+			if result.host != tt.hostname {
+				t.Errorf("Expected result host %q, got %q", tt.hostname, result.host)
 			}
 		})
 	}
@@ -114,7 +114,7 @@ func TestProcessDir_ErrorPaths(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			var procWriter, errPipe bytes.Buffer
 
-			err := processDir(tt.srcPath, tt.srcFileInfo, &procWriter, &errPipe, false)
+			err := testSource(&procWriter, &errPipe).processDir(tt.srcPath, tt.srcFileInfo)
 
 			if tt.expectErr && err == nil {
 				t.Error("Expected error, got nil")
@@ -153,7 +153,7 @@ func TestSendFile_ErrorPaths(t *testing.T) {
 			fileInfo, _ := os.Stat("/tmp") // Use any valid file info
 			var procWriter, errPipe bytes.Buffer
 
-			err := sendFile(tt.srcFile, fileInfo, &procWriter, &errPipe, false)
+			err := testSource(&procWriter, &errPipe).sendFile(tt.srcFile, fileInfo)
 
 			if tt.expectErr && err == nil {
 				t.Error("Expected error, got nil")
@@ -197,10 +197,10 @@ func TestExecuteCopy_InvalidOptions(t *testing.T) {
 				Auth: []ssh.AuthMethod{ssh.PublicKeys(nil)},
 			}
 
-			result := executeCopy(tt.options, "localhost", config)
+			result := executeCopy(tt.options, testTarget(t, tt.options, "localhost"), &runEnv{config: config})
 
 			// Should have some result or error
-			_ = result.result
+			_ = result.host
 			_ = result.err
 		})
 	}
@@ -218,7 +218,7 @@ func TestProcessDir_EmptyDirectory(t *testing.T) {
 	var procWriter, errPipe bytes.Buffer
 
 	// This should process without errors (just no files to process)
-	err = processDir(tmpDir, dirInfo, &procWriter, &errPipe, false)
+	err = testSource(&procWriter, &errPipe).processDir(tmpDir, dirInfo)
 	// Will fail at sendDir, but that's expected - just verify it doesn't panic
 	_ = err
 }
@@ -19,7 +19,10 @@ import (
 	"github.com/raravena80/ya/common"
 	"github.com/raravena80/ya/test"
 	"golang.org/x/crypto/ssh/testdata"
+	"io"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 )
@@ -242,6 +245,7 @@ func TestCopy(t *testing.T) {
 				common.SetKey(tt.key.Keyname),
 				common.SetUseAgent(tt.useagent),
 				common.SetTimeout(tt.timeout),
+				common.SetInsecureHost(true),
 				common.SetSource(tt.src),
 				common.SetDestination(tt.dst),
 				common.SetOp(tt.op),
@@ -260,7 +264,7 @@ func TestCopy(t *testing.T) {
 
 func TestSendEndDir(t *testing.T) {
 	var buf bytes.Buffer
-	err := sendEndDir(&buf, &buf)
+	err := testSource(&buf, &buf).sendEndDir()
 	if err != nil {
 		t.Errorf("sendEndDir() returned error: %v", err)
 	}
@@ -297,7 +301,7 @@ func TestSendDir(t *testing.T) {
 			// Use test mode instead of actual file mode
 			fi = &mockFileInfo{name: tt.srcPath, mode: tt.mode}
 
-			err = sendDir(tt.srcPath, fi, &buf, &buf)
+			err = testSource(&buf, &buf).sendDir(tt.srcPath, fi)
 			if err != nil {
 				t.Errorf("sendDir() returned error: %v", err)
 			}
@@ -493,3 +497,161 @@ func TestTearCopy(t *testing.T) {
 
 	}
 }
+
+// testSource returns an scp source writing to w whose remote side
+// acknowledges every record.
+func testSource(w, errPipe io.Writer) *scpSource {
+	return newSCPSource(w, strings.NewReader(strings.Repeat("\x00", 64)), errPipe, false)
+}
+
+func TestSCPSourceAcks(t *testing.T) {
+	tests := []struct {
+		name   string
+		acks   string
+		errMsg string
+	}{
+		{name: "Acknowledged", acks: "\x00"},
+		{name: "Warning", acks: "\x01scp: /data/dir: Permission denied\n", errMsg: "remote scp warning: scp: /data/dir: Permission denied"},
+		{name: "Fatal error", acks: "\x02scp: protocol error\n", errMsg: "remote scp error: scp: protocol error"},
+		{name: "Unexpected byte", acks: "x", errMsg: "unexpected scp acknowledgement"},
+		{name: "Remote went away", acks: "", errMsg: "failed to read scp acknowledgement"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			source := newSCPSource(&buf, strings.NewReader(tt.acks), &buf, false)
+			err := source.sendEndDir()
+			if tt.errMsg == "" {
+				if err != nil {
+					t.Errorf("sendEndDir() error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.errMsg) {
+				t.Errorf("sendEndDir() error = %v, want %q", err, tt.errMsg)
+			}
+		})
+	}
+}
+
+func TestExecuteCopy_RemoteStatus(t *testing.T) {
+	srcFile := filepath.Join(t.TempDir(), "payload.txt")
+	if err := os.WriteFile(srcFile, []byte("payload"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dstDir := t.TempDir()
+	entry := fmt.Sprintf("127.0.0.1:%d", execTestServer())
+
+	tests := []struct {
+		name   string
+		dst    string
+		errMsg string
+	}{
+		{name: "Copied", dst: filepath.Join(dstDir, "payload.txt")},
+		{name: "Missing remote directory", dst: "/nonexistent/dir/payload.txt", errMsg: "No such file or directory"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opt := common.Options{Src: srcFile, Dst: tt.dst}
+			res := executeCopy(opt, testTarget(t, opt, entry), &runEnv{config: execTestConfig()})
+			if tt.errMsg == "" {
+				if res.err != nil {
+					t.Fatalf("executeCopy() error: %v", res.err)
+				}
+				// The remote scp has exited, so the file is complete
+				if data, err := os.ReadFile(tt.dst); err != nil || string(data) != "payload" {
+					t.Errorf("Copied file = %q, %v, want payload", data, err)
+				}
+				return
+			}
+			if res.err == nil || !strings.Contains(res.err.Error(), tt.errMsg) {
+				t.Errorf("executeCopy() error = %v, want %q", res.err, tt.errMsg)
+			}
+		})
+	}
+}
+
+func TestSCPSourcePreserve(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "dir")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "f.txt")
+	if err := os.WriteFile(file, []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Unix(1500000000, 0)
+	atime := time.Unix(1600000000, 0)
+	for _, p := range []string{file, dir} {
+		if err := os.Chtimes(p, atime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	source := testSource(&buf, &buf)
+	source.preserve = true
+	if err := source.processDir(dir, info); err != nil {
+		t.Fatalf("processDir() error: %v", err)
+	}
+	want := "T1500000000 0 1600000000 0\nD0755 0 dir\n" +
+		"T1500000000 0 1600000000 0\nC0644 1 f.txt\nx\x00E\n"
+	if buf.String() != want {
+		t.Errorf("processDir() sent %q, want %q", buf.String(), want)
+	}
+}
+
+func TestSCPSourceSymlinkAsLink(t *testing.T) {
+	root := linkTree(t, false)
+	info, err := os.Stat(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	source := testSource(&buf, &buf)
+	source.symlinks = SymlinksLink
+	if err := source.processDir(root, info); err == nil || !strings.Contains(err.Error(), "--protocol sftp") {
+		t.Errorf("processDir() error = %v, want a hint to use sftp", err)
+	}
+}
+
+func TestExecuteCopy_Preserve(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "tree")
+	mtime := time.Date(2018, 3, 4, 5, 6, 7, 0, time.UTC)
+	files := map[string]string{"a.txt": "first\n", "nested/b.txt": "second\n"}
+	writeTree(t, src, files, mtime)
+	out := t.TempDir()
+
+	opt := common.Options{Src: src, Dst: out, IsRecursive: true, Preserve: true, Protocol: ProtocolSCP}
+	entry := fmt.Sprintf("127.0.0.1:%d", execTestServer())
+	res := executeCopy(opt, testTarget(t, opt, entry), &runEnv{config: execTestConfig()})
+	if res.err != nil {
+		t.Fatalf("executeCopy() error: %v", res.err)
+	}
+	checkTree(t, filepath.Join(out, "tree"), files, mtime)
+}
+
+func TestExecuteCopy_DestinationWithSpaces(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "app.conf")
+	if err := os.WriteFile(src, []byte("new\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(t.TempDir(), "my app")
+	if err := os.Mkdir(out, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	opt := common.Options{Src: src, Dst: out, Protocol: ProtocolSCP}
+	entry := fmt.Sprintf("127.0.0.1:%d", execTestServer())
+	res := executeCopy(opt, testTarget(t, opt, entry), &runEnv{config: execTestConfig()})
+	if res.err != nil {
+		t.Fatalf("executeCopy() error: %v", res.err)
+	}
+	if data, err := os.ReadFile(filepath.Join(out, "app.conf")); err != nil || string(data) != "new\n" {
+		t.Errorf("app.conf = %q, %v, want %q", data, err, "new\n")
+	}
+}
@@ -0,0 +1,246 @@
+// Copyright © 2017 Ricardo Aravena <raravena80@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ops
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+	"github.com/raravena80/ya/common"
+	"golang.org/x/crypto/ssh"
+)
+
+// backupInfix comes between the name of a replaced file and the time it was
+// replaced at in the name of its backup.
+const backupInfix = ".ya-bak."
+
+// backupStamp is the layout of the time in backup names, which sort in
+// the order they were made.
+const backupStamp = "20060102T150405Z"
+
+// validateDeploy checks the options of --atomic and --backup, which only
+// apply to copies to the hosts that ya makes itself.
+func validateDeploy(opt common.Options) error {
+	if !opt.Atomic && !opt.Backup {
+		return nil
+	}
+	if opt.Op != "scp" || opt.FromRemote {
+		return errors.New("--atomic and --backup only apply to copies to the servers")
+	}
+	if opt.Relay > 0 {
+		return errors.New("--atomic and --backup cannot be used with --relay")
+	}
+	return nil
+}
+
+// deployment puts a copy in place on a host once it is complete. The copy
+// is uploaded to a staging path next to its final one and renamed into
+// place, after keeping the previous version as a backup if asked to.
+type deployment struct {
+	path    string // Final path of the copy
+	staging string
+	backup  string       // Where the previous version is kept, empty to remove it
+	client  *sftp.Client // Used when set, otherwise shell commands over conn
+	conn    *ssh.Client
+	opt     common.Options
+}
+
+// newDeployment finds the final path of the copy of opt.Src to opt.Dst on
+// the host, which is inside opt.Dst if it is a directory, and removes what
+// an earlier attempt may have left at the staging path.
+func newDeployment(opt common.Options, conn *ssh.Client, client *sftp.Client) (*deployment, error) {
+	d := &deployment{client: client, conn: conn, opt: opt}
+	base := path.Base(strings.ReplaceAll(opt.Src, `\`, "/"))
+	if client != nil {
+		d.path = opt.Dst
+		if st, err := client.Stat(opt.Dst); err == nil && st.IsDir() {
+			d.path = path.Join(opt.Dst, base)
+		}
+	} else {
+		script := "f=" + shellQuote(opt.Dst) + "\n" +
+			"if [ -d \"$f\" ]; then f=\"$f\"/" + shellQuote(base) + "; fi\n" +
+			"printf '%s\\n' \"$f\"\n"
+		out, err := runRemote(opt, conn, "sh -c "+shellQuote(script))
+		if err != nil {
+			return nil, fmt.Errorf("failed to find the destination: %w", err)
+		}
+		d.path = strings.TrimSuffix(string(out), "\n")
+	}
+	d.staging = d.path + partialSuffix
+	if opt.Backup {
+		d.backup = d.path + backupInfix + time.Now().UTC().Format(backupStamp)
+	}
+	return d, d.abort()
+}
+
+// abort removes the staging path.
+func (d *deployment) abort() error {
+	if d.client != nil {
+		if err := d.client.RemoveAll(d.staging); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	_, err := runRemote(d.opt, d.conn, "rm -rf -- "+shellQuote(d.staging))
+	return err
+}
+
+// commit renames the staging path into place. A file replaces the previous
+// one in a single rename, after a hard link to it, or a copy where links
+// are not supported, is made as the backup; a directory, which cannot
+// replace another, is moved aside first and briefly leaves the path missing.
+func (d *deployment) commit() error {
+	if d.client == nil {
+		if _, err := runRemote(d.opt, d.conn, "sh -c "+shellQuote(commitScript(d.path, d.staging, d.backup))); err != nil {
+			return fmt.Errorf("failed to put %s in place: %w", d.path, err)
+		}
+		return nil
+	}
+
+	st, err := d.client.Lstat(d.path)
+	if err != nil || !st.IsDir() {
+		if err == nil && d.backup != "" {
+			if err := sftpBackup(d.client, d.path, d.backup, st); err != nil {
+				return fmt.Errorf("failed to back up %s: %w", d.path, err)
+			}
+		}
+		if err := sftpRename(d.client, d.staging, d.path); err != nil {
+			if d.backup != "" {
+				d.client.Remove(d.backup)
+			}
+			return fmt.Errorf("failed to put %s in place: %w", d.path, err)
+		}
+		return nil
+	}
+
+	old := d.backup
+	if old == "" {
+		old = d.path + ".ya-old"
+		d.client.RemoveAll(old)
+	}
+	if err := d.client.Rename(d.path, old); err != nil {
+		return fmt.Errorf("failed to move %s aside: %w", d.path, err)
+	}
+	if err := d.client.Rename(d.staging, d.path); err != nil {
+		d.client.Rename(old, d.path)
+		return fmt.Errorf("failed to put %s in place: %w", d.path, err)
+	}
+	if old != d.backup {
+		d.client.RemoveAll(old)
+	}
+	return nil
+}
+
+// sftpBackup makes backup a hard link to the file or symlink p, described
+// by info, leaving p in place. It falls back to a copy when the server
+// does not support hard links.
+func sftpBackup(client *sftp.Client, p, backup string, info fs.FileInfo) error {
+	if _, ok := client.HasExtension("hardlink@openssh.com"); ok {
+		if err := client.Link(p, backup); err == nil {
+			return nil
+		}
+	}
+	if info.Mode()&fs.ModeSymlink != 0 {
+		target, err := client.ReadLink(p)
+		if err != nil {
+			return err
+		}
+		return client.Symlink(target, backup)
+	}
+	src, err := client.Open(p)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := client.OpenFile(backup, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		client.Remove(backup)
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		client.Remove(backup)
+		return err
+	}
+	client.Chmod(backup, info.Mode().Perm())
+	return nil
+}
+
+// commitScript returns a shell script doing what deployment.commit does
+// over SFTP.
+func commitScript(path, staging, backup string) string {
+	old := backup
+	if old == "" {
+		old = path + ".ya-old"
+	}
+	script := "f=" + shellQuote(path) + "; p=" + shellQuote(staging) + "; o=" + shellQuote(old) + "; m=\n"
+	if backup != "" {
+		script += "if [ -d \"$f\" ] && [ ! -L \"$f\" ]; then mv -- \"$f\" \"$o\" && m=1 || exit 1\n" +
+			"elif [ -e \"$f\" ] || [ -L \"$f\" ]; then ln -- \"$f\" \"$o\" 2>/dev/null || cp -pP -- \"$f\" \"$o\" || exit 1; fi\n"
+	} else {
+		script += "if [ -d \"$f\" ] && [ ! -L \"$f\" ]; then rm -rf -- \"$o\" && mv -- \"$f\" \"$o\" && m=1 || exit 1; fi\n"
+	}
+	script += "mv -f -- \"$p\" \"$f\" || { if [ -n \"$m\" ]; then mv -- \"$o\" \"$f\"; else rm -f -- \"$o\"; fi; exit 1; }\n"
+	if backup == "" {
+		script += "rm -rf -- \"$o\"\n"
+	}
+	return script
+}
+
+// rollbackScript returns a shell script that puts the latest backup of p
+// back in its place and prints the backup's path.
+func rollbackScript(p string) string {
+	return "f=" + shellQuote(p) + "\n" +
+		"b=$(ls -d -- \"$f\"" + shellQuote(backupInfix) + "* 2>/dev/null | LC_ALL=C sort | tail -n 1)\n" +
+		"[ -n \"$b\" ] || { echo \"no backup of $f\" >&2; exit 1; }\n" +
+		"if [ -d \"$f\" ] && [ ! -L \"$f\" ] || [ -d \"$b\" ]; then rm -rf -- \"$f\" || exit 1; fi\n" +
+		"mv -f -- \"$b\" \"$f\" || exit 1\n" +
+		"printf '%s\\n' \"$b\"\n"
+}
+
+// executeRollback restores the latest backup of opt.Dst made by a copy with
+// --backup, which replaces the current version. Rolling back again restores
+// the backup before that.
+func executeRollback(opt common.Options, t target, env *runEnv) executeResult {
+	// Validate destination path for security
+	if err := validatePath(opt.Dst); err != nil {
+		return makeExecResult(t.name, "", err)
+	}
+	if opt.Dst == "" {
+		return makeExecResult(t.name, "", fmt.Errorf("rollback needs the path to restore"))
+	}
+	conn, err := dialHost(opt, t, env)
+	if err != nil {
+		return makeExecResult(t.name, "", err)
+	}
+	defer conn.Close()
+
+	out, err := runRemote(opt, conn, "sh -c "+shellQuote(rollbackScript(opt.Dst)))
+	if err != nil {
+		return makeExecResult(t.name, "", fmt.Errorf("failed to roll back %s: %w", opt.Dst, err))
+	}
+	backup := strings.TrimSuffix(string(out), "\n")
+	return makeExecResult(t.name, fmt.Sprintf("Restored %s from %s\n", opt.Dst, backup), nil)
+}
@@ -0,0 +1,290 @@
+// Copyright © 2017 Ricardo Aravena <raravena80@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ops
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/raravena80/ya/common"
+)
+
+func TestValidateDeploy(t *testing.T) {
+	tests := []struct {
+		name      string
+		opt       common.Options
+		expectErr bool
+	}{
+		{name: "Neither", opt: common.Options{Op: "sync"}},
+		{name: "Atomic", opt: common.Options{Op: "scp", Atomic: true}},
+		{name: "Backup", opt: common.Options{Op: "scp", Backup: true}},
+		{name: "From remote", opt: common.Options{Op: "scp", Atomic: true, FromRemote: true}, expectErr: true},
+		{name: "Sync", opt: common.Options{Op: "sync", Backup: true}, expectErr: true},
+		{name: "Relay", opt: common.Options{Op: "scp", Atomic: true, Relay: 2}, expectErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateDeploy(tt.opt); (err != nil) != tt.expectErr {
+				t.Errorf("validateDeploy() error = %v, expectErr %v", err, tt.expectErr)
+			}
+		})
+	}
+}
+
+// readPath returns the contents of the file p, or of the file "f" inside
+// it if p is a directory.
+func readPath(t *testing.T, p string) string {
+	t.Helper()
+	if st, err := os.Stat(p); err == nil && st.IsDir() {
+		p = filepath.Join(p, "f")
+	}
+	data, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// writePath writes a file at p, or a directory holding the file "f".
+func writePath(t *testing.T, p, contents string, dir bool) {
+	t.Helper()
+	if dir {
+		if err := os.MkdirAll(p, 0755); err != nil {
+			t.Fatal(err)
+		}
+		p = filepath.Join(p, "f")
+	}
+	if err := os.WriteFile(p, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCommitScript(t *testing.T) {
+	tests := []struct {
+		name       string
+		dir        bool
+		existing   bool
+		backup     bool
+		wantBackup string
+	}{
+		{name: "New file"},
+		{name: "Replaced file", existing: true},
+		{name: "Replaced file with backup", existing: true, backup: true, wantBackup: "old"},
+		{name: "New file with backup", backup: true},
+		{name: "Replaced directory", dir: true, existing: true},
+		{name: "Replaced directory with backup", dir: true, existing: true, backup: true, wantBackup: "old"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := filepath.Join(t.TempDir(), "app.conf")
+			if tt.existing {
+				writePath(t, p, "old", tt.dir)
+			}
+			writePath(t, p+partialSuffix, "new", tt.dir)
+			backup := ""
+			if tt.backup {
+				backup = p + backupInfix + "20240102T030405Z"
+			}
+			if out, err := exec.Command("sh", "-c", commitScript(p, p+partialSuffix, backup)).CombinedOutput(); err != nil {
+				t.Fatalf("commit script failed: %v: %s", err, out)
+			}
+			if got := readPath(t, p); got != "new" {
+				t.Errorf("%s holds %q, want new", p, got)
+			}
+			entries, _ := filepath.Glob(p + ".*")
+			if tt.wantBackup == "" && len(entries) > 0 {
+				t.Errorf("commit script left %v", entries)
+			}
+			if tt.wantBackup != "" {
+				if len(entries) != 1 || readPath(t, backup) != tt.wantBackup {
+					t.Errorf("commit script left %v, want only the backup", entries)
+				}
+			}
+		})
+	}
+}
+
+func TestCommitScriptFailure(t *testing.T) {
+	for _, dir := range []bool{false, true} {
+		t.Run(fmt.Sprintf("dir=%v", dir), func(t *testing.T) {
+			p := filepath.Join(t.TempDir(), "app.conf")
+			writePath(t, p, "old", dir)
+			backup := p + backupInfix + "20240102T030405Z"
+			// No staging path, so the final rename fails
+			if err := exec.Command("sh", "-c", commitScript(p, p+partialSuffix, backup)).Run(); err == nil {
+				t.Fatal("commit script without a staging path succeeded")
+			}
+			if got := readPath(t, p); got != "old" {
+				t.Errorf("%s holds %q, want old", p, got)
+			}
+			if entries, _ := filepath.Glob(p + ".*"); len(entries) > 0 {
+				t.Errorf("commit script left %v", entries)
+			}
+		})
+	}
+}
+
+func TestRollbackScript(t *testing.T) {
+	for _, dir := range []bool{false, true} {
+		t.Run(fmt.Sprintf("dir=%v", dir), func(t *testing.T) {
+			p := filepath.Join(t.TempDir(), "app")
+			writePath(t, p, "v3", dir)
+			writePath(t, p+backupInfix+"20240101T000000Z", "v1", dir)
+			writePath(t, p+backupInfix+"20240201T000000Z", "v2", dir)
+			rollback := func() (string, error) {
+				out, err := exec.Command("sh", "-c", rollbackScript(p)).CombinedOutput()
+				return strings.TrimSpace(string(out)), err
+			}
+
+			for _, want := range []string{"v2", "v1"} {
+				out, err := rollback()
+				if err != nil {
+					t.Fatalf("rollback script failed: %v: %s", err, out)
+				}
+				if got := readPath(t, p); got != want {
+					t.Errorf("%s holds %q after rollback, want %q", p, got, want)
+				}
+			}
+			if out, err := rollback(); err == nil || !strings.Contains(out, "no backup of") {
+				t.Errorf("rollback without backups = %v: %s", err, out)
+			}
+		})
+	}
+}
+
+func TestExecuteCopyAtomic(t *testing.T) {
+	src := t.TempDir()
+	writePath(t, filepath.Join(src, "app.conf"), "new", false)
+	writePath(t, filepath.Join(src, "conf.d"), "new", true)
+	port := sftpTestServer()
+	entry := fmt.Sprintf("127.0.0.1:%d", port)
+
+	tests := []struct {
+		name     string
+		src      string
+		dir      bool
+		intoDir  bool // Copy into the directory holding the destination
+		backup   bool
+		existing bool
+	}{
+		{name: "New file", src: "app.conf"},
+		{name: "Replaced file", src: "app.conf", existing: true},
+		{name: "Replaced file in directory", src: "app.conf", existing: true, intoDir: true},
+		{name: "Backed up file", src: "app.conf", existing: true, backup: true},
+		{name: "Backed up file in directory", src: "app.conf", existing: true, intoDir: true, backup: true},
+		{name: "Replaced directory", src: "conf.d", dir: true, existing: true, intoDir: true},
+		{name: "Backed up directory", src: "conf.d", dir: true, existing: true, intoDir: true, backup: true},
+	}
+	for _, protocol := range []string{ProtocolSCP, ProtocolSFTP} {
+		for _, tt := range tests {
+			t.Run(protocol+"/"+tt.name, func(t *testing.T) {
+				root := t.TempDir()
+				final := filepath.Join(root, tt.src)
+				if tt.existing {
+					writePath(t, final, "old", tt.dir)
+				}
+				dst := final
+				if tt.intoDir {
+					dst = root
+				}
+				opt := common.Options{Src: filepath.Join(src, tt.src), Dst: dst, IsRecursive: tt.dir,
+					Atomic: true, Backup: tt.backup, Protocol: protocol}
+				res := executeCopy(opt, testTarget(t, opt, entry), &runEnv{config: execTestConfig()})
+				if res.err != nil {
+					t.Fatalf("executeCopy() error: %v", res.err)
+				}
+				if got := readPath(t, final); got != "new" {
+					t.Errorf("%s holds %q, want new", final, got)
+				}
+				left, _ := filepath.Glob(final + ".*")
+				if !tt.backup {
+					if len(left) > 0 {
+						t.Errorf("copy left %v", left)
+					}
+					return
+				}
+				if len(left) != 1 || !strings.Contains(left[0], backupInfix) || readPath(t, left[0]) != "old" {
+					t.Fatalf("copy left %v, want only the backup", left)
+				}
+
+				opt = common.Options{Dst: final}
+				res = executeRollback(opt, testTarget(t, opt, entry), &runEnv{config: execTestConfig()})
+				if want := fmt.Sprintf("Restored %s from %s\n", final, left[0]); res.err != nil || res.stdout != want {
+					t.Errorf("executeRollback() = %q, %v, want %q", res.stdout, res.err, want)
+				}
+				if got := readPath(t, final); got != "old" {
+					t.Errorf("%s holds %q after rollback, want old", final, got)
+				}
+				res = executeRollback(opt, testTarget(t, opt, entry), &runEnv{config: execTestConfig()})
+				if res.err == nil || !strings.Contains(res.err.Error(), "no backup of") {
+					t.Errorf("executeRollback() without backups error = %v", res.err)
+				}
+			})
+		}
+	}
+}
+
+func TestExecuteCopyAtomicFailure(t *testing.T) {
+	data := strings.Repeat("new contents\n", 40000)
+	src := filepath.Join(t.TempDir(), "app.conf")
+	writePath(t, src, data, false)
+	port := sftpTestServer()
+
+	for _, protocol := range []string{ProtocolSCP, ProtocolSFTP} {
+		t.Run(protocol, func(t *testing.T) {
+			final := filepath.Join(t.TempDir(), "app.conf")
+			writePath(t, final, "old", false)
+			entry := fmt.Sprintf("127.0.0.1:%d", flakyProxy(t, port, 1, 200*1024))
+			opt := common.Options{Src: src, Dst: final, Atomic: true, Protocol: protocol}
+			if res := executeCopy(opt, testTarget(t, opt, entry), &runEnv{config: execTestConfig()}); res.err == nil {
+				t.Fatal("executeCopy() over a cut connection succeeded")
+			}
+			// Give the server time to notice the connection is gone
+			time.Sleep(100 * time.Millisecond)
+			if got := readPath(t, final); got != "old" {
+				t.Errorf("%s holds %d bytes after a failed copy, want the old version", final, len(got))
+			}
+
+			// The next copy replaces what the failed one left
+			res := executeCopy(opt, testTarget(t, opt, entry), &runEnv{config: execTestConfig()})
+			if res.err != nil {
+				t.Fatalf("executeCopy() error: %v", res.err)
+			}
+			if got := readPath(t, final); got != data {
+				t.Errorf("%s holds %d bytes, want %d", final, len(got), len(data))
+			}
+			if left, _ := filepath.Glob(final + ".*"); len(left) > 0 {
+				t.Errorf("copy left %v", left)
+			}
+		})
+	}
+}
+
+func TestExecuteRollbackErrors(t *testing.T) {
+	entry := fmt.Sprintf("127.0.0.1:%d", execTestServer())
+	for name, dst := range map[string]string{"Empty path": "", "Traversal": "/tmp/../etc/passwd"} {
+		t.Run(name, func(t *testing.T) {
+			opt := common.Options{Dst: dst}
+			if res := executeRollback(opt, testTarget(t, opt, entry), &runEnv{config: execTestConfig()}); res.err == nil {
+				t.Error("Expected an error, got nil")
+			}
+		})
+	}
+}
@@ -16,54 +16,131 @@ package ops
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/raravena80/ya/common"
-	"github.com/skeema/knownhosts"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
 )
 
-// executeResult holds the result of an SSH operation.
+// executeResult holds the result of an SSH operation on a single host.
 type executeResult struct {
-	result string
-	err    error
+	host     string
+	stdout   string
+	stderr   string
+	exitCode int    // Remote exit status, -1 if the command never completed
+	signal   string // Signal that terminated the remote command, if any
+	duration time.Duration
+	transfer *transferStats // How a copied file got to the host, nil for other operations
+	retries  int            // Times the operation was retried after failing
+	err      error
 }
 
-// Formatter defines the interface for output formatting.
-type Formatter interface {
-	FormatResult(hostname, output string, err error) string
-	FormatError(err error) string
+// Result status values reported by executeResult.status.
+const (
+	statusOK      = "ok"
+	statusFailed  = "failed"
+	statusTimeout = "timeout"
+	statusError   = "error"
+)
+
+// ErrCommandTimeout is reported for a host whose command or transfer did not
+// finish within Options.CommandTimeout.
+var ErrCommandTimeout = errors.New("command timed out")
+
+// status summarises the result: statusOK on success, statusFailed when the
+// remote command ran but exited non-zero or was killed by a signal,
+// statusTimeout when it exceeded the command timeout, and statusError when
+// it could not be run at all (dial, auth, session errors).
+func (r executeResult) status() string {
+	switch {
+	case r.err == nil:
+		return statusOK
+	case errors.Is(r.err, ErrCommandTimeout):
+		return statusTimeout
+	case r.exitCode > 0 || r.signal != "":
+		return statusFailed
+	default:
+		return statusError
+	}
 }
 
-// TextFormatter implements plain text output formatting.
-type TextFormatter struct{}
+// exitStatus extracts the remote exit code and signal from an error
+// returned by session.Run or session.Wait. It returns -1 when the error
+// does not carry a remote exit status.
+func exitStatus(err error) (int, string) {
+	if err == nil {
+		return 0, ""
+	}
+	var exitErr *ssh.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitStatus(), exitErr.Signal()
+	}
+	return -1, ""
+}
 
-func (f *TextFormatter) FormatResult(hostname, output string, err error) string {
-	return hostname + ":\n" + output
+// commandTimeout returns the command deadline from opt, or 0 for none.
+func commandTimeout(opt common.Options) time.Duration {
+	if opt.CommandTimeout == nil || *opt.CommandTimeout <= 0 {
+		return 0
+	}
+	return time.Duration(*opt.CommandTimeout) * time.Second
 }
 
-func (f *TextFormatter) FormatError(err error) string {
-	return fmt.Sprintf("Error: %v", err)
+// remoteProcess is used to stop a remote command that ran out of time.
+type remoteProcess interface {
+	Signal(sig ssh.Signal) error
+	Close() error
 }
 
-// JSONFormatter implements JSON output formatting.
-type JSONFormatter struct{}
+// sessionProcess stops a remote command by signalling its session and then
+// closing the session and the connection, which unblocks any pending I/O.
+type sessionProcess struct {
+	session *ssh.Session
+	conn    io.Closer
+}
 
-func (f *JSONFormatter) FormatResult(hostname, output string, err error) string {
-	var status string
-	if err != nil {
-		status = fmt.Sprintf("\"error\": %q", err.Error())
-	} else {
-		status = fmt.Sprintf("\"output\": %q", output)
-	}
-	return fmt.Sprintf(`{"host": %q, %s}`, hostname, status)
+func (p sessionProcess) Signal(sig ssh.Signal) error {
+	return p.session.Signal(sig)
+}
+
+func (p sessionProcess) Close() error {
+	p.session.Close()
+	return p.conn.Close()
 }
 
-func (f *JSONFormatter) FormatError(err error) string {
-	return fmt.Sprintf(`{"error": %q}`, err.Error())
+// waitWithTimeout waits for wait to return. If timeout elapses first, the
+// remote process is sent SIGTERM and closed, and once wait has returned an
+// error wrapping ErrCommandTimeout is reported. Closing proc must make wait
+// return. A zero timeout waits indefinitely.
+func waitWithTimeout(proc remoteProcess, timeout time.Duration, wait func() error) error {
+	if timeout <= 0 {
+		return wait()
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- wait()
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		proc.Signal(ssh.SIGTERM)
+		proc.Close()
+		<-done
+		return fmt.Errorf("%w after %v", ErrCommandTimeout, timeout)
+	}
 }
 
 // matchesPattern checks if a hostname matches a glob pattern.
@@ -162,39 +239,88 @@ func filterHosts(hosts []string, patterns, excludes []string) []string {
 	return filtered
 }
 
-type execFuncType func(common.Options, string, *ssh.ClientConfig) executeResult
+// runEnv holds the state shared by every host in a single run.
+type runEnv struct {
+	ctx       context.Context // Cancels the run, nil for none
+	config    *ssh.ClientConfig
+	sshConfig *common.SSHConfig // OpenSSH client config, nil if not used
+	stream    *streamer         // Live output writer, nil unless streaming
+	jumps     jumpPool          // Jump host connections shared by all hosts
+	passAuth  []ssh.AuthMethod  // Password and keyboard-interactive auth, tried after keys
+	agent     *common.Agent     // SSH agent connection, nil unless using the agent
+	digest    string            // SHA-256 of the source file, with --verify
+	relay     *relayTree        // Hosts serving the file to others, with --relay
+	progress  *progress         // Transfer progress and rate limits, nil unless enabled
+	rate      int64             // Transfer rate limit per host in bytes per second, 0 for none
+	certErr   error             // Why user certificates of the global keys were left out, if any
+
+	keysMu   sync.Mutex
+	keys     map[string]ssh.AuthMethod // Auth for per-host keys, loaded once per key file
+	certErrs map[string]error          // Why the user certificate of a per-host key was left out
+}
+
+// keyAuth returns the public key authentication for a per-host key file.
+// The agent is still offered when enabled.
+func (env *runEnv) keyAuth(key string) ssh.AuthMethod {
+	env.keysMu.Lock()
+	defer env.keysMu.Unlock()
+	if auth, ok := env.keys[key]; ok {
+		return auth
+	}
+	if env.keys == nil {
+		env.keys = map[string]ssh.AuthMethod{}
+		env.certErrs = map[string]error{}
+	}
+	signers, certErr := common.LoadKeyring([]string{key})
+	auth := publicKeyAuth(env.agent, signers)
+	env.keys[key] = auth
+	env.certErrs[key] = certErr
+	return auth
+}
+
+// certError returns why the user certificates t authenticates with were
+// left out, such as having expired, or nil if none were.
+func (env *runEnv) certError(t target) error {
+	if t.key == "" {
+		return env.certErr
+	}
+	env.keysMu.Lock()
+	defer env.keysMu.Unlock()
+	return env.certErrs[t.key]
+}
+
+type execFuncType func(common.Options, target, *runEnv) executeResult
 
 // makeExecResult creates a new executeResult with the given hostname, output, and error.
+// The exit code and signal are taken from err when it is an *ssh.ExitError.
 func makeExecResult(hostname, output string, err error) executeResult {
+	code, signal := exitStatus(err)
 	return executeResult{
-		result: hostname + ":\n" + output,
-		err:    err,
+		host:     hostname,
+		stdout:   output,
+		exitCode: code,
+		signal:   signal,
+		err:      err,
 	}
 }
 
-// getHostKeyCallback returns an appropriate HostKeyCallback based on options.
-// It uses known_hosts file for proper host key verification, with fallback to
-// insecure mode when explicitly requested or when known_hosts is not available.
-func getHostKeyCallback(opt common.Options) ssh.HostKeyCallback {
-	// If insecure mode is explicitly requested, use the insecure callback with a warning
-	if opt.InsecureHost {
-		fmt.Fprintln(os.Stderr, "Warning: Using insecure host key verification. This is not recommended for production.")
-		return ssh.InsecureIgnoreHostKey()
+// reportLearnedHosts writes the hosts whose keys were added to known_hosts
+// during the run to stderr.
+func reportLearnedHosts(learner *hostKeyLearner) {
+	if hosts := learner.hosts(); len(hosts) > 0 {
+		fmt.Fprintf(os.Stderr, "Added host keys for %d new hosts to %s: %s\n",
+			len(hosts), learner.file, strings.Join(hosts, ", "))
 	}
+}
 
-	// Try to use the user's known_hosts file for proper host key verification
-	knownHostsPath := os.ExpandEnv("~/.ssh/known_hosts")
-	callback, err := knownhosts.New(knownHostsPath)
-	if err != nil {
-		// If known_hosts file doesn't exist or is unreadable, fall back to insecure mode with warning
-		fmt.Fprintln(os.Stderr, "Warning: Could not read known_hosts file:", err)
-		fmt.Fprintln(os.Stderr, "Warning: Falling back to insecure host key verification.")
-		fmt.Fprintln(os.Stderr, "To fix this, ensure ~/.ssh/known_hosts exists or use --insecure-host to suppress this warning.")
-		return ssh.InsecureIgnoreHostKey()
+// printOutput writes formatted output to stdout, terminating it with a
+// newline if the formatter did not.
+func printOutput(out string) {
+	if out == "" || strings.HasSuffix(out, "\n") {
+		fmt.Print(out)
+		return
 	}
-
-	// Wrap the knownhosts callback to ensure type compatibility
-	return ssh.HostKeyCallback(callback)
+	fmt.Println(out)
 }
 
 // SSHSession creates SSH sessions to multiple machines and executes commands or copy operations.
@@ -206,7 +332,9 @@ func SSHSession(options ...func(*common.Options)) bool {
 }
 
 // SSHSessionWithContext creates SSH sessions with context support for cancellation.
-// If the context is cancelled before all operations complete, the function returns early.
+// If the context is cancelled before all operations complete, the running ones
+// are stopped by closing their connections and the hosts not yet started are
+// reported as cancelled.
 // Returns true if all operations succeed, false otherwise.
 func SSHSessionWithContext(ctx context.Context, options ...func(*common.Options)) bool {
 	var execFunc execFuncType
@@ -225,6 +353,12 @@ func SSHSessionWithContext(ctx context.Context, options ...func(*common.Options)
 		for _, m := range machines {
 			if opt.Op == "ssh" {
 				fmt.Printf("DRY-RUN: Would execute on %s: %s\n", m, opt.Cmd)
+			} else if opt.Op == "rollback" {
+				fmt.Printf("DRY-RUN: Would restore the latest backup of %s:%s\n", m, opt.Dst)
+			} else if opt.Op == "sync" {
+				fmt.Printf("DRY-RUN: Would sync %s to %s:%s\n", opt.Src, m, opt.Dst)
+			} else if opt.Op == "scp" && opt.FromRemote {
+				fmt.Printf("DRY-RUN: Would copy %s:%s to %s\n", m, opt.Src, filepath.Join(opt.Dst, hostDir(m)))
 			} else if opt.Op == "scp" {
 				if opt.IsRecursive {
 					fmt.Printf("DRY-RUN: Would copy (recursive) %s to %s:%s\n", opt.Src, m, opt.Dst)
@@ -244,81 +378,245 @@ func SSHSessionWithContext(ctx context.Context, options ...func(*common.Options)
 		connectTimeout = time.Duration(opt.Timeout) * time.Second
 	}
 
-	// done channel for synchronization
-	done := make(chan bool, len(machines))
+	// Get formatter based on output format
+	formatter, err := NewFormatter(opt.OutputFormat)
+	if err != nil {
+		formatter = &TextFormatter{}
+		fmt.Fprintln(os.Stderr, formatter.FormatError(err))
+		return false
+	}
+
+	if err := validateProtocol(opt.Protocol); err != nil {
+		fmt.Fprintln(os.Stderr, formatter.FormatError(err))
+		return false
+	}
+	if err := validateSymlinks(opt.Symlinks); err != nil {
+		fmt.Fprintln(os.Stderr, formatter.FormatError(err))
+		return false
+	}
+	if err := validateTransfer(opt); err != nil {
+		fmt.Fprintln(os.Stderr, formatter.FormatError(err))
+		return false
+	}
+	if err := validateDeploy(opt); err != nil {
+		fmt.Fprintln(os.Stderr, formatter.FormatError(err))
+		return false
+	}
+	hostRate, err := parseRate(opt.LimitRate)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, formatter.FormatError(err))
+		return false
+	}
+	totalRate, err := parseRate(opt.TotalRate)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, formatter.FormatError(err))
+		return false
+	}
+
+	if opt.ForwardAgent && opt.AgentSock == "" {
+		fmt.Fprintln(os.Stderr, formatter.FormatError(
+			fmt.Errorf("agent forwarding needs an SSH agent, set SSH_AUTH_SOCK or --agentsock")))
+		return false
+	}
+
+	// The agent connection stays open for the whole run, so the agent can
+	// sign for every host
+	var sshAgent *common.Agent
+	if opt.UseAgent {
+		sshAgent, err = common.DialAgent(opt.AgentSock)
+		if err != nil {
+			// Continue with key-based auth even if agent fails
+			fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+		} else {
+			defer sshAgent.Close()
+		}
+	}
+	keys := opt.Keys
+	if len(keys) == 0 {
+		keys = defaultKeyFiles()
+	}
+	signers, certErr := common.LoadKeyring(keys)
+	sshAuth := []ssh.AuthMethod{publicKeyAuth(sshAgent, signers)}
 
-	sshAuth := []ssh.AuthMethod{
-		ssh.PublicKeys(common.MakeKeyring(
-			opt.Key,
-			opt.AgentSock,
-			opt.UseAgent)...),
+	hostKeyCallback, learner, err := hostKeyPolicy(opt)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, formatter.FormatError(err))
+		return false
+	}
+	if learner != nil {
+		defer reportLearnedHosts(learner)
+	}
+	passAuth, err := passwordAuth(opt)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, formatter.FormatError(err))
+		return false
+	}
+	if len(signers) == 0 && sshAgent == nil && len(passAuth) == 0 {
+		fmt.Fprintln(os.Stderr, "Warning: No valid SSH authentication methods available")
 	}
+	sshAuth = append(sshAuth, passAuth...)
 	config := &ssh.ClientConfig{
 		User:            opt.User,
 		Auth:            sshAuth,
-		HostKeyCallback: getHostKeyCallback(opt),
+		HostKeyCallback: hostKeyCallback,
 		Timeout:         connectTimeout,
 	}
 
-	// Get formatter based on output format
-	var formatter Formatter = &TextFormatter{}
-	switch opt.OutputFormat {
-	case "json":
-		formatter = &JSONFormatter{}
-	case "yaml":
-		// YAML formatter - simple implementation
-		formatter = &TextFormatter{} // Fall back to text for now
-	case "table":
-		// Table formatter - simple implementation
-		formatter = &TextFormatter{} // Fall back to text for now
-	}
-
-	for _, m := range machines {
-		// we'll write results into the buffered channel of strings
-		switch opt.Op {
-		case "ssh":
-			execFunc = executeCmd
-		case "scp":
-			execFunc = executeCopy
+	switch opt.Op {
+	case "ssh":
+		execFunc = executeCmd
+	case "scp":
+		execFunc = executeCopy
+		if opt.FromRemote {
+			execFunc = executeFetch
 		}
-		go func(hostname string, execFunc execFuncType) {
-			select {
-			case <-ctx.Done():
-				fmt.Println(hostname, ":", ctx.Err())
-				done <- false
-				return
-			default:
-			}
-			res := execFunc(opt, hostname, config)
-			if res.err == nil {
-				if opt.OutputFormat == "json" {
-					fmt.Println(formatter.FormatResult(hostname, res.result, nil))
-				} else {
-					fmt.Print(res.result)
-				}
-				done <- true
-			} else {
-				fmt.Println(res.result, "\n", res.err)
-				done <- false
-			}
-		}(m, execFunc)
+	case "sync":
+		execFunc = executeSync
+	case "rollback":
+		execFunc = executeRollback
 	}
 
-	retval := true
-	for i := 0; i < len(machines); i++ {
+	sshConfig, err := loadSSHConfig(opt.SSHConfig)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, formatter.FormatError(err))
+		return false
+	}
+
+	env := &runEnv{ctx: ctx, config: config, sshConfig: sshConfig, passAuth: passAuth, agent: sshAgent, rate: hostRate,
+		certErr: certErr}
+	defer env.jumps.close()
+
+	// The source is only hashed once, however many hosts check their copy
+	if opt.Verify != "" {
+		env.digest, err = fileSHA256(opt.Src)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, formatter.FormatError(err))
+			return false
+		}
+	}
+	if opt.Relay > 0 {
+		env.relay = newRelayTree(ctx, machines, opt.Relay)
+		execFunc = executeRelay
+	}
+
+	// In stream mode remote output is written live. Text output then only
+	// reports failures; other formats keep stdout for the structured
+	// results and stream to stderr instead.
+	_, isText := formatter.(*TextFormatter)
+	if opt.Stream && opt.Op == "ssh" {
+		var liveOut io.Writer = os.Stdout
+		if !isText {
+			liveOut = os.Stderr
+		}
+		env.stream = newStreamer(machines, liveOut, os.Stderr, opt.Color)
+	}
+
+	size, err := batchSize(opt.Batch, len(machines))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, formatter.FormatError(err))
+		return false
+	}
+	waves := makeWaves(machines, size)
+
+	// Formatters that align output across hosts get every result at the end
+	var (
+		resultsMu sync.Mutex
+		results   []executeResult
+	)
+	batchFmt, collect := formatter.(batchFormatter)
+	if collect {
+		defer func() {
+			resultsMu.Lock()
+			defer resultsMu.Unlock()
+			fmt.Print(batchFmt.FormatResults(results))
+		}()
+	}
+
+	// Progress goes to stderr so it stays out of redirected results. It is
+	// stopped before the deferred batch results are printed
+	transfer := opt.Op == "scp" || opt.Op == "sync"
+	if transfer && (opt.ShowProgress || env.rate > 0 || totalRate > 0) {
+		size, err := transferSize(opt)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, formatter.FormatError(err))
+			return false
+		}
+		var out io.Writer
+		tty := term.IsTerminal(int(os.Stderr.Fd()))
+		interval := 5 * time.Second
+		if tty {
+			interval = 200 * time.Millisecond
+		}
+		if opt.ShowProgress {
+			out = os.Stderr
+		}
+		env.progress = newProgress(machines, size, out, tty, interval, env.rate, newRateLimiter(totalRate))
+		defer env.progress.stop()
+	}
+
+	runHost := func(hostname string) bool {
+		var (
+			res executeResult
+			t   target
+		)
 		select {
 		case <-ctx.Done():
-			// Context was cancelled, drain remaining goroutines
-			go func() {
-				for j := i + 1; j < len(machines); j++ {
-					<-done
+			res = makeExecResult(hostname, "", ctx.Err())
+		default:
+			start := time.Now()
+			var err error
+			t, err = newTarget(opt, env.sshConfig, hostname)
+			if err != nil {
+				res = makeExecResult(hostname, "", err)
+			} else {
+				env.progress.begin(hostname)
+				res = execFunc(opt, t, env)
+				if res.err != nil && ctx.Err() != nil {
+					// Failed because the run was cancelled and its connection closed
+					res.err = ctx.Err()
 				}
-			}()
-			return false
-		case success := <-done:
-			if !success {
-				retval = false
 			}
+			res.duration = time.Since(start)
+		}
+		env.progress.finish(hostname, res.err)
+		if env.relay != nil {
+			env.relay.finish(hostname, t, res)
+		}
+		if env.stream != nil && isText {
+			if res.err != nil {
+				env.stream.message(hostname, formatter.FormatError(res.err))
+			}
+		} else if collect {
+			resultsMu.Lock()
+			results = append(results, res)
+			resultsMu.Unlock()
+		} else {
+			out := formatter.FormatResult(res)
+			env.progress.above(func() { printOutput(out) })
+		}
+		return res.err == nil
+	}
+
+	retval := true
+	remaining := len(machines)
+	for i, wave := range waves {
+		failed, completed := runWave(ctx, wave, opt.Forks, runHost)
+		remaining -= len(wave)
+		if !completed {
+			// The later waves only report their hosts as cancelled
+			retval = false
+			continue
+		}
+		if failed > 0 {
+			retval = false
+		}
+		if exceedsFailThreshold(failed, len(wave), opt.MaxFailPercent) && remaining > 0 {
+			env.progress.above(func() {
+				fmt.Fprintln(os.Stderr, formatter.FormatError(fmt.Errorf(
+					"aborting: %d of %d hosts failed in batch %d, skipping %d remaining hosts",
+					failed, len(wave), i+1, remaining)))
+			})
+			return false
 		}
 	}
 	return retval
@@ -16,89 +16,182 @@ package ops
 
 import (
 	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
 	"strings"
+	homedir "github.com/mitchellh/go-homedir"
 	"github.com/raravena80/ya/common"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
 	"testing"
+	"time"
 )
 
 func TestMakeExecResult(t *testing.T) {
 	result := makeExecResult("testhost", "output", nil)
 
-	if result.result != "testhost:\noutput" {
-		t.Errorf("Expected 'testhost:\\noutput', got '%s'", result.result)
+	if result.host != "testhost" {
+		t.Errorf("Expected host 'testhost', got '%s'", result.host)
+	}
+	if result.stdout != "output" {
+		t.Errorf("Expected stdout 'output', got '%s'", result.stdout)
+	}
+	if result.exitCode != 0 {
+		t.Errorf("Expected exit code 0, got %d", result.exitCode)
 	}
 	if result.err != nil {
 		t.Errorf("Expected nil error, got %v", result.err)
 	}
+	if result.status() != statusOK {
+		t.Errorf("Expected status %q, got %q", statusOK, result.status())
+	}
 }
 
 func TestMakeExecResultWithError(t *testing.T) {
 	testErr := fmt.Errorf("connection closed")
 	result := makeExecResult("testhost", "output", testErr)
 
-	if result.result != "testhost:\noutput" {
-		t.Errorf("Expected 'testhost:\\noutput', got '%s'", result.result)
+	if result.host != "testhost" || result.stdout != "output" {
+		t.Errorf("Expected host/stdout testhost/output, got %s/%s", result.host, result.stdout)
 	}
 	if result.err != testErr {
 		t.Errorf("Expected error %v, got %v", testErr, result.err)
 	}
+	if result.exitCode != -1 {
+		t.Errorf("Expected exit code -1, got %d", result.exitCode)
+	}
+	if result.status() != statusError {
+		t.Errorf("Expected status %q, got %q", statusError, result.status())
+	}
+}
+
+func TestExitStatus(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		code     int
+		signal   string
+	}{
+		{name: "No error", err: nil, code: 0},
+		{name: "Non exit error", err: fmt.Errorf("dial failed"), code: -1},
+		{name: "Wrapped non exit error", err: fmt.Errorf("wrapped: %w", io.EOF), code: -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, signal := exitStatus(tt.err)
+			if code != tt.code || signal != tt.signal {
+				t.Errorf("exitStatus(%v) = %d, %q, want %d, %q", tt.err, code, signal, tt.code, tt.signal)
+			}
+		})
+	}
 }
 
 func TestGetHostKeyCallbackInsecure(t *testing.T) {
 	opt := common.Options{
 		InsecureHost: true,
+		KnownHosts:   "/nonexistent/path/known_hosts",
 	}
 
-	callback := getHostKeyCallback(opt)
-
-	if callback == nil {
-		t.Error("Expected non-nil callback")
+	callback, err := getHostKeyCallback(opt)
+	if err != nil {
+		t.Fatalf("Expected no error in insecure mode, got %v", err)
 	}
 
 	// Test that callback works (should not error in insecure mode)
-	err := callback("testhost", nil, nil)
+	err = callback("testhost", nil, nil)
 	if err != nil {
 		t.Errorf("Expected nil error in insecure mode, got %v", err)
 	}
 }
 
 func TestGetHostKeyCallbackDefault(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	homedir.DisableCache = true
+	defer func() { homedir.DisableCache = false }()
 	opt := common.Options{
 		InsecureHost: false,
 	}
 
-	callback := getHostKeyCallback(opt)
-
-	if callback == nil {
-		t.Error("Expected non-nil callback")
+	// A missing ~/.ssh/known_hosts is an error unless insecure mode is explicit
+	if _, err := getHostKeyCallback(opt); err == nil {
+		t.Error("Expected error for a missing ~/.ssh/known_hosts")
 	}
 
-	// Default mode also uses InsecureIgnoreHostKey but with warning
-	// The callback should still work
-	err := callback("testhost", nil, nil)
+	// The default file is found with ~ expanded
+	if err := os.MkdirAll(filepath.Join(home, ".ssh"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(home, ".ssh", "known_hosts"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	callback, err := getHostKeyCallback(opt)
 	if err != nil {
-		t.Errorf("Expected nil error, got %v", err)
+		t.Fatalf("Expected ~/.ssh/known_hosts to be used, got %v", err)
+	}
+	if err := callback("testhost:22", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 22}, testSigners["rsa"].PublicKey()); err == nil {
+		t.Error("Expected unknown host key to be rejected")
 	}
 }
 
 func TestGetHostKeyCallbackWithKnownHosts(t *testing.T) {
-	// Test with a known hosts path set
-	opt := common.Options{
-		InsecureHost: false,
-		KnownHosts:   "/nonexistent/path/known_hosts",
+	dir := t.TempDir()
+	key := testSigners["rsa"].PublicKey()
+	other := testSigners["ecdsa"].PublicKey()
+	first := filepath.Join(dir, "known_hosts")
+	second := filepath.Join(dir, "known_hosts2")
+	if err := os.WriteFile(first, []byte(knownhosts.Line([]string{"host1"}, key)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(second, []byte(knownhosts.Line([]string{"host2"}, other)+"\n"), 0600); err != nil {
+		t.Fatal(err)
 	}
+	addr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 22}
 
-	callback := getHostKeyCallback(opt)
+	tests := []struct {
+		name       string
+		knownHosts string
+		host       string
+		key        ssh.PublicKey
+		expectErr  bool
+	}{
+		{name: "Known host", knownHosts: first, host: "host1:22", key: key},
+		{name: "Host from second file", knownHosts: first + "," + second, host: "host2:22", key: other},
+		{name: "Changed key", knownHosts: first, host: "host1:22", key: other, expectErr: true},
+		{name: "Unknown host", knownHosts: first, host: "host3:22", key: key, expectErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			callback, err := getHostKeyCallback(common.Options{KnownHosts: tt.knownHosts})
+			if err != nil {
+				t.Fatalf("getHostKeyCallback() error: %v", err)
+			}
+			err = callback(tt.host, addr, tt.key)
+			if (err != nil) != tt.expectErr {
+				t.Errorf("callback() error = %v, expectErr %v", err, tt.expectErr)
+			}
+		})
+	}
 
-	if callback == nil {
-		t.Error("Expected non-nil callback")
+	// Any missing file is an error
+	opt := common.Options{KnownHosts: first + ",/nonexistent/path/known_hosts"}
+	if _, err := getHostKeyCallback(opt); err == nil {
+		t.Error("Expected error for a missing known_hosts file")
 	}
+}
 
-	// Should fall back to insecure mode since file doesn't exist
-	// and return nil
-	err := callback("testhost", nil, nil)
-	if err != nil {
-		t.Errorf("Expected nil error, got %v", err)
+func TestSSHSessionMissingKnownHosts(t *testing.T) {
+	ok := SSHSession(
+		common.SetMachines([]string{"host1"}),
+		common.SetKnownHosts(filepath.Join(t.TempDir(), "missing")),
+		common.SetOutputFormat("json"),
+		common.SetOp("ssh"),
+		common.SetCmd("true"),
+	)
+	if ok {
+		t.Error("Expected failure without a known_hosts file")
 	}
 }
 
@@ -107,29 +200,27 @@ func TestTextFormatter(t *testing.T) {
 
 	tests := []struct {
 		name     string
-		hostname string
-		output   string
+		res      executeResult
 		err      error
 		expected string
 	}{
 		{
 			name:     "Format result without error",
-			hostname: "testhost",
-			output:   "Hello World",
-			err:      nil,
+			res:      executeResult{host: "testhost", stdout: "Hello World"},
 			expected: "testhost:\nHello World",
 		},
 		{
 			name:     "Format result with error",
-			hostname: "testhost",
-			output:   "",
-			err:      fmt.Errorf("connection failed"),
-			expected: "testhost:\n",
+			res:      executeResult{host: "testhost", err: fmt.Errorf("connection failed")},
+			expected: "testhost:\nError: connection failed",
+		},
+		{
+			name:     "Format result with stderr",
+			res:      executeResult{host: "testhost", stdout: "out\n", stderr: "err\n", exitCode: 2},
+			expected: "testhost:\nout\nerr\n",
 		},
 		{
 			name:     "Format error message",
-			hostname: "testhost",
-			output:   "",
 			err:      fmt.Errorf("connection failed"),
 			expected: "Error: connection failed",
 		},
@@ -137,13 +228,13 @@ func TestTextFormatter(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if tt.err != nil && tt.name == "Format error message" {
+			if tt.err != nil {
 				result := f.FormatError(tt.err)
 				if result != tt.expected {
 					t.Errorf("FormatError() = %v, want %v", result, tt.expected)
 				}
 			} else {
-				result := f.FormatResult(tt.hostname, tt.output, tt.err)
+				result := f.FormatResult(tt.res)
 				if result != tt.expected {
 					t.Errorf("FormatResult() = %v, want %v", result, tt.expected)
 				}
@@ -157,44 +248,45 @@ func TestJSONFormatter(t *testing.T) {
 
 	tests := []struct {
 		name     string
-		hostname string
-		output   string
+		res      executeResult
 		err      error
-		contains string
+		contains []string
 	}{
 		{
 			name:     "Format result without error",
-			hostname: "testhost",
-			output:   "Hello World",
-			err:      nil,
-			contains: `"host": "testhost"`,
+			res:      executeResult{host: "testhost", stdout: "Hello World", duration: 1500 * time.Millisecond},
+			contains: []string{`"host":"testhost"`, `"status":"ok"`, `"stdout":"Hello World"`, `"duration_ms":1500`},
+		},
+		{
+			name: "Format result with non-zero exit",
+			res: executeResult{host: "testhost", stderr: "boom\n", exitCode: 2,
+				err: fmt.Errorf("Process exited with status 2")},
+			contains: []string{`"status":"failed"`, `"exit_code":2`, `"stderr":"boom\n"`},
 		},
 		{
 			name:     "Format result with error",
-			hostname: "testhost",
-			output:   "",
-			err:      fmt.Errorf("connection failed"),
-			contains: `"error": "connection failed"`,
+			res:      executeResult{host: "testhost", exitCode: -1, err: fmt.Errorf("connection failed")},
+			contains: []string{`"status":"error"`, `"error":"connection failed"`},
 		},
 		{
 			name:     "Format error message",
-			hostname: "testhost",
-			output:   "",
 			err:      fmt.Errorf("timeout"),
-			contains: `"error": "timeout"`,
+			contains: []string{`"error":"timeout"`},
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			var result string
-			if tt.err != nil && tt.name == "Format error message" {
+			if tt.err != nil {
 				result = f.FormatError(tt.err)
 			} else {
-				result = f.FormatResult(tt.hostname, tt.output, tt.err)
+				result = f.FormatResult(tt.res)
 			}
-			if !strings.Contains(result, tt.contains) {
-				t.Errorf("Format output does not contain %q, got: %s", tt.contains, result)
+			for _, c := range tt.contains {
+				if !strings.Contains(result, c) {
+					t.Errorf("Format output does not contain %q, got: %s", c, result)
+				}
 			}
 		})
 	}
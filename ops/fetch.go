@@ -0,0 +1,343 @@
+// Copyright © 2017 Ricardo Aravena <raravena80@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ops
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/raravena80/ya/common"
+	"golang.org/x/crypto/ssh"
+)
+
+// scpTimes holds the modification and access times of a T record.
+type scpTimes struct {
+	mtime, atime time.Time
+}
+
+// scpDir is a directory being received, whose mode and times are applied
+// once all of its entries have been written.
+type scpDir struct {
+	path  string
+	mode  os.FileMode
+	times *scpTimes
+}
+
+// scpSink receives files from the source side of the scp protocol, as run
+// by `scp -f` on the remote host, acknowledging every record it reads.
+type scpSink struct {
+	r *bufio.Reader
+	w io.Writer
+
+	dirs     []scpDir  // Directories being received, the last one is the current one
+	times    *scpTimes // Times from a T record, for the next file or directory
+	warnings []string  // Warnings sent by the remote scp
+	files    int
+	bytes    int64
+	progress *hostProgress
+}
+
+// newSCPSink returns a sink reading records from r and writing its
+// acknowledgements to w.
+func newSCPSink(r io.Reader, w io.Writer) *scpSink {
+	return &scpSink{r: bufio.NewReader(r), w: w}
+}
+
+// fail sends a fatal error to the remote scp and returns err.
+func (s *scpSink) fail(err error) error {
+	fmt.Fprintf(s.w, "\x02%s\n", err)
+	return err
+}
+
+// receive writes the files and directories sent by the remote scp into
+// root, which is created if needed, until the remote side finishes.
+func (s *scpSink) receive(root string) error {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return err
+	}
+	s.dirs = []scpDir{{path: root}}
+	if err := sendByte(s.w, 0); err != nil {
+		return err
+	}
+	for {
+		kind, err := s.r.ReadByte()
+		if err == io.EOF {
+			if len(s.dirs) != 1 {
+				return errors.New("scp stream ended inside a directory")
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		line, err := s.r.ReadString('\n')
+		if err != nil {
+			return fmt.Errorf("truncated scp record: %w", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+
+		switch kind {
+		case 1:
+			s.warnings = append(s.warnings, line)
+			continue
+		case 2:
+			return fmt.Errorf("remote scp: %s", line)
+		case 'T':
+			err = s.setTimes(line)
+		case 'C':
+			err = s.receiveFile(line)
+		case 'D':
+			err = s.enterDir(line)
+		case 'E':
+			err = s.leaveDir()
+		default:
+			err = fmt.Errorf("unexpected scp record %q", string(kind)+line)
+		}
+		if err != nil {
+			return s.fail(err)
+		}
+		if err := sendByte(s.w, 0); err != nil {
+			return err
+		}
+	}
+}
+
+// setTimes parses a "T<mtime> 0 <atime> 0" record.
+func (s *scpSink) setTimes(line string) error {
+	var mtime, mtimeUsec, atime, atimeUsec int64
+	if _, err := fmt.Sscanf(line, "%d %d %d %d", &mtime, &mtimeUsec, &atime, &atimeUsec); err != nil {
+		return fmt.Errorf("invalid scp times %q", line)
+	}
+	s.times = &scpTimes{mtime: time.Unix(mtime, mtimeUsec*1000), atime: time.Unix(atime, atimeUsec*1000)}
+	return nil
+}
+
+// parseEntry parses the "<mode> <size> <name>" of a C or D record. Names
+// that could escape the current directory are rejected.
+func parseEntry(line string) (os.FileMode, int64, string, error) {
+	fields := strings.SplitN(line, " ", 3)
+	if len(fields) != 3 {
+		return 0, 0, "", fmt.Errorf("invalid scp record %q", line)
+	}
+	mode, err := strconv.ParseUint(fields[0], 8, 32)
+	if err != nil {
+		return 0, 0, "", fmt.Errorf("invalid mode in scp record %q", line)
+	}
+	size, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil || size < 0 {
+		return 0, 0, "", fmt.Errorf("invalid size in scp record %q", line)
+	}
+	name := fields[2]
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return 0, 0, "", fmt.Errorf("invalid file name %q in scp record", name)
+	}
+	return os.FileMode(mode).Perm(), size, name, nil
+}
+
+// takeTimes returns the times of the last T record and clears them.
+func (s *scpSink) takeTimes() *scpTimes {
+	times := s.times
+	s.times = nil
+	return times
+}
+
+// receiveFile handles a C record: it acknowledges the header, then reads
+// the file contents followed by the source's status byte.
+func (s *scpSink) receiveFile(line string) error {
+	mode, size, name, err := parseEntry(line)
+	if err != nil {
+		return err
+	}
+	times := s.takeTimes()
+	s.progress.expect(size)
+	path := filepath.Join(s.dirs[len(s.dirs)-1].path, name)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := sendByte(s.w, 0); err != nil {
+		return err
+	}
+	if _, err := io.CopyN(s.progress.writer(f), s.r, size); err != nil {
+		return fmt.Errorf("failed to receive %s: %w", name, err)
+	}
+	status, err := s.r.ReadByte()
+	if err != nil {
+		return fmt.Errorf("failed to receive %s: %w", name, err)
+	}
+	if status != 0 {
+		msg, _ := s.r.ReadString('\n')
+		return fmt.Errorf("remote scp failed sending %s: %s", name, strings.TrimSpace(msg))
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		return err
+	}
+	if times != nil {
+		if err := os.Chtimes(path, times.atime, times.mtime); err != nil {
+			return err
+		}
+	}
+	s.files++
+	s.bytes += size
+	return nil
+}
+
+// enterDir handles a D record, creating the directory. Its mode is only
+// applied when it is left, so a read-only directory can still be filled.
+func (s *scpSink) enterDir(line string) error {
+	mode, _, name, err := parseEntry(line)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(s.dirs[len(s.dirs)-1].path, name)
+	if err := os.Mkdir(path, 0700); err != nil && !os.IsExist(err) {
+		return err
+	}
+	s.dirs = append(s.dirs, scpDir{path: path, mode: mode, times: s.takeTimes()})
+	return nil
+}
+
+// leaveDir handles an E record, applying the directory's mode and times.
+func (s *scpSink) leaveDir() error {
+	if len(s.dirs) == 1 {
+		return errors.New("unexpected end of directory in scp stream")
+	}
+	dir := s.dirs[len(s.dirs)-1]
+	s.dirs = s.dirs[:len(s.dirs)-1]
+	if err := os.Chmod(dir.path, dir.mode); err != nil {
+		return err
+	}
+	if dir.times != nil {
+		return os.Chtimes(dir.path, dir.times.atime, dir.times.mtime)
+	}
+	return nil
+}
+
+// hostDir returns the name of the local directory the files of a host are
+// received into.
+func hostDir(name string) string {
+	return strings.NewReplacer("/", "_", `\`, "_").Replace(name)
+}
+
+// executeFetch copies opt.Src from the remote host into <opt.Dst>/<host>,
+// over SFTP or scp as selected by opt.Protocol.
+func executeFetch(opt common.Options, t target, env *runEnv) executeResult {
+	// Validate source path for security
+	if err := validatePath(opt.Src); err != nil {
+		return makeExecResult(t.name, "", err)
+	}
+	// Validate destination path for security
+	if err := validatePath(opt.Dst); err != nil {
+		return makeExecResult(t.name, "", err)
+	}
+
+	conn, err := dialHost(opt, t, env)
+	if err != nil {
+		return makeExecResult(t.name, "", err)
+	}
+	defer conn.Close()
+
+	root := filepath.Join(opt.Dst, hostDir(t.name))
+	prog := env.progress.host(t.name)
+	client, err := openSFTP(opt, conn)
+	if err != nil {
+		return makeExecResult(t.name, "", err)
+	}
+	if client != nil {
+		defer client.Close()
+		var (
+			files int
+			bytes int64
+		)
+		err = waitWithTimeout(sftpProcess{client, conn}, commandTimeout(opt), func() error {
+			files, bytes, err = sftpDownload(client, opt, root, prog)
+			return err
+		})
+		return makeExecResult(t.name,
+			fmt.Sprintf("Received %d files (%d bytes) into %s\n", files, bytes, root), err)
+	}
+	return scpDownload(opt, t, conn, root, prog)
+}
+
+// scpDownload copies opt.Src from the host into root by running `scp -f`
+// remotely and receiving its files locally, counting the bytes received in
+// prog.
+func scpDownload(opt common.Options, t target, conn *ssh.Client, root string, prog *hostProgress) executeResult {
+	// The remote scp always follows symlinks
+	if opt.Symlinks == SymlinksLink || opt.Symlinks == SymlinksSkip {
+		return makeExecResult(t.name, "",
+			fmt.Errorf("--symlinks %s is not supported when copying with scp, use --protocol sftp", opt.Symlinks))
+	}
+
+	session, err := conn.NewSession()
+	if err != nil {
+		//go:nocovline // NewSession failure hard to test without mock SSH server
+		return makeExecResult(t.name, "", fmt.Errorf("failed to create SSH session: %w", err))
+	}
+	defer session.Close()
+
+	procWriter, err := session.StdinPipe()
+	if err != nil {
+		//go:nocovline // StdinPipe failure hard to test without mock SSH server
+		return makeExecResult(t.name, "", fmt.Errorf("could not open stdin pipe: %w", err))
+	}
+	defer procWriter.Close()
+	procReader, err := session.StdoutPipe()
+	if err != nil {
+		//go:nocovline // StdoutPipe failure hard to test without mock SSH server
+		return makeExecResult(t.name, "", fmt.Errorf("could not open stdout pipe: %w", err))
+	}
+
+	flags := "-q"
+	if opt.Preserve {
+		flags += "p"
+	}
+	if opt.IsRecursive {
+		flags += "r"
+	}
+	flags += "f"
+	scpCmd := fmt.Sprintf("%s %s %s", DefaultSCPPath, flags, shellQuote(opt.Src))
+	if err := session.Start(scpCmd); err != nil {
+		//go:nocovline // session.Start failure hard to test without mock SSH server
+		return makeExecResult(t.name, "", fmt.Errorf("could not start scp command: %w", err))
+	}
+
+	sink := newSCPSink(procReader, procWriter)
+	sink.progress = prog
+	err = waitWithTimeout(sessionProcess{session, conn}, commandTimeout(opt), func() error {
+		err := sink.receive(root)
+		procWriter.Close()
+		if waitErr := session.Wait(); err == nil {
+			err = waitErr
+		}
+		return err
+	})
+	if err != nil && len(sink.warnings) > 0 {
+		err = fmt.Errorf("%s: %w", strings.Join(sink.warnings, "; "), err)
+	}
+	return makeExecResult(t.name,
+		fmt.Sprintf("Received %d files (%d bytes) into %s\n", sink.files, sink.bytes, root), err)
+}
@@ -0,0 +1,204 @@
+// Copyright © 2017 Ricardo Aravena <raravena80@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ops
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/raravena80/ya/common"
+)
+
+func TestSCPSinkReceive(t *testing.T) {
+	stream := "T1500000000 0 1500000000 0\n" +
+		"D0750 0 logs\n" +
+		"C0640 5 app.log\nhello\x00" +
+		"\x01scp: logs/skipped: Permission denied\n" +
+		"D0700 0 old\n" +
+		"C0600 0 empty.log\n\x00" +
+		"E\n" +
+		"E\n"
+	root := filepath.Join(t.TempDir(), "out", "host1")
+	var acks bytes.Buffer
+	sink := newSCPSink(strings.NewReader(stream), &acks)
+	if err := sink.receive(root); err != nil {
+		t.Fatalf("receive() error: %v", err)
+	}
+
+	// One ack to start, one per record and one per file's contents
+	if want := strings.Repeat("\x00", 1+7+2); acks.String() != want {
+		t.Errorf("acks = %q, want %q", acks.String(), want)
+	}
+	if sink.files != 2 || sink.bytes != 5 {
+		t.Errorf("received %d files and %d bytes, want 2 and 5", sink.files, sink.bytes)
+	}
+	if len(sink.warnings) != 1 || !strings.Contains(sink.warnings[0], "Permission denied") {
+		t.Errorf("warnings = %v, want the remote warning", sink.warnings)
+	}
+
+	data, err := os.ReadFile(filepath.Join(root, "logs", "app.log"))
+	if err != nil || string(data) != "hello" {
+		t.Errorf("app.log = %q, %v, want hello", data, err)
+	}
+	tests := []struct {
+		path string
+		mode os.FileMode
+	}{
+		{path: "logs", mode: 0750},
+		{path: "logs/app.log", mode: 0640},
+		{path: "logs/old", mode: 0700},
+		{path: "logs/old/empty.log", mode: 0600},
+	}
+	for _, tt := range tests {
+		info, err := os.Stat(filepath.Join(root, tt.path))
+		if err != nil {
+			t.Errorf("Stat(%s) error: %v", tt.path, err)
+			continue
+		}
+		if info.Mode().Perm() != tt.mode {
+			t.Errorf("%s mode = %o, want %o", tt.path, info.Mode().Perm(), tt.mode)
+		}
+	}
+	info, err := os.Stat(filepath.Join(root, "logs"))
+	if err == nil && !info.ModTime().Equal(time.Unix(1500000000, 0)) {
+		t.Errorf("logs mtime = %v, want the time of the T record", info.ModTime())
+	}
+}
+
+func TestSCPSinkErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		stream string
+		errMsg string
+	}{
+		{name: "Fatal remote error", stream: "\x02scp: /var/log/x: No such file or directory\n", errMsg: "No such file"},
+		{name: "Path traversal", stream: "C0644 1 ../evil\nx\x00", errMsg: "invalid file name"},
+		{name: "Name with separator", stream: "D0755 0 a/b\n", errMsg: "invalid file name"},
+		{name: "Bad mode", stream: "C07x4 1 file\nx\x00", errMsg: "invalid mode"},
+		{name: "Bad size", stream: "C0644 -1 file\n", errMsg: "invalid size"},
+		{name: "Truncated file", stream: "C0644 10 file\nshort", errMsg: "failed to receive"},
+		{name: "Unbalanced end", stream: "E\n", errMsg: "unexpected end"},
+		{name: "Unterminated directory", stream: "D0755 0 dir\n", errMsg: "inside a directory"},
+		{name: "Unknown record", stream: "X\n", errMsg: "unexpected scp record"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var acks bytes.Buffer
+			err := newSCPSink(strings.NewReader(tt.stream), &acks).receive(t.TempDir())
+			if err == nil || !strings.Contains(err.Error(), tt.errMsg) {
+				t.Errorf("receive() error = %v, want %q", err, tt.errMsg)
+			}
+		})
+	}
+}
+
+func TestHostDir(t *testing.T) {
+	tests := map[string]string{
+		"host1":             "host1",
+		"deploy@host1:2222": "deploy@host1:2222",
+		"[::1]:22":          "[::1]:22",
+		"weird/name\\here":  "weird_name_here",
+	}
+	for name, want := range tests {
+		if got := hostDir(name); got != want {
+			t.Errorf("hostDir(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestExecuteFetch(t *testing.T) {
+	src := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(src, "logs", "nested"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{"logs/a.log": "first\n", "logs/nested/b.log": "second\n", "my app.log": "third\n"}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(src, name), []byte(content), 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+	port := execTestServer()
+
+	tests := []struct {
+		name      string
+		src       string
+		recursive bool
+		want      map[string]string
+		expectErr bool
+	}{
+		{name: "Single file", src: "logs/a.log",
+			want: map[string]string{"a.log": "first\n"}},
+		{name: "Name with spaces", src: "my app.log",
+			want: map[string]string{"my app.log": "third\n"}},
+		{name: "Recursive directory", src: "logs", recursive: true,
+			want: map[string]string{"logs/a.log": "first\n", "logs/nested/b.log": "second\n"}},
+		{name: "Directory without recursive", src: "logs", expectErr: true},
+		{name: "Missing file", src: "missing.log", expectErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := t.TempDir()
+			opt := common.Options{Src: filepath.Join(src, tt.src), Dst: out, IsRecursive: tt.recursive}
+			entry := fmt.Sprintf("127.0.0.1:%d", port)
+			res := executeFetch(opt, testTarget(t, opt, entry), &runEnv{config: execTestConfig()})
+			if tt.expectErr {
+				if res.err == nil {
+					t.Error("Expected an error, got nil")
+				}
+				return
+			}
+			if res.err != nil {
+				t.Fatalf("executeFetch() error: %v", res.err)
+			}
+			for name, content := range tt.want {
+				path := filepath.Join(out, hostDir(entry), name)
+				data, err := os.ReadFile(path)
+				if err != nil || string(data) != content {
+					t.Errorf("%s = %q, %v, want %q", name, data, err, content)
+				}
+				if info, err := os.Stat(path); err == nil && info.Mode().Perm() != 0640 {
+					t.Errorf("%s mode = %o, want 640", name, info.Mode().Perm())
+				}
+			}
+		})
+	}
+}
+
+func TestExecuteFetchPreserve(t *testing.T) {
+	mtime := time.Date(2017, 8, 9, 10, 11, 12, 0, time.UTC)
+	src := filepath.Join(t.TempDir(), "logs")
+	files := map[string]string{"a.log": "first\n", "nested/b.log": "second\n"}
+	writeTree(t, src, files, mtime)
+	entry := fmt.Sprintf("127.0.0.1:%d", execTestServer())
+
+	out := t.TempDir()
+	opt := common.Options{Src: src, Dst: out, IsRecursive: true, Preserve: true, Protocol: ProtocolSCP}
+	res := executeFetch(opt, testTarget(t, opt, entry), &runEnv{config: execTestConfig()})
+	if res.err != nil {
+		t.Fatalf("executeFetch() error: %v", res.err)
+	}
+	checkTree(t, filepath.Join(out, hostDir(entry), "logs"), files, mtime)
+
+	opt.Symlinks = SymlinksLink
+	res = executeFetch(opt, testTarget(t, opt, entry), &runEnv{config: execTestConfig()})
+	if res.err == nil || !strings.Contains(res.err.Error(), "--protocol sftp") {
+		t.Errorf("executeFetch() with --symlinks link over scp error = %v, want a hint to use sftp", res.err)
+	}
+}
@@ -0,0 +1,226 @@
+// Copyright © 2017 Ricardo Aravena <raravena80@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ops
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"go.yaml.in/yaml/v3"
+)
+
+// OutputFormats lists the names accepted by NewFormatter.
+var OutputFormats = []string{"text", "json", "yaml", "table"}
+
+// Formatter defines the interface for output formatting.
+type Formatter interface {
+	FormatResult(res executeResult) string
+	FormatError(err error) string
+}
+
+// batchFormatter is implemented by formatters that need every result before
+// producing any output, such as tables with aligned columns.
+type batchFormatter interface {
+	FormatResults(results []executeResult) string
+}
+
+// NewFormatter returns the Formatter for the named output format.
+// An empty name selects the text formatter.
+func NewFormatter(name string) (Formatter, error) {
+	switch name {
+	case "", "text":
+		return &TextFormatter{}, nil
+	case "json":
+		return &JSONFormatter{}, nil
+	case "yaml":
+		return &YAMLFormatter{}, nil
+	case "table":
+		return &TableFormatter{}, nil
+	}
+	return nil, fmt.Errorf("unknown output format %q (valid formats: %s)",
+		name, strings.Join(OutputFormats, ", "))
+}
+
+// TextFormatter implements plain text output formatting.
+type TextFormatter struct{}
+
+func (f *TextFormatter) FormatResult(res executeResult) string {
+	out := res.host + ":\n" + res.stdout + res.stderr
+	if res.retries > 0 {
+		if !strings.HasSuffix(out, "\n") {
+			out += "\n"
+		}
+		out += retryNote(res.retries)
+	}
+	if res.err != nil {
+		if !strings.HasSuffix(out, "\n") {
+			out += "\n"
+		}
+		out += f.FormatError(res.err)
+	}
+	return out
+}
+
+// retryNote reports how many times a host was retried.
+func retryNote(n int) string {
+	if n == 1 {
+		return "Retried once\n"
+	}
+	return fmt.Sprintf("Retried %d times\n", n)
+}
+
+func (f *TextFormatter) FormatError(err error) string {
+	return fmt.Sprintf("Error: %v", err)
+}
+
+// resultRecord is the serialisable form of an executeResult.
+type resultRecord struct {
+	Host       string `json:"host" yaml:"host"`
+	Status     string `json:"status" yaml:"status"`
+	ExitCode   int    `json:"exit_code" yaml:"exit_code"`
+	Signal     string `json:"signal,omitempty" yaml:"signal,omitempty"`
+	Stdout     string `json:"stdout" yaml:"stdout"`
+	Stderr     string `json:"stderr" yaml:"stderr"`
+	DurationMS int64  `json:"duration_ms" yaml:"duration_ms"`
+	Error      string `json:"error,omitempty" yaml:"error,omitempty"`
+	Retries    int    `json:"retries,omitempty" yaml:"retries,omitempty"`
+
+	Transfer *transferRecord `json:"transfer,omitempty" yaml:"transfer,omitempty"`
+}
+
+// transferRecord is the serialisable form of a transferStats.
+type transferRecord struct {
+	Bytes    int64  `json:"bytes" yaml:"bytes"`
+	Peer     string `json:"peer,omitempty" yaml:"peer,omitempty"` // Empty when ya sent the file, unless a relay failed
+	Path     string `json:"path,omitempty" yaml:"path,omitempty"`
+	SHA256   string `json:"sha256,omitempty" yaml:"sha256,omitempty"`
+	Verified *bool  `json:"verified,omitempty" yaml:"verified,omitempty"`
+}
+
+// newResultRecord converts an executeResult into a resultRecord.
+func newResultRecord(res executeResult) resultRecord {
+	rec := resultRecord{
+		Host:       res.host,
+		Status:     res.status(),
+		ExitCode:   res.exitCode,
+		Signal:     res.signal,
+		Stdout:     res.stdout,
+		Stderr:     res.stderr,
+		DurationMS: res.duration.Milliseconds(),
+		Retries:    res.retries,
+	}
+	if res.err != nil {
+		rec.Error = res.err.Error()
+	}
+	if s := res.transfer; s != nil {
+		rec.Transfer = &transferRecord{Bytes: s.bytes, Peer: s.peer, Path: s.path, SHA256: s.digest}
+		if s.digest != "" {
+			rec.Transfer.Verified = &s.verified
+		}
+	}
+	return rec
+}
+
+// JSONFormatter implements JSON output formatting.
+type JSONFormatter struct{}
+
+func (f *JSONFormatter) FormatResult(res executeResult) string {
+	out, err := json.Marshal(newResultRecord(res))
+	if err != nil {
+		return f.FormatError(err)
+	}
+	return string(out)
+}
+
+func (f *JSONFormatter) FormatError(err error) string {
+	out, _ := json.Marshal(map[string]string{"error": err.Error()})
+	return string(out)
+}
+
+// YAMLFormatter implements YAML output formatting. Each result is emitted
+// as a single-item sequence so the concatenated output of all hosts forms
+// one valid YAML list.
+type YAMLFormatter struct{}
+
+func (f *YAMLFormatter) FormatResult(res executeResult) string {
+	out, err := yaml.Marshal([]resultRecord{newResultRecord(res)})
+	if err != nil {
+		return f.FormatError(err)
+	}
+	return string(out)
+}
+
+func (f *YAMLFormatter) FormatError(err error) string {
+	out, _ := yaml.Marshal([]map[string]string{{"error": err.Error()}})
+	return string(out)
+}
+
+// TableFormatter implements aligned table output formatting with one row
+// per host. Rows are only aligned across hosts when formatted together with
+// FormatResults.
+type TableFormatter struct{}
+
+func (f *TableFormatter) FormatResult(res executeResult) string {
+	return f.FormatResults([]executeResult{res})
+}
+
+// FormatResults renders results as a table sorted by host name.
+func (f *TableFormatter) FormatResults(results []executeResult) string {
+	sorted := make([]executeResult, len(results))
+	copy(sorted, results)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].host < sorted[j].host
+	})
+
+	var buf bytes.Buffer
+	w := tabwriter.NewWriter(&buf, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "HOST\tSTATUS\tEXIT\tDURATION\tOUTPUT")
+	for _, res := range sorted {
+		exit := "-"
+		if res.exitCode >= 0 {
+			exit = strconv.Itoa(res.exitCode)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", res.host, res.status(), exit,
+			res.duration.Round(time.Millisecond), firstLine(res))
+	}
+	w.Flush()
+	return buf.String()
+}
+
+func (f *TableFormatter) FormatError(err error) string {
+	return fmt.Sprintf("Error: %v", err)
+}
+
+// firstLine returns the first non-empty line of a result's output, falling
+// back to stderr and then to the error message.
+func firstLine(res executeResult) string {
+	for _, s := range []string{res.stdout, res.stderr} {
+		for _, line := range strings.Split(s, "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				return strings.ReplaceAll(line, "\t", " ")
+			}
+		}
+	}
+	if res.err != nil {
+		return res.err.Error()
+	}
+	return ""
+}
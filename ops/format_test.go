@@ -0,0 +1,147 @@
+// Copyright © 2017 Ricardo Aravena <raravena80@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ops
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/raravena80/ya/common"
+	"go.yaml.in/yaml/v3"
+)
+
+func TestNewFormatter(t *testing.T) {
+	tests := []struct {
+		name      string
+		format    string
+		expected  Formatter
+		expectErr bool
+	}{
+		{name: "Default is text", format: "", expected: &TextFormatter{}},
+		{name: "Text", format: "text", expected: &TextFormatter{}},
+		{name: "JSON", format: "json", expected: &JSONFormatter{}},
+		{name: "YAML", format: "yaml", expected: &YAMLFormatter{}},
+		{name: "Table", format: "table", expected: &TableFormatter{}},
+		{name: "Unknown", format: "xml", expectErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := NewFormatter(tt.format)
+			if tt.expectErr {
+				if err == nil {
+					t.Errorf("NewFormatter(%q) expected error", tt.format)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NewFormatter(%q) unexpected error: %v", tt.format, err)
+			}
+			if fmt.Sprintf("%T", f) != fmt.Sprintf("%T", tt.expected) {
+				t.Errorf("NewFormatter(%q) = %T, want %T", tt.format, f, tt.expected)
+			}
+		})
+	}
+}
+
+func TestYAMLFormatter(t *testing.T) {
+	f := &YAMLFormatter{}
+	results := []executeResult{
+		{host: "web1", stdout: "line1\nline2\n", duration: 20 * time.Millisecond},
+		{host: "web2", stderr: "denied\n", exitCode: 1, err: fmt.Errorf("Process exited with status 1")},
+	}
+
+	var out string
+	for _, res := range results {
+		out += f.FormatResult(res)
+	}
+
+	var records []resultRecord
+	if err := yaml.Unmarshal([]byte(out), &records); err != nil {
+		t.Fatalf("Concatenated output is not a valid YAML list: %v\n%s", err, out)
+	}
+	if len(records) != 2 {
+		t.Fatalf("Expected 2 records, got %d", len(records))
+	}
+	if records[0].Host != "web1" || records[0].Stdout != "line1\nline2\n" || records[0].DurationMS != 20 {
+		t.Errorf("Unexpected first record: %+v", records[0])
+	}
+	if records[1].Status != statusFailed || records[1].ExitCode != 1 || records[1].Error == "" {
+		t.Errorf("Unexpected second record: %+v", records[1])
+	}
+
+	errOut := f.FormatError(fmt.Errorf("timeout"))
+	if !strings.Contains(errOut, "error: timeout") {
+		t.Errorf("FormatError() = %q, want it to contain %q", errOut, "error: timeout")
+	}
+}
+
+func TestTableFormatter(t *testing.T) {
+	f := &TableFormatter{}
+	out := f.FormatResults([]executeResult{
+		{host: "web-long-name", stdout: "\n  first\nsecond\n", duration: 1500 * time.Millisecond},
+		{host: "db", stderr: "oops\n", exitCode: 3, err: fmt.Errorf("Process exited with status 3")},
+		{host: "cache", exitCode: -1, err: fmt.Errorf("connection refused")},
+	})
+
+	lines := strings.Split(strings.TrimRight(out, "\n"), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("Expected header and 3 rows, got %d lines:\n%s", len(lines), out)
+	}
+	if !strings.HasPrefix(lines[0], "HOST") {
+		t.Errorf("Expected header first, got %q", lines[0])
+	}
+
+	// Rows are sorted by host and the status column is aligned
+	expected := []struct {
+		host, status, exit, output string
+	}{
+		{"cache", "error", "-", "connection refused"},
+		{"db", "failed", "3", "oops"},
+		{"web-long-name", "ok", "0", "first"},
+	}
+	col := strings.Index(lines[0], "STATUS")
+	for i, e := range expected {
+		row := lines[i+1]
+		fields := strings.Fields(row)
+		if fields[0] != e.host || fields[1] != e.status || fields[2] != e.exit {
+			t.Errorf("Row %d = %q, want host %s status %s exit %s", i, row, e.host, e.status, e.exit)
+		}
+		if !strings.HasSuffix(row, e.output) {
+			t.Errorf("Row %d = %q, want output %q", i, row, e.output)
+		}
+		if strings.Index(row, e.status) != col {
+			t.Errorf("Row %d status column not aligned: %q", i, row)
+		}
+	}
+
+	if single := f.FormatResult(executeResult{host: "one"}); !strings.HasPrefix(single, "HOST") {
+		t.Errorf("FormatResult() should include a header, got %q", single)
+	}
+	if errOut := f.FormatError(fmt.Errorf("bad")); errOut != "Error: bad" {
+		t.Errorf("FormatError() = %q, want %q", errOut, "Error: bad")
+	}
+}
+
+func TestSSHSessionUnknownFormat(t *testing.T) {
+	returned := SSHSession(common.SetMachines([]string{"127.0.0.1"}),
+		common.SetOutputFormat("xml"),
+		common.SetInsecureHost(true),
+		common.SetOp("ssh"))
+	if returned {
+		t.Error("Expected unknown output format to fail")
+	}
+}
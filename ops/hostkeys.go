@@ -0,0 +1,310 @@
+// Copyright © 2017 Ricardo Aravena <raravena80@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ops
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	homedir "github.com/mitchellh/go-homedir"
+	"github.com/raravena80/ya/common"
+	"github.com/skeema/knownhosts"
+	"golang.org/x/crypto/ssh"
+)
+
+// knownHostsFiles returns the known_hosts files named in opt.KnownHosts, a
+// comma-separated list, with ~ expanded. It defaults to ~/.ssh/known_hosts.
+func knownHostsFiles(opt common.Options) ([]string, error) {
+	names := opt.KnownHosts
+	if names == "" {
+		names = "~/.ssh/known_hosts"
+	}
+	var files []string
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		file, err := homedir.Expand(name)
+		if err != nil {
+			return nil, fmt.Errorf("invalid known_hosts path %s: %w", name, err)
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// getHostKeyCallback returns the HostKeyCallback for opt. Host keys are
+// verified against the known_hosts files unless insecure mode is explicitly
+// requested; a missing or unreadable known_hosts file is an error.
+func getHostKeyCallback(opt common.Options) (ssh.HostKeyCallback, error) {
+	if opt.InsecureHost {
+		fmt.Fprintln(os.Stderr, "Warning: Using insecure host key verification. This is not recommended for production.")
+		return ssh.InsecureIgnoreHostKey(), nil
+	}
+
+	files, err := knownHostsFiles(opt)
+	if err != nil {
+		return nil, err
+	}
+	callback, err := knownhosts.New(files...)
+	if err != nil {
+		return nil, fmt.Errorf("could not read known_hosts: %w (use --known-hosts to choose the file or --insecure-host to skip host key verification)", err)
+	}
+	return ssh.HostKeyCallback(callback), nil
+}
+
+// hostKeyLearner implements the accept-new host key policy, like OpenSSH's
+// StrictHostKeyChecking=accept-new: keys of hosts missing from known_hosts
+// are trusted and appended to the first known_hosts file, while changed keys
+// are still rejected. It is safe for concurrent use.
+type hostKeyLearner struct {
+	check ssh.HostKeyCallback // Verifies keys against known_hosts as loaded
+	file  string              // known_hosts file new keys are appended to
+
+	mu      sync.Mutex
+	learned map[string]ssh.PublicKey // Keys learned this run, by normalized address
+}
+
+// newHostKeyLearner loads the known_hosts files of opt for the accept-new
+// policy, creating the first one if it does not exist yet.
+func newHostKeyLearner(opt common.Options) (*hostKeyLearner, error) {
+	files, err := knownHostsFiles(opt)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, errors.New("no known_hosts file to add new host keys to")
+	}
+	if err := os.MkdirAll(filepath.Dir(files[0]), 0700); err != nil {
+		return nil, fmt.Errorf("could not create known_hosts: %w", err)
+	}
+	f, err := os.OpenFile(files[0], os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("could not create known_hosts: %w", err)
+	}
+	f.Close()
+
+	check, err := knownhosts.New(files...)
+	if err != nil {
+		return nil, fmt.Errorf("could not read known_hosts: %w", err)
+	}
+	return &hostKeyLearner{
+		check:   ssh.HostKeyCallback(check),
+		file:    files[0],
+		learned: map[string]ssh.PublicKey{},
+	}, nil
+}
+
+// callback is the ssh.HostKeyCallback of the accept-new policy.
+func (l *hostKeyLearner) callback(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	err := l.check(hostname, remote, key)
+	if !knownhosts.IsHostUnknown(err) {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	addr := knownhosts.Normalize(hostname)
+	if known, ok := l.learned[addr]; ok {
+		if bytes.Equal(known.Marshal(), key.Marshal()) {
+			return nil
+		}
+		return fmt.Errorf("host key for %s changed since it was added to %s", addr, l.file)
+	}
+	if err := l.add(hostname, remote, key); err != nil {
+		return err
+	}
+	l.learned[addr] = key
+	return nil
+}
+
+// add appends the key of hostname to the known_hosts file. The file is
+// locked while it is re-read and written, so other ya processes learning
+// keys at the same time neither corrupt it nor add a host twice.
+func (l *hostKeyLearner) add(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	f, err := os.OpenFile(l.file, os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("could not open known_hosts: %w", err)
+	}
+	defer f.Close()
+	if err := lockFile(f); err != nil {
+		return fmt.Errorf("could not lock %s: %w", l.file, err)
+	}
+	defer unlockFile(f)
+
+	// Another process may have added the host since the file was loaded
+	current, err := knownhosts.New(l.file)
+	if err != nil {
+		return fmt.Errorf("could not read known_hosts: %w", err)
+	}
+	if err := current(hostname, remote, key); !knownhosts.IsHostUnknown(err) {
+		return err
+	}
+
+	// Never append to an unterminated last line
+	if info, err := f.Stat(); err == nil && info.Size() > 0 {
+		last := make([]byte, 1)
+		if _, err := f.ReadAt(last, info.Size()-1); err != nil && err != io.EOF {
+			return err
+		}
+		if last[0] != '\n' {
+			if _, err := f.Write([]byte("\n")); err != nil {
+				return err
+			}
+		}
+	}
+	if err := knownhosts.WriteKnownHost(f, hostname, remote, key); err != nil {
+		return fmt.Errorf("could not add host key to %s: %w", l.file, err)
+	}
+	return nil
+}
+
+// hosts returns the addresses whose keys were learned this run, sorted.
+func (l *hostKeyLearner) hosts() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	hosts := make([]string, 0, len(l.learned))
+	for addr := range l.learned {
+		hosts = append(hosts, addr)
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+// hostKeyPolicy returns the HostKeyCallback for opt: insecure, accept-new
+// (with the learner recording new keys) or strict known_hosts checking.
+// Unless insecure, host certificates are checked against the CA keys of
+// opt.HostCAs and the @cert-authority lines of known_hosts.
+func hostKeyPolicy(opt common.Options) (ssh.HostKeyCallback, *hostKeyLearner, error) {
+	if opt.InsecureHost {
+		callback, err := getHostKeyCallback(opt)
+		return callback, nil, err
+	}
+
+	var (
+		callback ssh.HostKeyCallback
+		learner  *hostKeyLearner
+		err      error
+	)
+	if opt.AcceptNewHosts {
+		learner, err = newHostKeyLearner(opt)
+		if err != nil {
+			return nil, nil, err
+		}
+		callback = learner.callback
+	} else {
+		callback, err = getHostKeyCallback(opt)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	cas, err := loadHostCAs(opt.HostCAs)
+	if err != nil {
+		return nil, nil, err
+	}
+	return certHostKeyCallback(cas, callback), learner, nil
+}
+
+// loadHostCAs reads the CA public keys, in authorized_keys format, trusted
+// to sign host certificates for any host.
+func loadHostCAs(files []string) ([]ssh.PublicKey, error) {
+	var cas []ssh.PublicKey
+	for _, name := range files {
+		file, err := homedir.Expand(name)
+		if err != nil {
+			return nil, fmt.Errorf("invalid host CA path %s: %w", name, err)
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("could not read host CA keys: %w", err)
+		}
+		for len(bytes.TrimSpace(data)) > 0 {
+			var key ssh.PublicKey
+			key, _, _, data, err = ssh.ParseAuthorizedKey(data)
+			if err != nil {
+				return nil, fmt.Errorf("could not parse host CA keys in %s: %w", file, err)
+			}
+			cas = append(cas, key)
+		}
+	}
+	return cas, nil
+}
+
+// certHostKeyCallback wraps fallback so that host certificates signed by one
+// of cas are trusted. Certificates from other CAs are left to fallback, which
+// handles @cert-authority lines of known_hosts. Expired certificates and
+// certificates not issued for the host are rejected with a clear error
+// whichever CA signed them; plain host keys go straight to fallback.
+func certHostKeyCallback(cas []ssh.PublicKey, fallback ssh.HostKeyCallback) ssh.HostKeyCallback {
+	checker := &ssh.CertChecker{
+		IsHostAuthority: func(auth ssh.PublicKey, address string) bool {
+			for _, ca := range cas {
+				if bytes.Equal(auth.Marshal(), ca.Marshal()) {
+					return true
+				}
+			}
+			return false
+		},
+	}
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		cert, ok := key.(*ssh.Certificate)
+		if !ok {
+			return fallback(hostname, remote, key)
+		}
+		if err := checkHostCert(hostname, cert, time.Now()); err != nil {
+			return err
+		}
+		if checker.IsHostAuthority(cert.SignatureKey, hostname) {
+			return checker.CheckHostKey(hostname, remote, key)
+		}
+		return fallback(hostname, remote, key)
+	}
+}
+
+// checkHostCert checks that cert is a host certificate valid at now for
+// hostname, given as host:port.
+func checkHostCert(hostname string, cert *ssh.Certificate, now time.Time) error {
+	host, _, err := net.SplitHostPort(hostname)
+	if err != nil {
+		host = hostname
+	}
+	if cert.CertType != ssh.HostCert {
+		return fmt.Errorf("%s presented a user certificate as its host key", host)
+	}
+	if err := common.CheckCertTime(cert, now); err != nil {
+		return fmt.Errorf("host certificate of %s: %w", host, err)
+	}
+	if len(cert.ValidPrincipals) > 0 {
+		for _, p := range cert.ValidPrincipals {
+			if p == host {
+				return nil
+			}
+		}
+		return fmt.Errorf("host certificate of %s is only valid for %s",
+			host, strings.Join(cert.ValidPrincipals, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,373 @@
+// Copyright © 2017 Ricardo Aravena <raravena80@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ops
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/raravena80/ya/common"
+	"github.com/raravena80/ya/test"
+	"github.com/skeema/knownhosts"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/testdata"
+)
+
+func TestHostKeyLearner(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "ssh", "known_hosts")
+	key := testSigners["rsa"].PublicKey()
+	other := testSigners["ecdsa"].PublicKey()
+	addr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2222}
+
+	learner, err := newHostKeyLearner(common.Options{KnownHosts: file})
+	if err != nil {
+		t.Fatalf("newHostKeyLearner() error: %v", err)
+	}
+	if err := learner.callback("host1:2222", addr, key); err != nil {
+		t.Fatalf("Expected new host to be accepted, got %v", err)
+	}
+	if err := learner.callback("host1:2222", addr, key); err != nil {
+		t.Errorf("Expected learned host to be accepted again, got %v", err)
+	}
+	if err := learner.callback("host1:2222", addr, other); err == nil {
+		t.Error("Expected changed key of a learned host to be rejected")
+	}
+	if got := learner.hosts(); !reflect.DeepEqual(got, []string{"[host1]:2222"}) {
+		t.Errorf("hosts() = %v, want [host1]:2222", got)
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(data), "\n"); n != 1 {
+		t.Errorf("Expected one known_hosts line, got %q", data)
+	}
+
+	// A fresh strict callback now trusts the learned key
+	strict, err := getHostKeyCallback(common.Options{KnownHosts: file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := strict("host1:2222", addr, key); err != nil {
+		t.Errorf("Expected learned key in known_hosts, got %v", err)
+	}
+
+	// Keys already in known_hosts are still enforced
+	learner, err = newHostKeyLearner(common.Options{KnownHosts: file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := learner.callback("host1:2222", addr, other); !knownhosts.IsHostKeyChanged(err) {
+		t.Errorf("Expected changed key error, got %v", err)
+	}
+	if len(learner.hosts()) != 0 {
+		t.Errorf("Expected no learned hosts, got %v", learner.hosts())
+	}
+}
+
+func TestHostKeyLearnerConcurrent(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "known_hosts")
+	// An unterminated last line must not be joined with the new entries
+	if err := os.WriteFile(file, []byte("# comment"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	key := testSigners["rsa"].PublicKey()
+	addr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 22}
+
+	// Two learners stand in for two ya processes sharing the file
+	var learners []*hostKeyLearner
+	for i := 0; i < 2; i++ {
+		l, err := newHostKeyLearner(common.Options{KnownHosts: file})
+		if err != nil {
+			t.Fatal(err)
+		}
+		learners = append(learners, l)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 40; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			host := fmt.Sprintf("host%d:22", i%5)
+			if err := learners[i%2].callback(host, addr, key); err != nil {
+				t.Errorf("callback(%s) error: %v", host, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 6 {
+		t.Fatalf("Expected the comment and 5 host lines, got %q", data)
+	}
+	if lines[0] != "# comment" {
+		t.Errorf("Expected the comment line to be kept, got %q", lines[0])
+	}
+	strict, err := getHostKeyCallback(common.Options{KnownHosts: file})
+	if err != nil {
+		t.Fatalf("known_hosts no longer parses: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		if err := strict(fmt.Sprintf("host%d:22", i), addr, key); err != nil {
+			t.Errorf("host%d not in known_hosts: %v", i, err)
+		}
+	}
+}
+
+func TestSSHSessionAcceptNewHosts(t *testing.T) {
+	keyFile := writeTestKey(t)
+	defer os.Remove(keyFile)
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+	machine := fmt.Sprintf("127.0.0.1:%d", execTestServer())
+
+	run := func(acceptNew bool) bool {
+		return SSHSession(
+			common.SetMachines([]string{machine}),
+			common.SetUser("testuser"),
+			common.SetKey(keyFile),
+			common.SetSSHConfig("none"),
+			common.SetKnownHosts(knownHosts),
+			common.SetAcceptNewHosts(acceptNew),
+			common.SetOutputFormat("json"),
+			common.SetOp("ssh"),
+			common.SetCmd("true"),
+		)
+	}
+
+	if run(false) {
+		t.Fatal("Expected strict mode to fail without a known_hosts file")
+	}
+	if !run(true) {
+		t.Fatal("Expected accept-new mode to learn the host key")
+	}
+	if !run(false) {
+		t.Error("Expected strict mode to trust the learned host key")
+	}
+}
+
+// signCert issues a certificate of certType for key, signed by ca.
+func signCert(t *testing.T, ca ssh.Signer, key ssh.PublicKey, certType uint32, principals []string, after, before time.Time) *ssh.Certificate {
+	cert := &ssh.Certificate{
+		Key:             key,
+		KeyId:           "test-cert",
+		CertType:        certType,
+		ValidPrincipals: principals,
+		ValidAfter:      uint64(after.Unix()),
+		ValidBefore:     uint64(before.Unix()),
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestCheckHostCert(t *testing.T) {
+	now := time.Now()
+	ca, key := testSigners["ed25519"], testSigners["ecdsa"].PublicKey()
+	tests := []struct {
+		name    string
+		cert    *ssh.Certificate
+		errPart string
+	}{
+		{name: "Valid certificate",
+			cert: signCert(t, ca, key, ssh.HostCert, []string{"web1"}, now.Add(-time.Hour), now.Add(time.Hour))},
+		{name: "Valid for any host",
+			cert: signCert(t, ca, key, ssh.HostCert, nil, now.Add(-time.Hour), now.Add(time.Hour))},
+		{name: "Expired",
+			cert:    signCert(t, ca, key, ssh.HostCert, []string{"web1"}, now.Add(-2*time.Hour), now.Add(-time.Hour)),
+			errPart: "expired at"},
+		{name: "Not yet valid",
+			cert:    signCert(t, ca, key, ssh.HostCert, []string{"web1"}, now.Add(time.Hour), now.Add(2*time.Hour)),
+			errPart: "not valid before"},
+		{name: "Principal mismatch",
+			cert:    signCert(t, ca, key, ssh.HostCert, []string{"web2", "web3"}, now.Add(-time.Hour), now.Add(time.Hour)),
+			errPart: "only valid for web2, web3"},
+		{name: "User certificate",
+			cert:    signCert(t, ca, key, ssh.UserCert, []string{"web1"}, now.Add(-time.Hour), now.Add(time.Hour)),
+			errPart: "user certificate"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkHostCert("web1:22", tt.cert, now)
+			if tt.errPart == "" {
+				if err != nil {
+					t.Errorf("Unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.errPart) || !strings.Contains(err.Error(), "web1") {
+				t.Errorf("Expected error naming web1 and containing %q, got %v", tt.errPart, err)
+			}
+		})
+	}
+}
+
+func TestLoadHostCAs(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "host_ca.pub")
+	content := string(ssh.MarshalAuthorizedKey(testSigners["ed25519"].PublicKey())) +
+		"\n" + string(ssh.MarshalAuthorizedKey(testSigners["rsa"].PublicKey()))
+	if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cas, err := loadHostCAs([]string{file})
+	if err != nil || len(cas) != 2 {
+		t.Errorf("loadHostCAs() = %d keys, %v, want 2 keys", len(cas), err)
+	}
+
+	bad := filepath.Join(t.TempDir(), "bad.pub")
+	os.WriteFile(bad, []byte("not a key\n"), 0644)
+	if _, err := loadHostCAs([]string{bad}); err == nil {
+		t.Error("Expected error for an invalid CA file")
+	}
+	if _, err := loadHostCAs([]string{filepath.Join(t.TempDir(), "missing")}); err == nil {
+		t.Error("Expected error for a missing CA file")
+	}
+}
+
+func TestSSHCertificates(t *testing.T) {
+	now := time.Now()
+	ca := testSigners["ed25519"]
+	dir := t.TempDir()
+
+	// User key with a certificate next to it
+	keyFile := filepath.Join(dir, "id_rsa")
+	if err := os.WriteFile(keyFile, testdata.PEMBytes["rsa"], 0600); err != nil {
+		t.Fatal(err)
+	}
+	userCert := signCert(t, ca, testSigners["rsa"].PublicKey(), ssh.UserCert, []string{"testuser"},
+		now.Add(-time.Hour), now.Add(time.Hour))
+	if err := os.WriteFile(keyFile+"-cert.pub", ssh.MarshalAuthorizedKey(userCert), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	caFile := filepath.Join(dir, "host_ca.pub")
+	if err := os.WriteFile(caFile, ssh.MarshalAuthorizedKey(ca.PublicKey()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	knownHosts := filepath.Join(dir, "known_hosts")
+	if err := os.WriteFile(knownHosts, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	hostServer := func(principals []string, before time.Time) int {
+		hostCert := signCert(t, ca, testSigners["ecdsa"].PublicKey(), ssh.HostCert, principals,
+			now.Add(-time.Hour), before)
+		hostKey, err := ssh.NewCertSigner(hostCert, testSigners["ecdsa"])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return test.StartSSHServerForCerts(hostKey, ca.PublicKey())
+	}
+
+	tests := []struct {
+		name    string
+		port    int
+		errPart string
+	}{
+		{name: "Valid certificates", port: hostServer([]string{"127.0.0.1"}, now.Add(time.Hour))},
+		{name: "Expired host certificate", port: hostServer([]string{"127.0.0.1"}, now.Add(-time.Minute)),
+			errPart: "expired at"},
+		{name: "Wrong host principal", port: hostServer([]string{"other.example.com"}, now.Add(time.Hour)),
+			errPart: "only valid for other.example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opt := common.Options{
+				User:       "testuser",
+				Keys:       []string{keyFile},
+				KnownHosts: knownHosts,
+				HostCAs:    []string{caFile},
+				Cmd:        "echo certified",
+			}
+			callback, _, err := hostKeyPolicy(opt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			signers, err := common.LoadKeyring([]string{keyFile})
+			if err != nil {
+				t.Fatal(err)
+			}
+			config := &ssh.ClientConfig{
+				User:            "testuser",
+				Auth:            []ssh.AuthMethod{ssh.PublicKeys(signers...)},
+				HostKeyCallback: callback,
+			}
+			entry := fmt.Sprintf("127.0.0.1:%d", tt.port)
+			res := executeCmd(opt, testTarget(t, opt, entry), &runEnv{config: config})
+			if tt.errPart == "" {
+				if res.err != nil || res.stdout != "certified\n" {
+					t.Errorf("executeCmd() = %q, %v, want certified", res.stdout, res.err)
+				}
+				return
+			}
+			if res.err == nil || !strings.Contains(res.err.Error(), tt.errPart) {
+				t.Errorf("Expected error containing %q, got %v", tt.errPart, res.err)
+			}
+		})
+	}
+}
+
+func TestSSHExpiredUserCertificate(t *testing.T) {
+	now := time.Now()
+	ca := testSigners["ed25519"]
+	keyFile := filepath.Join(t.TempDir(), "id_rsa")
+	if err := os.WriteFile(keyFile, testdata.PEMBytes["rsa"], 0600); err != nil {
+		t.Fatal(err)
+	}
+	userCert := signCert(t, ca, testSigners["rsa"].PublicKey(), ssh.UserCert, []string{"testuser"},
+		now.Add(-time.Hour), now.Add(-time.Minute))
+	if err := os.WriteFile(keyFile+"-cert.pub", ssh.MarshalAuthorizedKey(userCert), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// The server only accepts certificates, so the plain key is refused
+	entry := fmt.Sprintf("127.0.0.1:%d", test.StartSSHServerForCerts(testSigners["ecdsa"], ca.PublicKey()))
+
+	signers, certErr := common.LoadKeyring([]string{keyFile})
+	tests := []struct {
+		name string
+		opt  common.Options
+		env  *runEnv
+	}{
+		{name: "Global key",
+			opt: common.Options{User: "testuser", Cmd: "true"},
+			env: &runEnv{certErr: certErr, config: &ssh.ClientConfig{User: "testuser",
+				Auth: []ssh.AuthMethod{ssh.PublicKeys(signers...)}, HostKeyCallback: ssh.InsecureIgnoreHostKey()}}},
+		{name: "Per-host key",
+			opt: common.Options{User: "testuser", Cmd: "true", Hosts: map[string]common.Host{entry: {Key: keyFile}}},
+			env: &runEnv{config: &ssh.ClientConfig{User: "testuser", HostKeyCallback: ssh.InsecureIgnoreHostKey()}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := executeCmd(tt.opt, testTarget(t, tt.opt, entry), tt.env)
+			if res.err == nil || !strings.Contains(res.err.Error(), `user certificate "test-cert" expired at`) {
+				t.Errorf("executeCmd() error = %v, want the certificate expiry", res.err)
+			}
+		})
+	}
+}
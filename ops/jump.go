@@ -0,0 +1,185 @@
+// Copyright © 2017 Ricardo Aravena <raravena80@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ops
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// jumpDialer connects to a jump host, through via unless it is nil.
+type jumpDialer func(via *ssh.Client, hop string) (*ssh.Client, error)
+
+// jumpConn is a connection to the last jump host of a chain. Goroutines
+// asking for it while it is being dialed wait for that dial.
+type jumpConn struct {
+	done   chan struct{} // Closed once dialed
+	client *ssh.Client
+	err    error
+}
+
+// failed reports whether the connection was dialed and failed.
+func (jc *jumpConn) failed() bool {
+	select {
+	case <-jc.done:
+		return jc.err != nil
+	default:
+		return false
+	}
+}
+
+// jumpPool shares jump host connections between the goroutines of a run.
+// Each chain of jump hosts, and each prefix of it, is dialed only once; an
+// *ssh.Client is safe for concurrent use, so every host reached through the
+// same chain tunnels through the same connection. A chain that failed, or
+// whose connection dropped, is dialed again when next needed, so retries can
+// get through once a jump host recovers.
+type jumpPool struct {
+	mu    sync.Mutex
+	conns map[string]*jumpConn
+	order []*jumpConn // In dial order, so close can tear down the last hops first
+}
+
+// splitJumps splits a comma-separated jump host chain into its hops.
+func splitJumps(chain string) []string {
+	var hops []string
+	for _, hop := range strings.Split(chain, ",") {
+		if hop = strings.TrimSpace(hop); hop != "" {
+			hops = append(hops, hop)
+		}
+	}
+	return hops
+}
+
+// client returns the connection to the last of hops, dialing the chain on
+// first use and after a failure.
+func (p *jumpPool) client(hops []string, dial jumpDialer) (*ssh.Client, error) {
+	if len(hops) == 0 {
+		return nil, nil
+	}
+	key := strings.Join(hops, ",")
+	p.mu.Lock()
+	if p.conns == nil {
+		p.conns = map[string]*jumpConn{}
+	}
+	jc, ok := p.conns[key]
+	if ok && jc.failed() {
+		ok = false
+	}
+	if !ok {
+		jc = &jumpConn{done: make(chan struct{})}
+		p.conns[key] = jc
+	}
+	p.mu.Unlock()
+
+	if ok {
+		<-jc.done
+		return jc.client, jc.err
+	}
+	defer close(jc.done)
+	via, err := p.client(hops[:len(hops)-1], dial)
+	if err != nil {
+		jc.err = err
+		return nil, err
+	}
+	hop := hops[len(hops)-1]
+	jc.client, jc.err = dial(via, hop)
+	if jc.err != nil {
+		jc.err = fmt.Errorf("failed to connect to jump host %s: %w", hop, jc.err)
+		return nil, jc.err
+	}
+	p.mu.Lock()
+	p.order = append(p.order, jc)
+	p.mu.Unlock()
+	if jc.client != nil {
+		go p.forget(key, jc)
+	}
+	return jc.client, nil
+}
+
+// forget drops jc from the pool once its connection closes, so the chain is
+// dialed again when next needed.
+func (p *jumpPool) forget(key string, jc *jumpConn) {
+	jc.client.Wait()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conns[key] == jc {
+		delete(p.conns, key)
+	}
+}
+
+// close closes every jump host connection, innermost hops first.
+func (p *jumpPool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i := len(p.order) - 1; i >= 0; i-- {
+		p.order[i].client.Close()
+	}
+	p.order = nil
+	p.conns = nil
+}
+
+// dialVia opens an SSH client to addr, tunnelled through via when it is not
+// nil. Closing the returned client leaves via open. Cancelling ctx, which
+// may be nil, abandons the dial. Tunnelled connections are also given
+// config.Timeout to connect, handshake and authenticate; direct ones only
+// to connect, like ssh.Dial.
+func dialVia(ctx context.Context, via *ssh.Client, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	var (
+		netConn net.Conn
+		err     error
+	)
+	handshake := ctx
+	if via == nil {
+		d := net.Dialer{Timeout: config.Timeout}
+		netConn, err = d.DialContext(ctx, "tcp", addr)
+	} else {
+		if config.Timeout > 0 {
+			var cancel context.CancelFunc
+			handshake, cancel = context.WithTimeout(ctx, config.Timeout)
+			defer cancel()
+		}
+		netConn, err = via.DialContext(handshake, "tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Tunnelled connections have no deadlines, so a stalled or cancelled
+	// handshake is cut short by closing the connection
+	stop := context.AfterFunc(handshake, func() { netConn.Close() })
+	c, chans, reqs, err := ssh.NewClientConn(netConn, addr, config)
+	if !stop() {
+		if err == nil {
+			c.Close()
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("ssh: handshake with %s timed out after %v", addr, config.Timeout)
+	}
+	if err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	return ssh.NewClient(c, chans, reqs), nil
+}
@@ -0,0 +1,205 @@
+// Copyright © 2017 Ricardo Aravena <raravena80@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ops
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/raravena80/ya/common"
+	"github.com/raravena80/ya/test"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSplitJumps(t *testing.T) {
+	tests := []struct {
+		chain string
+		hops  []string
+	}{
+		{chain: "", hops: nil},
+		{chain: "bastion", hops: []string{"bastion"}},
+		{chain: "me@outer:2200, inner ,", hops: []string{"me@outer:2200", "inner"}},
+	}
+	for _, tt := range tests {
+		if got := splitJumps(tt.chain); !reflect.DeepEqual(got, tt.hops) {
+			t.Errorf("splitJumps(%q) = %q, want %q", tt.chain, got, tt.hops)
+		}
+	}
+}
+
+func TestJumpPoolDialsOnce(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		dials []string
+	)
+	dialErr := errors.New("unreachable")
+	dial := func(via *ssh.Client, hop string) (*ssh.Client, error) {
+		mu.Lock()
+		dials = append(dials, hop)
+		mu.Unlock()
+		if hop == "down" {
+			return nil, dialErr
+		}
+		return nil, nil
+	}
+
+	var pool jumpPool
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			pool.client([]string{"outer", "inner"}, dial)
+		}()
+	}
+	wg.Wait()
+	if want := []string{"outer", "inner"}; !reflect.DeepEqual(dials, want) {
+		t.Errorf("Dialed %v, want each hop once: %v", dials, want)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := pool.client([]string{"outer", "down"}, dial); !errors.Is(err, dialErr) {
+			t.Errorf("Expected jump host error, got %v", err)
+		}
+	}
+	if want := []string{"outer", "inner", "down", "down"}; !reflect.DeepEqual(dials, want) {
+		t.Errorf("Dialed %v, want a failed hop dialed again: %v", dials, want)
+	}
+}
+
+func TestDialViaTimeout(t *testing.T) {
+	// A host that accepts connections but never sends its SSH banner
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	via, err := ssh.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", execTestServer()), execTestConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer via.Close()
+	config := execTestConfig()
+	config.Timeout = 200 * time.Millisecond
+	start := time.Now()
+	if _, err := dialVia(context.Background(), via, l.Addr().String(), config); err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("dialVia() error = %v, want a timeout", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("dialVia() took %v, want it bounded by the timeout", d)
+	}
+}
+
+func TestSSHSessionJump(t *testing.T) {
+	keyFile := writeTestKey(t)
+	defer os.Remove(keyFile)
+	port := execTestServer()
+	jumpPort, jumpConns := test.StartSSHServerForJump(testPublicKeys)
+
+	marker := filepath.Join(t.TempDir(), "marker")
+	machines := []string{
+		fmt.Sprintf("127.0.0.1:%d", port),
+		fmt.Sprintf("one@127.0.0.1:%d", port),
+		fmt.Sprintf("two@127.0.0.1:%d", port),
+	}
+	ok := SSHSession(
+		common.SetMachines(machines),
+		common.SetJump(fmt.Sprintf("testuser@127.0.0.1:%d", jumpPort)),
+		common.SetUser("testuser"),
+		common.SetKey(keyFile),
+		common.SetSSHConfig("none"),
+		common.SetInsecureHost(true),
+		common.SetOutputFormat("json"),
+		common.SetOp("ssh"),
+		common.SetCmd("echo x >> "+marker),
+	)
+	if !ok {
+		t.Fatal("Expected commands through the jump host to succeed")
+	}
+	if n := jumpConns(); n != 1 {
+		t.Errorf("Expected 1 connection to the jump host, got %d", n)
+	}
+	if data, _ := os.ReadFile(marker); len(data) != 2*len(machines) {
+		t.Errorf("Expected every host to run, marker has %q", data)
+	}
+
+	// Copies go through the jump host too
+	src := filepath.Join(t.TempDir(), "payload.txt")
+	if err := os.WriteFile(src, []byte("payload"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dstDir := t.TempDir()
+	ok = SSHSession(
+		common.SetMachines(machines[:1]),
+		common.SetJump(fmt.Sprintf("testuser@127.0.0.1:%d", jumpPort)),
+		common.SetUser("testuser"),
+		common.SetKey(keyFile),
+		common.SetSSHConfig("none"),
+		common.SetInsecureHost(true),
+		common.SetOutputFormat("json"),
+		common.SetOp("scp"),
+		common.SetSource(src),
+		common.SetDestination(filepath.Join(dstDir, "payload.txt")),
+	)
+	if !ok {
+		t.Fatal("Expected copy through the jump host to succeed")
+	}
+	if n := jumpConns(); n != 2 {
+		t.Errorf("Expected 2 connections to the jump host after two runs, got %d", n)
+	}
+	data, err := os.ReadFile(filepath.Join(dstDir, "payload.txt"))
+	if err != nil || string(data) != "payload" {
+		t.Errorf("Copied file through jump host = %q, %v, want payload", data, err)
+	}
+}
+
+func TestSSHSessionJumpFailure(t *testing.T) {
+	keyFile := writeTestKey(t)
+	defer os.Remove(keyFile)
+
+	ok := SSHSession(
+		common.SetMachines([]string{fmt.Sprintf("127.0.0.1:%d", execTestServer())}),
+		common.SetJump("127.0.0.1:1"),
+		common.SetUser("testuser"),
+		common.SetKey(keyFile),
+		common.SetSSHConfig("none"),
+		common.SetInsecureHost(true),
+		common.SetOutputFormat("json"),
+		common.SetOp("ssh"),
+		common.SetCmd("true"),
+	)
+	if ok {
+		t.Error("Expected failure with an unreachable jump host")
+	}
+}
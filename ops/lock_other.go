@@ -0,0 +1,30 @@
+// Copyright © 2017 Ricardo Aravena <raravena80@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !unix || aix || solaris
+
+package ops
+
+import "os"
+
+// lockFile is a no-op where flock(2) is not available; writers
+// within a single ya process are still serialised by their callers.
+func lockFile(f *os.File) error {
+	return nil
+}
+
+// unlockFile is a no-op where flock(2) is not available.
+func unlockFile(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,370 @@
+// Copyright © 2017 Ricardo Aravena <raravena80@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ops
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/raravena80/ya/common"
+)
+
+// maxProgressBars is the most hosts a terminal shows bars for at once; the
+// other running hosts are only counted.
+const maxProgressBars = 20
+
+// Progress states of a host.
+const (
+	hostWaiting int32 = iota
+	hostRunning
+	hostFinished
+)
+
+// hostProgress counts the bytes transferred to or from one host, and paces
+// them to the rate limits of the run. A nil hostProgress neither counts nor
+// limits anything, so transfers can use it unconditionally.
+type hostProgress struct {
+	name     string
+	total    atomic.Int64 // Bytes expected, may grow as files are discovered
+	done     atomic.Int64
+	state    atomic.Int32
+	limiters []*rateLimiter // The host's own limit and the one shared by all hosts
+}
+
+// expect adds n bytes to the total expected from the host.
+func (h *hostProgress) expect(n int64) {
+	if h != nil {
+		h.total.Add(n)
+	}
+}
+
+// add counts n bytes as transferred without writing them, such as the
+// bytes an earlier attempt already sent.
+func (h *hostProgress) add(n int64) {
+	if h != nil {
+		h.done.Add(n)
+	}
+}
+
+// restart forgets the bytes counted so far, for another attempt.
+func (h *hostProgress) restart() {
+	if h != nil {
+		h.done.Store(0)
+	}
+}
+
+// writer returns w, counting the bytes written to it and pacing them to
+// the host's rate limits.
+func (h *hostProgress) writer(w io.Writer) io.Writer {
+	if h == nil {
+		return w
+	}
+	return limitWriter(&countingWriter{w: w, h: h}, h.limiters...)
+}
+
+// countingWriter adds the bytes written through it to a host's progress.
+type countingWriter struct {
+	w io.Writer
+	h *hostProgress
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.h.done.Add(int64(n))
+	return n, err
+}
+
+// progress tracks the transfers of a run and, when shown, how far they have
+// got. On a terminal every running host has a bar that is redrawn in place;
+// otherwise a line per running host is written periodically. Both are
+// followed by the aggregate throughput and the estimated time left.
+// Everything else written to the terminal while bars are shown has to go
+// through above.
+type progress struct {
+	w        io.Writer // Nil when progress is not shown
+	tty      bool
+	interval time.Duration
+	width    int // Longest host name, to align the bars
+	hosts    []*hostProgress
+	byName   map[string]*hostProgress
+	start    time.Time
+
+	mu    sync.Mutex
+	drawn int // Lines drawn by the last redraw on a terminal
+
+	quit chan struct{}
+	done chan struct{}
+}
+
+// newProgress creates the progress of hosts, each of which is expected to
+// transfer size bytes until told otherwise, and starts reporting it to w
+// every interval unless w is nil. Every host's transfers are limited to
+// hostRate bytes per second, if positive, and to total together with those
+// of the other hosts.
+func newProgress(hosts []string, size int64, w io.Writer, tty bool, interval time.Duration, hostRate int64, total *rateLimiter) *progress {
+	p := &progress{
+		w:        w,
+		tty:      tty,
+		interval: interval,
+		byName:   make(map[string]*hostProgress, len(hosts)),
+		start:    time.Now(),
+		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	for _, name := range hosts {
+		if _, ok := p.byName[name]; ok {
+			continue
+		}
+		h := &hostProgress{name: name, limiters: []*rateLimiter{newRateLimiter(hostRate), total}}
+		h.total.Store(size)
+		p.hosts = append(p.hosts, h)
+		p.byName[name] = h
+		if len(name) > p.width {
+			p.width = len(name)
+		}
+	}
+	if w != nil {
+		go p.run()
+	}
+	return p
+}
+
+// transferSize returns the bytes a copy of opt.Src to a host sends, or 0
+// when that is only known once the host is reached.
+func transferSize(opt common.Options) (int64, error) {
+	if opt.Op != "scp" || opt.FromRemote {
+		return 0, nil
+	}
+	info, err := os.Stat(opt.Src)
+	if err != nil {
+		return 0, err
+	}
+	if !info.IsDir() {
+		return info.Size(), nil
+	}
+	var size int64
+	skip := func(p, rel string, info fs.FileInfo) error { return nil }
+	err = walkTree(localFS{}, opt.Src, info, opt.Symlinks, treeVisitor{
+		enterDir: skip,
+		leaveDir: skip,
+		file: func(p, rel string, info fs.FileInfo) error {
+			size += info.Size()
+			return nil
+		},
+		symlink: func(p, rel, target string, info fs.FileInfo) error { return nil },
+	})
+	return size, err
+}
+
+// host returns the progress of the host name, nil without progress.
+func (p *progress) host(name string) *hostProgress {
+	if p == nil {
+		return nil
+	}
+	return p.byName[name]
+}
+
+// begin marks the host name as running.
+func (p *progress) begin(name string) {
+	if h := p.host(name); h != nil {
+		h.state.Store(hostRunning)
+	}
+}
+
+// finish marks the host name as finished. A failed host no longer expects
+// the bytes it did not get, while a successful one has got them all even
+// if they were not counted, such as when a peer sent them.
+func (p *progress) finish(name string, err error) {
+	h := p.host(name)
+	if h == nil {
+		return
+	}
+	if err != nil {
+		h.total.Store(h.done.Load())
+	} else if h.done.Load() < h.total.Load() {
+		h.done.Store(h.total.Load())
+	} else {
+		h.total.Store(h.done.Load())
+	}
+	h.state.Store(hostFinished)
+}
+
+// above calls print, which writes to the terminal, with the bars cleared
+// so they are not garbled and redraws them afterwards.
+func (p *progress) above(print func()) {
+	if p == nil || p.w == nil {
+		print()
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.clear()
+	print()
+	if p.tty {
+		p.redraw()
+	}
+}
+
+// stop stops reporting and writes the final totals.
+func (p *progress) stop() {
+	if p == nil || p.w == nil {
+		return
+	}
+	close(p.quit)
+	<-p.done
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.clear()
+	fmt.Fprintln(p.w, p.summary())
+}
+
+func (p *progress) run() {
+	defer close(p.done)
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.quit:
+			return
+		case <-ticker.C:
+			p.mu.Lock()
+			if p.tty {
+				p.redraw()
+			} else {
+				p.report()
+			}
+			p.mu.Unlock()
+		}
+	}
+}
+
+// clear erases the bars from the terminal.
+func (p *progress) clear() {
+	if p.drawn > 0 {
+		fmt.Fprintf(p.w, "\x1b[%dA\x1b[J", p.drawn)
+		p.drawn = 0
+	}
+}
+
+// redraw draws the bars of the running hosts over the previous ones.
+func (p *progress) redraw() {
+	var buf bytes.Buffer
+	if p.drawn > 0 {
+		fmt.Fprintf(&buf, "\x1b[%dA", p.drawn)
+	}
+	lines := 0
+	hidden := 0
+	for _, h := range p.running() {
+		if lines == maxProgressBars {
+			hidden++
+			continue
+		}
+		done, total := h.done.Load(), h.total.Load()
+		fmt.Fprintf(&buf, "\r\x1b[2K%-*s %s %3d%% %s/%s\n", p.width, h.name,
+			progressBar(done, total, 30), percent(done, total), formatBytes(done), formatBytes(total))
+		lines++
+	}
+	if hidden > 0 {
+		fmt.Fprintf(&buf, "\r\x1b[2K... and %d more hosts\n", hidden)
+		lines++
+	}
+	fmt.Fprintf(&buf, "\r\x1b[2K%s\n\x1b[J", p.summary())
+	p.w.Write(buf.Bytes())
+	p.drawn = lines + 1
+}
+
+// report writes a line for every running host and the totals.
+func (p *progress) report() {
+	var buf bytes.Buffer
+	for _, h := range p.running() {
+		done, total := h.done.Load(), h.total.Load()
+		fmt.Fprintf(&buf, "%s: %d%% (%s of %s)\n", h.name, percent(done, total), formatBytes(done), formatBytes(total))
+	}
+	fmt.Fprintln(&buf, p.summary())
+	p.w.Write(buf.Bytes())
+}
+
+// running returns the hosts that are transferring.
+func (p *progress) running() []*hostProgress {
+	var hosts []*hostProgress
+	for _, h := range p.hosts {
+		if h.state.Load() == hostRunning {
+			hosts = append(hosts, h)
+		}
+	}
+	return hosts
+}
+
+// summary describes the transfers of all hosts on one line.
+func (p *progress) summary() string {
+	var done, total int64
+	finished := 0
+	for _, h := range p.hosts {
+		done += h.done.Load()
+		total += h.total.Load()
+		if h.state.Load() == hostFinished {
+			finished++
+		}
+	}
+	elapsed := time.Since(p.start).Seconds()
+	var rate float64
+	if elapsed > 0 {
+		rate = float64(done) / elapsed
+	}
+	eta := "-"
+	if rate > 0 {
+		eta = (time.Duration(float64(max(total-done, 0))/rate) * time.Second).String()
+	}
+	return fmt.Sprintf("Total: %d/%d hosts, %d%% (%s of %s), %s/s, ETA %s", finished, len(p.hosts),
+		percent(done, total), formatBytes(done), formatBytes(total), formatBytes(int64(rate)), eta)
+}
+
+// percent returns done as a percentage of total, capped at 100.
+func percent(done, total int64) int {
+	switch {
+	case total <= 0:
+		return 0
+	case done >= total:
+		return 100
+	}
+	return int(done * 100 / total)
+}
+
+// progressBar draws a bar of width characters filled by done out of total.
+func progressBar(done, total int64, width int) string {
+	filled := percent(done, total) * width / 100
+	return "[" + strings.Repeat("=", filled) + strings.Repeat(" ", width-filled) + "]"
+}
+
+// formatBytes formats n bytes with a binary unit.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit && exp < 5; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,250 @@
+// Copyright © 2017 Ricardo Aravena <raravena80@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ops
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/raravena80/ya/common"
+)
+
+func TestHostProgressWriter(t *testing.T) {
+	var buf bytes.Buffer
+	var nilProgress *hostProgress
+	if w := nilProgress.writer(&buf); w != &buf {
+		t.Error("writer() of a nil progress should return the writer itself")
+	}
+	nilProgress.expect(10)
+
+	h := &hostProgress{name: "host1"}
+	h.expect(8)
+	h.expect(2)
+	w := h.writer(&buf)
+	fmt.Fprint(w, "hello")
+	fmt.Fprint(w, "world")
+	if buf.String() != "helloworld" || h.done.Load() != 10 || h.total.Load() != 10 {
+		t.Errorf("wrote %q, counted %d of %d, want 10 of 10", buf.String(), h.done.Load(), h.total.Load())
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	tests := map[int64]string{
+		0:                         "0 B",
+		1023:                      "1023 B",
+		1024:                      "1.0 KiB",
+		1536:                      "1.5 KiB",
+		10 * 1024 * 1024:          "10.0 MiB",
+		3 << 30:                   "3.0 GiB",
+		1<<62 + 1<<61:             "6.0 EiB",
+		5*1024*1024*1024*1024 + 1: "5.0 TiB",
+	}
+	for n, want := range tests {
+		if got := formatBytes(n); got != want {
+			t.Errorf("formatBytes(%d) = %q, want %q", n, got, want)
+		}
+	}
+}
+
+func TestPercent(t *testing.T) {
+	tests := []struct {
+		done, total int64
+		want        int
+	}{
+		{0, 0, 0},
+		{5, 0, 0},
+		{0, 10, 0},
+		{5, 10, 50},
+		{10, 10, 100},
+		{12, 10, 100},
+	}
+	for _, tt := range tests {
+		if got := percent(tt.done, tt.total); got != tt.want {
+			t.Errorf("percent(%d, %d) = %d, want %d", tt.done, tt.total, got, tt.want)
+		}
+	}
+	if got := progressBar(5, 10, 10); got != "[=====     ]" {
+		t.Errorf("progressBar() = %q", got)
+	}
+}
+
+func TestProgressReport(t *testing.T) {
+	var buf bytes.Buffer
+	p := newProgress([]string{"host1", "host2", "host3", "host1"}, 100, &buf, false, time.Hour, 0, nil)
+	if len(p.hosts) != 3 {
+		t.Fatalf("newProgress() tracks %d hosts, want 3", len(p.hosts))
+	}
+	p.begin("host1")
+	p.begin("host2")
+	p.host("host1").done.Store(50)
+	p.host("host2").done.Store(30)
+	p.finish("host2", fmt.Errorf("failed"))
+	p.begin("unknown")
+
+	p.mu.Lock()
+	p.report()
+	p.mu.Unlock()
+	out := buf.String()
+	for _, want := range []string{"host1: 50% (50 B of 100 B)\n", "Total: 1/3 hosts, 34% (80 B of 230 B)"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("report() = %q, want it to contain %q", out, want)
+		}
+	}
+	if strings.Contains(out, "host2:") || strings.Contains(out, "host3:") {
+		t.Errorf("report() = %q, only running hosts should be listed", out)
+	}
+
+	// A successful host got everything, even bytes it did not count
+	p.finish("host1", nil)
+	p.finish("host3", nil)
+	buf.Reset()
+	p.stop()
+	if want := "Total: 3/3 hosts, 100% (230 B of 230 B)"; !strings.HasPrefix(buf.String(), want) {
+		t.Errorf("stop() = %q, want it to start with %q", buf.String(), want)
+	}
+}
+
+func TestProgressRedraw(t *testing.T) {
+	var buf bytes.Buffer
+	var hosts []string
+	for i := 0; i < maxProgressBars+2; i++ {
+		hosts = append(hosts, fmt.Sprintf("host%d", i))
+	}
+	p := newProgress(hosts, 10, &buf, true, time.Hour, 0, nil)
+	defer p.stop()
+	for _, h := range hosts {
+		p.begin(h)
+	}
+
+	p.mu.Lock()
+	p.redraw()
+	p.mu.Unlock()
+	first := buf.String()
+	if strings.Contains(first, "\x1b[23A") {
+		t.Errorf("first redraw() moved the cursor up: %q", first)
+	}
+	if !strings.Contains(first, "host0  [                              ]   0% 0 B/10 B\n") {
+		t.Errorf("redraw() = %q, missing the bar of host0", first)
+	}
+	if !strings.Contains(first, "... and 2 more hosts\n") {
+		t.Errorf("redraw() = %q, missing the hidden hosts", first)
+	}
+	if p.drawn != maxProgressBars+2 {
+		t.Errorf("redraw() drew %d lines, want %d", p.drawn, maxProgressBars+2)
+	}
+
+	// Output printed above the bars clears them and redraws them below it
+	buf.Reset()
+	p.above(func() { fmt.Fprint(&buf, "host0 | Finished\n") })
+	out := buf.String()
+	clear := fmt.Sprintf("\x1b[%dA\x1b[J", maxProgressBars+2)
+	if !strings.HasPrefix(out, clear+"host0 | Finished\n\r\x1b[2Khost0 ") {
+		t.Errorf("above() = %q", out)
+	}
+
+	var nilProgress *progress
+	called := false
+	nilProgress.above(func() { called = true })
+	nilProgress.begin("host0")
+	nilProgress.finish("host0", nil)
+	nilProgress.stop()
+	if !called {
+		t.Error("above() of a nil progress should still print")
+	}
+}
+
+func TestTransferSize(t *testing.T) {
+	src := t.TempDir()
+	writeTree(t, src, map[string]string{"a": "12345", "dir/b": "123"}, time.Now())
+	tests := []struct {
+		name string
+		opt  common.Options
+		want int64
+	}{
+		{name: "File", opt: common.Options{Op: "scp", Src: filepath.Join(src, "a")}, want: 5},
+		{name: "Directory", opt: common.Options{Op: "scp", Src: src, IsRecursive: true}, want: 8},
+		{name: "From remote", opt: common.Options{Op: "scp", Src: src, FromRemote: true}, want: 0},
+		{name: "Sync", opt: common.Options{Op: "sync", Src: src}, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := transferSize(tt.opt)
+			if err != nil || got != tt.want {
+				t.Errorf("transferSize() = %d, %v, want %d", got, err, tt.want)
+			}
+		})
+	}
+	if _, err := transferSize(common.Options{Op: "scp", Src: filepath.Join(src, "missing")}); err == nil {
+		t.Error("transferSize() of a missing source expected an error")
+	}
+}
+
+func TestTransferProgress(t *testing.T) {
+	src := t.TempDir()
+	files := map[string]string{"a.txt": "alpha\n", "dir/b.txt": "bravo bravo\n"}
+	writeTree(t, src, files, time.Now())
+	entry := fmt.Sprintf("127.0.0.1:%d", sftpTestServer())
+
+	for _, protocol := range []string{ProtocolSCP, ProtocolSFTP} {
+		t.Run(protocol, func(t *testing.T) {
+			dst := t.TempDir()
+			opt := common.Options{Op: "scp", Src: src, Dst: dst, IsRecursive: true, Preserve: true, Protocol: protocol}
+			size, err := transferSize(opt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			env := &runEnv{config: execTestConfig()}
+			env.progress = newProgress([]string{entry}, size, &bytes.Buffer{}, false, time.Hour, 0, nil)
+			defer env.progress.stop()
+			h := env.progress.host(entry)
+
+			if res := executeCopy(opt, testTarget(t, opt, entry), env); res.err != nil {
+				t.Fatalf("executeCopy() error: %v", res.err)
+			}
+			if h.done.Load() != 18 || h.total.Load() != 18 {
+				t.Errorf("upload counted %d of %d bytes, want 18", h.done.Load(), h.total.Load())
+			}
+
+			h.done.Store(0)
+			h.total.Store(0)
+			opt = common.Options{Op: "scp", Src: dst, Dst: t.TempDir(), IsRecursive: true, FromRemote: true, Protocol: protocol}
+			if res := executeFetch(opt, testTarget(t, opt, entry), env); res.err != nil {
+				t.Fatalf("executeFetch() error: %v", res.err)
+			}
+			if h.done.Load() != 18 || h.total.Load() != 18 {
+				t.Errorf("download counted %d of %d bytes, want 18", h.done.Load(), h.total.Load())
+			}
+
+			h.done.Store(0)
+			h.total.Store(0)
+			if err := os.WriteFile(filepath.Join(src, "a.txt"), []byte("alpha alpha\n"), 0640); err != nil {
+				t.Fatal(err)
+			}
+			defer os.WriteFile(filepath.Join(src, "a.txt"), []byte("alpha\n"), 0640)
+			opt = common.Options{Op: "sync", Src: src, Dst: filepath.Join(dst, filepath.Base(src)), Protocol: protocol}
+			if res := executeSync(opt, testTarget(t, opt, entry), env); res.err != nil {
+				t.Fatalf("executeSync() error: %v", res.err)
+			}
+			if h.done.Load() != 12 || h.total.Load() != 12 {
+				t.Errorf("sync counted %d of %d bytes, want 12", h.done.Load(), h.total.Load())
+			}
+		})
+	}
+}
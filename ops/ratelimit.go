@@ -0,0 +1,140 @@
+// Copyright © 2017 Ricardo Aravena <raravena80@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ops
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// limitChunk is the most bytes a limited writer sends at once, so that
+// slow rates are paced smoothly rather than in long pauses.
+const limitChunk = 32 * 1024
+
+// parseRate parses a rate in bytes per second, such as "10M", with an
+// optional K, M or G suffix for multiples of 1024. An empty rate or 0
+// means no limit.
+func parseRate(s string) (int64, error) {
+	num := strings.TrimSpace(s)
+	if num == "" {
+		return 0, nil
+	}
+	mult := 1.0
+	switch strings.ToUpper(num[len(num)-1:]) {
+	case "K":
+		mult = 1 << 10
+	case "M":
+		mult = 1 << 20
+	case "G":
+		mult = 1 << 30
+	}
+	if mult > 1 {
+		num = num[:len(num)-1]
+	}
+	v, err := strconv.ParseFloat(num, 64)
+	if err != nil || math.IsNaN(v) || math.IsInf(v, 0) || v < 0 || v*mult >= math.MaxInt64 {
+		return 0, fmt.Errorf("invalid rate %q, use bytes per second such as 500K or 10M", s)
+	}
+	return int64(v * mult), nil
+}
+
+// rateLimiter is a token bucket that lets through rate bytes per second on
+// average, in bursts of up to a second's worth. It can be shared by any
+// number of goroutines. A nil rateLimiter does not limit anything.
+type rateLimiter struct {
+	rate float64
+
+	mu     sync.Mutex
+	tokens float64 // Bytes that can be sent right away, negative when in debt
+	last   time.Time
+}
+
+// newRateLimiter returns a limiter for rate bytes per second, or nil when
+// rate is not positive.
+func newRateLimiter(rate int64) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &rateLimiter{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+// reserve takes n bytes from the bucket and returns how long to wait before
+// sending them. The bucket goes into debt rather than making the caller
+// retry, so concurrent callers are served in the order they asked.
+func (l *rateLimiter) reserve(n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.tokens = min(l.rate, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// wait blocks until n bytes can be sent.
+func (l *rateLimiter) wait(n int) {
+	if l == nil {
+		return
+	}
+	if d := l.reserve(n); d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// limitWriter returns w with its writes paced to every one of limiters, of
+// which nil ones are ignored.
+func limitWriter(w io.Writer, limiters ...*rateLimiter) io.Writer {
+	var active []*rateLimiter
+	for _, l := range limiters {
+		if l != nil {
+			active = append(active, l)
+		}
+	}
+	if len(active) == 0 {
+		return w
+	}
+	return &limitedWriter{w: w, limiters: active}
+}
+
+// limitedWriter paces the writes to w.
+type limitedWriter struct {
+	w        io.Writer
+	limiters []*rateLimiter
+}
+
+func (l *limitedWriter) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		n := min(len(b), limitChunk)
+		for _, lim := range l.limiters {
+			lim.wait(n)
+		}
+		m, err := l.w.Write(b[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
@@ -0,0 +1,145 @@
+// Copyright © 2017 Ricardo Aravena <raravena80@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ops
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/raravena80/ya/common"
+)
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		in        string
+		want      int64
+		expectErr bool
+	}{
+		{in: "", want: 0},
+		{in: "0", want: 0},
+		{in: "1500", want: 1500},
+		{in: "512K", want: 512 << 10},
+		{in: "10M", want: 10 << 20},
+		{in: "1.5m", want: 3 << 19},
+		{in: "2G", want: 2 << 30},
+		{in: "fast", expectErr: true},
+		{in: "M", expectErr: true},
+		{in: "-1M", expectErr: true},
+		{in: "NaN", expectErr: true},
+		{in: "Inf", expectErr: true},
+		{in: "+Inf", expectErr: true},
+		{in: "-Inf", expectErr: true},
+		{in: "1e30G", expectErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseRate(tt.in)
+		if (err != nil) != tt.expectErr || got != tt.want {
+			t.Errorf("parseRate(%q) = %d, %v, want %d", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	if newRateLimiter(0) != nil {
+		t.Error("newRateLimiter(0) should not limit")
+	}
+	var nilLimiter *rateLimiter
+	nilLimiter.wait(1 << 30)
+
+	l := newRateLimiter(1000)
+	if d := l.reserve(1000); d != 0 {
+		t.Errorf("reserve() of the burst waits %v, want 0", d)
+	}
+	if d := l.reserve(500); d < 400*time.Millisecond || d > 500*time.Millisecond {
+		t.Errorf("reserve() past the burst waits %v, want about 500ms", d)
+	}
+	// Later callers wait behind the debt of earlier ones
+	if d := l.reserve(500); d < 900*time.Millisecond {
+		t.Errorf("reserve() behind a debt waits %v, want about 1s", d)
+	}
+}
+
+func TestLimitWriter(t *testing.T) {
+	var buf bytes.Buffer
+	if w := limitWriter(&buf, nil, nil); w != &buf {
+		t.Error("limitWriter() without limiters should return the writer itself")
+	}
+
+	// Two writers sharing a limiter whose burst is used up get 50 KiB
+	// through in about half a second
+	shared := newRateLimiter(100 << 10)
+	shared.reserve(100 << 10)
+	data := make([]byte, 25<<10)
+	rand.Read(data)
+	var outs [2]bytes.Buffer
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := range outs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, err := limitWriter(&outs[i], shared).Write(data); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("shared limiter let 50 KiB through in %v, want about 500ms", elapsed)
+	}
+	for i := range outs {
+		if !bytes.Equal(outs[i].Bytes(), data) {
+			t.Errorf("writer %d wrote different data", i)
+		}
+	}
+}
+
+func TestExecuteCopyLimitRate(t *testing.T) {
+	data := make([]byte, 96<<10)
+	rand.Read(data)
+	src := filepath.Join(t.TempDir(), "big.bin")
+	if err := os.WriteFile(src, data, 0640); err != nil {
+		t.Fatal(err)
+	}
+	entry := fmt.Sprintf("127.0.0.1:%d", sftpTestServer())
+
+	for _, protocol := range []string{ProtocolSCP, ProtocolSFTP} {
+		t.Run(protocol, func(t *testing.T) {
+			dst := filepath.Join(t.TempDir(), "big.bin")
+			opt := common.Options{Src: src, Dst: dst, Protocol: protocol}
+			env := &runEnv{config: execTestConfig(), rate: 64 << 10}
+			env.progress = newProgress([]string{entry}, int64(len(data)), nil, false, time.Hour, env.rate, nil)
+			defer env.progress.stop()
+
+			start := time.Now()
+			if res := executeCopy(opt, testTarget(t, opt, entry), env); res.err != nil {
+				t.Fatalf("executeCopy() error: %v", res.err)
+			}
+			// The first 64 KiB go out as a burst, the rest at 64 KiB/s
+			if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+				t.Errorf("copy of 96 KiB at 64 KiB/s took %v, want about 500ms", elapsed)
+			}
+			if got, err := os.ReadFile(dst); err != nil || !bytes.Equal(got, data) {
+				t.Errorf("copy differs from the source (%v)", err)
+			}
+		})
+	}
+}
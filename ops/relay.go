@@ -0,0 +1,197 @@
+// Copyright © 2017 Ricardo Aravena <raravena80@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ops
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/raravena80/ya/common"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// relaySCPPath is the scp binary peers run to send the file on.
+var relaySCPPath = DefaultSCPPath
+
+// relayNode is a host in a relay tree.
+type relayNode struct {
+	parent string // Host that sends the file to this one, empty for ya
+	done   chan struct{}
+	once   sync.Once
+
+	// Set once done is closed
+	ok     bool   // Whether the host got the file
+	target target // How ya reaches the host
+	path   string // Where the file is on the host
+}
+
+// relayTree fans a file out to hosts. ya sends it to the first fanout
+// hosts; from then on every host that has the file sends it to fanout more,
+// so the number of copies grows geometrically while ya's own uplink only
+// carries fanout of them.
+type relayTree struct {
+	ctx   context.Context
+	nodes map[string]*relayNode
+}
+
+// newRelayTree arranges hosts, in order, in a tree where every host sends
+// the file to fanout others.
+func newRelayTree(ctx context.Context, hosts []string, fanout int) *relayTree {
+	r := &relayTree{ctx: ctx, nodes: map[string]*relayNode{}}
+	for i, h := range hosts {
+		if _, ok := r.nodes[h]; ok {
+			continue
+		}
+		node := &relayNode{done: make(chan struct{})}
+		if i >= fanout {
+			node.parent = hosts[(i-fanout)/fanout]
+		}
+		r.nodes[h] = node
+	}
+	return r
+}
+
+// source waits for the host that should send the file to host and returns
+// it, or nil if ya has to send it itself. When a host failed to get the file
+// its own source is used instead.
+func (r *relayTree) source(host string) (*relayNode, error) {
+	node, ok := r.nodes[host]
+	if !ok {
+		return nil, nil
+	}
+	for p := node.parent; p != ""; p = r.nodes[p].parent {
+		peer := r.nodes[p]
+		select {
+		case <-peer.done:
+		case <-r.ctx.Done():
+			return nil, r.ctx.Err()
+		}
+		if peer.ok {
+			return peer, nil
+		}
+	}
+	return nil, nil
+}
+
+// finish records how host fared, letting the hosts it serves go ahead.
+func (r *relayTree) finish(host string, t target, res executeResult) {
+	node, ok := r.nodes[host]
+	if !ok {
+		return
+	}
+	node.once.Do(func() {
+		if res.err == nil && res.transfer != nil && res.transfer.path != "" {
+			node.ok, node.target, node.path = true, t, res.transfer.path
+		}
+		close(node.done)
+	})
+}
+
+// relayCommand returns the command that makes a peer send the file at src
+// to dst on t, at up to rate bytes per second if positive. The peer
+// authenticates with its own keys or a forwarded agent, and must already
+// trust t's host key.
+func relayCommand(src string, t target, dst string, rate int64) string {
+	host := t.host
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	if t.user != "" {
+		host = t.user + "@" + host
+	}
+	limit := ""
+	if rate > 0 {
+		// scp limits in Kbit/s
+		limit = fmt.Sprintf(" -l %d", max(rate*8/1000, 1))
+	}
+	return fmt.Sprintf("%s -q -p -o BatchMode=yes%s -P %d -- %s %s",
+		relaySCPPath, limit, t.port, shellQuote(src), shellQuote(host+":"+dst))
+}
+
+// executeRelay copies opt.Src to the host, from a peer that already has it
+// when there is one and from ya otherwise. Hosts behind jump hosts, which
+// peers cannot reach the way ya does, and hosts the peer failed to copy to
+// get the file from ya.
+func executeRelay(opt common.Options, t target, env *runEnv) executeResult {
+	peer, err := env.relay.source(t.name)
+	if err != nil {
+		return makeExecResult(t.name, "", err)
+	}
+	if peer == nil || t.jump != "" {
+		return executeCopy(opt, t, env)
+	}
+
+	stats := &transferStats{peer: peer.target.name}
+	if err := relayCopy(opt, peer, t, env); err != nil {
+		res := executeCopy(opt, t, env)
+		if res.err != nil {
+			res.err = fmt.Errorf("relay from %s failed: %v; direct copy failed: %w", stats.peer, err, res.err)
+		} else if res.transfer != nil {
+			res.transfer.peer = fmt.Sprintf("local (relay from %s failed)", stats.peer)
+		}
+		return res
+	}
+	if info, err := os.Stat(opt.Src); err == nil {
+		stats.bytes = info.Size()
+	}
+
+	conn, err := dialHost(opt, t, env)
+	if err != nil {
+		return makeExecResult(t.name, "", err)
+	}
+	defer conn.Close()
+	return transferResult(opt, t, conn, env, stats, nil)
+}
+
+// relayCopy has peer send its copy of the file to t.
+func relayCopy(opt common.Options, peer *relayNode, t target, env *runEnv) error {
+	conn, err := dialHost(opt, peer.target, env)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if opt.ForwardAgent {
+		if err := agent.ForwardToRemote(conn, opt.AgentSock); err != nil {
+			return fmt.Errorf("failed to forward SSH agent: %w", err)
+		}
+	}
+
+	session, err := conn.NewSession()
+	if err != nil {
+		//go:nocovline // NewSession failure hard to test without mock SSH server
+		return fmt.Errorf("failed to create SSH session: %w", err)
+	}
+	defer session.Close()
+	if opt.ForwardAgent {
+		if err := agent.RequestAgentForwarding(session); err != nil {
+			return fmt.Errorf("failed to request agent forwarding: %w", err)
+		}
+	}
+
+	var stderr bytes.Buffer
+	session.Stderr = &stderr
+	err = session.Start(relayCommand(peer.path, t, opt.Dst, env.rate))
+	if err == nil {
+		err = waitWithTimeout(sessionProcess{session, conn}, commandTimeout(opt), session.Wait)
+	}
+	if msg := strings.TrimSpace(stderr.String()); err != nil && msg != "" {
+		return fmt.Errorf("%s: %w", msg, err)
+	}
+	return err
+}
@@ -0,0 +1,196 @@
+// Copyright © 2017 Ricardo Aravena <raravena80@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ops
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/raravena80/ya/common"
+)
+
+func TestNewRelayTree(t *testing.T) {
+	hosts := []string{"h0", "h1", "h2", "h3", "h4", "h5", "h6"}
+	r := newRelayTree(context.Background(), hosts, 2)
+	want := map[string]string{"h0": "", "h1": "", "h2": "h0", "h3": "h0", "h4": "h1", "h5": "h1", "h6": "h2"}
+	got := map[string]string{}
+	for h, node := range r.nodes {
+		got[h] = node.parent
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parents = %v, want %v", got, want)
+	}
+}
+
+func TestRelayTreeSource(t *testing.T) {
+	r := newRelayTree(context.Background(), []string{"h0", "h1", "h2", "h3"}, 1)
+	ok := executeResult{transfer: &transferStats{path: "/tmp/file"}}
+	failed := makeExecResult("", "", fmt.Errorf("failed"))
+
+	if peer, err := r.source("h0"); peer != nil || err != nil {
+		t.Errorf("source(h0) = %v, %v, want ya", peer, err)
+	}
+	r.finish("h0", target{name: "h0"}, ok)
+	r.finish("h1", target{name: "h1"}, failed)
+	r.finish("h1", target{name: "h1"}, ok) // Only the first result counts
+	// h2 is served by h1, which failed, so by h0 instead
+	if peer, err := r.source("h2"); err != nil || peer == nil || peer.target.name != "h0" {
+		t.Errorf("source(h2) = %v, %v, want h0", peer, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r = newRelayTree(ctx, []string{"h0", "h1"}, 1)
+	cancel()
+	if _, err := r.source("h1"); err == nil {
+		t.Error("source() expected an error once cancelled")
+	}
+}
+
+func TestRelayCommand(t *testing.T) {
+	tests := []struct {
+		name string
+		t    target
+		rate int64
+		want string
+	}{
+		{name: "User and host", t: target{host: "10.0.0.2", port: 22, user: "deploy"},
+			want: DefaultSCPPath + " -q -p -o BatchMode=yes -P 22 -- '/srv/app.tar' 'deploy@10.0.0.2:/srv/'"},
+		{name: "IPv6 without user", t: target{host: "2001:db8::1", port: 2222},
+			want: DefaultSCPPath + " -q -p -o BatchMode=yes -P 2222 -- '/srv/app.tar' '[2001:db8::1]:/srv/'"},
+		{name: "Rate limit", t: target{host: "web1", port: 22}, rate: 10 << 20,
+			want: DefaultSCPPath + " -q -p -o BatchMode=yes -l 83886 -P 22 -- '/srv/app.tar' 'web1:/srv/'"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := relayCommand("/srv/app.tar", tt.t, "/srv/", tt.rate); got != tt.want {
+				t.Errorf("relayCommand() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExecuteRelay(t *testing.T) {
+	// Every host is the same machine, so the peers' scp only has to log
+	// what it was asked to send
+	dir := t.TempDir()
+	log := filepath.Join(dir, "relay.log")
+	fakeSCP := filepath.Join(dir, "scp")
+	if err := os.WriteFile(fakeSCP, []byte("#!/bin/sh\necho \"$@\" >> "+log+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer func(p string) { relaySCPPath = p }(relaySCPPath)
+	relaySCPPath = fakeSCP
+
+	src := filepath.Join(dir, "artifact.bin")
+	if err := os.WriteFile(src, []byte("artifact contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	digest, err := fileSHA256(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := t.TempDir()
+	port := execTestServer()
+	var hosts []string
+	for i := 0; i < 5; i++ {
+		hosts = append(hosts, fmt.Sprintf("u%d@127.0.0.1:%d", i, port))
+	}
+
+	opt := common.Options{Src: src, Dst: dst, Relay: 2, Verify: VerifySHA256, Protocol: ProtocolSCP}
+	env := &runEnv{config: execTestConfig(), digest: digest,
+		relay: newRelayTree(context.Background(), hosts, opt.Relay)}
+	results := make([]executeResult, len(hosts))
+	var wg sync.WaitGroup
+	for i, h := range hosts {
+		wg.Add(1)
+		go func(i int, h string) {
+			defer wg.Done()
+			tgt := testTarget(t, opt, h)
+			results[i] = executeRelay(opt, tgt, env)
+			env.relay.finish(h, tgt, results[i])
+		}(i, h)
+	}
+	wg.Wait()
+
+	wantPeers := []string{"", "", hosts[0], hosts[0], hosts[1]}
+	for i, res := range results {
+		if res.err != nil {
+			t.Fatalf("%s: executeRelay() error: %v", hosts[i], res.err)
+		}
+		s := res.transfer
+		if s.peer != wantPeers[i] || s.bytes != 17 || !s.verified || s.digest != digest {
+			t.Errorf("%s: transfer = %+v, want peer %q, 17 bytes, verified", hosts[i], *s, wantPeers[i])
+		}
+		if !strings.Contains(res.stdout, "Copied 17 bytes from ") || !strings.Contains(res.stdout, "verified") {
+			t.Errorf("%s: output = %q", hosts[i], res.stdout)
+		}
+	}
+
+	data, err := os.ReadFile(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copied := filepath.Join(dst, "artifact.bin")
+	for _, user := range []string{"u2", "u3", "u4"} {
+		want := fmt.Sprintf("-P %d -- %s %s@127.0.0.1:%s", port, copied, user, dst)
+		if !strings.Contains(string(data), want) {
+			t.Errorf("relay log %q does not contain %q", data, want)
+		}
+	}
+}
+
+func TestExecuteRelayFallback(t *testing.T) {
+	// The peers cannot reach the other hosts, so ya copies to them itself
+	dir := t.TempDir()
+	fakeSCP := filepath.Join(dir, "scp")
+	if err := os.WriteFile(fakeSCP, []byte("#!/bin/sh\necho 'Host key verification failed.' >&2\nexit 1\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer func(p string) { relaySCPPath = p }(relaySCPPath)
+	relaySCPPath = fakeSCP
+
+	src := filepath.Join(dir, "artifact.bin")
+	if err := os.WriteFile(src, []byte("artifact contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	port := execTestServer()
+	hosts := []string{fmt.Sprintf("u0@127.0.0.1:%d", port), fmt.Sprintf("u1@127.0.0.1:%d", port)}
+
+	opt := common.Options{Src: src, Dst: t.TempDir(), Relay: 1, Protocol: ProtocolSCP}
+	env := &runEnv{config: execTestConfig(), relay: newRelayTree(context.Background(), hosts, opt.Relay)}
+	var results []executeResult
+	for _, h := range hosts {
+		tgt := testTarget(t, opt, h)
+		res := executeRelay(opt, tgt, env)
+		env.relay.finish(h, tgt, res)
+		results = append(results, res)
+	}
+
+	wantPeers := []string{"", "local (relay from " + hosts[0] + " failed)"}
+	for i, res := range results {
+		if res.err != nil {
+			t.Fatalf("%s: executeRelay() error: %v", hosts[i], res.err)
+		}
+		if res.transfer.peer != wantPeers[i] || res.transfer.bytes != 17 {
+			t.Errorf("%s: transfer = %+v, want peer %q and 17 bytes", hosts[i], *res.transfer, wantPeers[i])
+		}
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright © 2017 Ricardo Aravena <raravena80@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ops
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/raravena80/ya/common"
+	"golang.org/x/crypto/ssh"
+)
+
+// maxRetryDelay caps the wait between two attempts of a copy.
+const maxRetryDelay = 5 * time.Minute
+
+// sha256Command prints the SHA-256 of its input, with GNU or BSD tools.
+const sha256Command = "if command -v sha256sum >/dev/null 2>&1; then sha256sum; else shasum -a 256; fi"
+
+// retryDelay returns how long to wait after the failed attempt number
+// attempt, counted from 0: opt.RetryDelay seconds doubled for every earlier
+// retry, up to maxRetryDelay.
+func retryDelay(opt common.Options, attempt int) time.Duration {
+	delay := time.Duration(opt.RetryDelay) * time.Second
+	for i := 0; i < attempt && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, maxRetryDelay)
+}
+
+// sleep waits for d, returning early with an error if the run is cancelled.
+func (env *runEnv) sleep(d time.Duration) error {
+	ctx := env.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// sftpResume lets an SFTP upload carry on from where an earlier attempt
+// stopped. A nil sftpResume starts every file afresh.
+type sftpResume struct {
+	// partial reports whether the partial file left on the host holds the
+	// first n bytes of local
+	partial func(partial string, local io.ReaderAt, n int64) bool
+	// done holds the files earlier attempts copied, which are skipped
+	done *copiedFiles
+	// keep is set when another attempt follows a failed one, which carries
+	// on from the partial file it leaves
+	keep bool
+}
+
+// copiedFiles is the set of destination files an upload put in place, kept
+// across its attempts. A nil copiedFiles is empty and records nothing.
+type copiedFiles struct {
+	mu    sync.Mutex
+	files map[string]bool
+}
+
+// add records that dst was copied.
+func (c *copiedFiles) add(dst string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.files == nil {
+		c.files = map[string]bool{}
+	}
+	c.files[dst] = true
+}
+
+// has reports whether dst was copied.
+func (c *copiedFiles) has(dst string) bool {
+	if c == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.files[dst]
+}
+
+// newSFTPResume returns the resume of an upload over conn, which checks
+// partial files by comparing the SHA-256 of their contents, computed on the
+// host, with that of the start of the local file, and skips the files in
+// done. With keep the partial file of a failed upload is left for the next
+// attempt.
+func newSFTPResume(opt common.Options, conn *ssh.Client, done *copiedFiles, keep bool) *sftpResume {
+	return &sftpResume{
+		partial: func(partial string, local io.ReaderAt, n int64) bool {
+			h := sha256.New()
+			if _, err := io.Copy(h, io.NewSectionReader(local, 0, n)); err != nil {
+				return false
+			}
+			out, err := runRemote(opt, conn, "sh -c "+shellQuote(sha256Command+" < "+shellQuote(partial)))
+			if err != nil {
+				return false
+			}
+			sum, _, _ := strings.Cut(strings.TrimSpace(string(out)), " ")
+			return sum == hex.EncodeToString(h.Sum(nil))
+		},
+		done: done,
+		keep: keep,
+	}
+}
@@ -0,0 +1,301 @@
+// Copyright © 2017 Ricardo Aravena <raravena80@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ops
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	"github.com/raravena80/ya/common"
+)
+
+// flakyProxy forwards connections to the local port and returns its own
+// port. The first cuts connections are cut once limit bytes have been
+// forwarded from the client, right away for a limit of 0.
+func flakyProxy(t *testing.T, port int, cuts int32, limit int64) int {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	var accepted atomic.Int32
+	go func() {
+		for {
+			client, err := l.Accept()
+			if err != nil {
+				return
+			}
+			cut := accepted.Add(1) <= cuts
+			if cut && limit == 0 {
+				client.Close()
+				continue
+			}
+			server, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+			if err != nil {
+				client.Close()
+				continue
+			}
+			go func() {
+				defer client.Close()
+				defer server.Close()
+				io.Copy(client, server)
+			}()
+			go func() {
+				defer client.Close()
+				defer server.Close()
+				if cut {
+					io.CopyN(server, client, limit)
+					return
+				}
+				io.Copy(server, client)
+			}()
+		}
+	}()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		delay   int
+		attempt int
+		want    time.Duration
+	}{
+		{delay: 0, attempt: 3, want: 0},
+		{delay: 1, attempt: 0, want: time.Second},
+		{delay: 1, attempt: 1, want: 2 * time.Second},
+		{delay: 2, attempt: 3, want: 16 * time.Second},
+		{delay: 10, attempt: 20, want: maxRetryDelay},
+	}
+	for _, tt := range tests {
+		if got := retryDelay(common.Options{RetryDelay: tt.delay}, tt.attempt); got != tt.want {
+			t.Errorf("retryDelay(%d, %d) = %v, want %v", tt.delay, tt.attempt, got, tt.want)
+		}
+	}
+}
+
+func TestRunEnvSleep(t *testing.T) {
+	if err := (&runEnv{}).sleep(time.Millisecond); err != nil {
+		t.Errorf("sleep() error: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	start := time.Now()
+	if err := (&runEnv{ctx: ctx}).sleep(time.Hour); err == nil || time.Since(start) > time.Second {
+		t.Errorf("sleep() of a cancelled run = %v after %v", err, time.Since(start))
+	}
+}
+
+func TestSFTPPutFileResume(t *testing.T) {
+	data := make([]byte, 256*1024)
+	rand.Read(data)
+	src := filepath.Join(t.TempDir(), "big.bin")
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := os.WriteFile(src, data, 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(src, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opt := common.Options{Protocol: ProtocolSFTP}
+	conn, err := dialHost(opt, testTarget(t, opt, fmt.Sprintf("127.0.0.1:%d", sftpTestServer())), &runEnv{config: execTestConfig()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	tests := []struct {
+		name     string
+		partial  []byte // Left by an earlier attempt, nil for none
+		existing bool   // Whether dst already holds the file
+		done     bool   // Whether an earlier attempt copied it there
+		wantSent int64
+	}{
+		{name: "Matching partial", partial: data[:100000], wantSent: int64(len(data) - 100000)},
+		{name: "Different partial", partial: bytes.Repeat([]byte("x"), 100000), wantSent: int64(len(data))},
+		{name: "Partial longer than the source", partial: append(data, 'x'), wantSent: int64(len(data))},
+		{name: "No partial", wantSent: int64(len(data))},
+		{name: "Done file skipped", existing: true, done: true, wantSent: 0},
+		{name: "Done file sent again", existing: true, wantSent: int64(len(data))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dst := filepath.Join(t.TempDir(), "big.bin")
+			if tt.partial != nil {
+				if err := os.WriteFile(dst+partialSuffix, tt.partial, 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			copied := &copiedFiles{}
+			if tt.existing {
+				var first *sftpResume
+				if tt.done {
+					first = newSFTPResume(opt, conn, copied, true)
+				}
+				if _, err := sftpPutFile(client, src, info, dst, false, nil, first); err != nil {
+					t.Fatal(err)
+				}
+			}
+			prog := &hostProgress{name: "host"}
+			sent, err := sftpPutFile(client, src, info, dst, false, prog, newSFTPResume(opt, conn, copied, true))
+			if err != nil {
+				t.Fatalf("sftpPutFile() error: %v", err)
+			}
+			if sent != tt.wantSent {
+				t.Errorf("sftpPutFile() sent %d bytes, want %d", sent, tt.wantSent)
+			}
+			if prog.done.Load() != int64(len(data)) {
+				t.Errorf("progress counted %d bytes, want %d", prog.done.Load(), len(data))
+			}
+			got, err := os.ReadFile(dst)
+			if err != nil || !bytes.Equal(got, data) {
+				t.Errorf("copy differs from the source (%v)", err)
+			}
+			if _, err := os.Stat(dst + partialSuffix); !os.IsNotExist(err) {
+				t.Errorf("partial file left behind: %v", err)
+			}
+		})
+	}
+}
+
+func TestSFTPPutFileFailure(t *testing.T) {
+	// Reading a directory fails once the partial file is created
+	src := t.TempDir()
+	info, err := os.Stat(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opt := common.Options{Protocol: ProtocolSFTP}
+	conn, err := dialHost(opt, testTarget(t, opt, fmt.Sprintf("127.0.0.1:%d", sftpTestServer())), &runEnv{config: execTestConfig()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	tests := []struct {
+		name     string
+		resume   *sftpResume
+		wantKept bool
+	}{
+		{name: "No resume"},
+		{name: "Last attempt", resume: newSFTPResume(opt, conn, nil, false)},
+		{name: "Retry follows", resume: newSFTPResume(opt, conn, nil, true), wantKept: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dst := filepath.Join(t.TempDir(), "big.bin")
+			if _, err := sftpPutFile(client, src, info, dst, false, nil, tt.resume); err == nil {
+				t.Fatal("sftpPutFile() of a directory succeeded")
+			}
+			if _, err := os.Stat(dst + partialSuffix); (err == nil) != tt.wantKept {
+				t.Errorf("partial file kept = %v, want %v", err == nil, tt.wantKept)
+			}
+		})
+	}
+}
+
+func TestExecuteCopyRetry(t *testing.T) {
+	data := make([]byte, 512*1024)
+	rand.Read(data)
+	src := filepath.Join(t.TempDir(), "big.bin")
+	if err := os.WriteFile(src, data, 0640); err != nil {
+		t.Fatal(err)
+	}
+	port := sftpTestServer()
+
+	tests := []struct {
+		name        string
+		protocol    string
+		cuts        int32
+		limit       int64
+		retries     int
+		wantRetries int
+		wantNote    string
+		expectErr   bool
+		resumed     bool
+	}{
+		{name: "Dial retried", protocol: ProtocolSCP, cuts: 1, retries: 3, wantRetries: 1, wantNote: "Retried once\n"},
+		{name: "Transfer resumed", protocol: ProtocolSFTP, cuts: 1, limit: 200 * 1024, retries: 2, wantRetries: 1,
+			wantNote: "Retried once\n", resumed: true},
+		{name: "Transfer retried with scp", protocol: ProtocolSCP, cuts: 1, limit: 200 * 1024, retries: 2, wantRetries: 1,
+			wantNote: "Retried once\n"},
+		{name: "Out of retries", protocol: ProtocolSFTP, cuts: 3, retries: 2, wantRetries: 2,
+			wantNote: "Retried 2 times\n", expectErr: true},
+		{name: "No retries", protocol: ProtocolSFTP, cuts: 1, expectErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dst := filepath.Join(t.TempDir(), "big.bin")
+			entry := fmt.Sprintf("127.0.0.1:%d", flakyProxy(t, port, tt.cuts, tt.limit))
+			opt := common.Options{Src: src, Dst: dst, Protocol: tt.protocol, Retries: tt.retries, Verify: VerifySHA256}
+			digest, err := fileSHA256(src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res := executeCopy(opt, testTarget(t, opt, entry), &runEnv{config: execTestConfig(), digest: digest})
+			if res.retries != tt.wantRetries || newResultRecord(res).Retries != tt.wantRetries {
+				t.Errorf("executeCopy() retried %d times, want %d", res.retries, tt.wantRetries)
+			}
+			if strings.Contains(res.stdout, "Retried") {
+				t.Errorf("executeCopy() output = %q, want the retries left out", res.stdout)
+			}
+			if out := (&TextFormatter{}).FormatResult(res); !strings.Contains(out, tt.wantNote) {
+				t.Errorf("FormatResult() = %q, want it to contain %q", out, tt.wantNote)
+			}
+			if tt.expectErr {
+				if res.err == nil {
+					t.Error("Expected an error, got nil")
+				}
+				return
+			}
+			if res.err != nil {
+				t.Fatalf("executeCopy() error: %v", res.err)
+			}
+			if tt.resumed && res.transfer.bytes >= int64(len(data)) {
+				t.Errorf("executeCopy() sent %d bytes again, want the copy resumed", res.transfer.bytes)
+			}
+			if !tt.resumed && res.transfer.bytes != int64(len(data)) {
+				t.Errorf("executeCopy() sent %d bytes, want %d", res.transfer.bytes, len(data))
+			}
+		})
+	}
+}
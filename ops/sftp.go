@@ -0,0 +1,376 @@
+// Copyright © 2017 Ricardo Aravena <raravena80@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ops
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/sftp"
+	"github.com/raravena80/ya/common"
+	"golang.org/x/crypto/ssh"
+)
+
+// Transfer protocols selectable with common.SetProtocol.
+const (
+	ProtocolAuto = "auto" // SFTP when the server offers it, scp otherwise
+	ProtocolSCP  = "scp"
+	ProtocolSFTP = "sftp"
+)
+
+// Protocols lists the supported transfer protocols.
+var Protocols = []string{ProtocolAuto, ProtocolSCP, ProtocolSFTP}
+
+// partialSuffix is appended to the name of a file while it is being
+// transferred; it is renamed into place once complete.
+const partialSuffix = ".ya-partial"
+
+// validateProtocol returns an error for an unknown transfer protocol. An
+// empty protocol is the same as auto.
+func validateProtocol(p string) error {
+	switch p {
+	case "", ProtocolAuto, ProtocolSCP, ProtocolSFTP:
+		return nil
+	}
+	return fmt.Errorf("unknown transfer protocol %q, use one of %v", p, Protocols)
+}
+
+// openSFTP starts an SFTP session over conn as selected by opt.Protocol. It
+// returns nil without an error when scp should be used instead: always for
+// scp, and for auto when the server does not offer the sftp subsystem.
+func openSFTP(opt common.Options, conn *ssh.Client) (*sftp.Client, error) {
+	switch opt.Protocol {
+	case ProtocolSCP:
+		return nil, nil
+	case ProtocolSFTP:
+		client, err := sftp.NewClient(conn)
+		if err != nil {
+			return nil, fmt.Errorf("failed to start sftp: %w", err)
+		}
+		return client, nil
+	}
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		return nil, nil
+	}
+	return client, nil
+}
+
+// sftpProcess stops an SFTP transfer that ran out of time by closing the
+// client and the connection.
+type sftpProcess struct {
+	client *sftp.Client
+	conn   io.Closer
+}
+
+func (p sftpProcess) Signal(sig ssh.Signal) error {
+	return nil
+}
+
+func (p sftpProcess) Close() error {
+	p.client.Close()
+	return p.conn.Close()
+}
+
+// sftpUpload copies opt.Src to opt.Dst on the host. As with scp, the source
+// is copied into opt.Dst if that is an existing directory, or to opt.Dst
+// itself otherwise, carrying on from an earlier attempt with resume. It
+// returns the number of bytes sent, which are also counted in prog.
+func sftpUpload(client *sftp.Client, opt common.Options, prog *hostProgress, resume *sftpResume) (int64, error) {
+	info, err := os.Stat(opt.Src)
+	if err != nil {
+		return 0, err
+	}
+	dst := opt.Dst
+	if st, err := client.Stat(dst); err == nil && st.IsDir() {
+		dst = path.Join(dst, filepath.Base(opt.Src))
+	}
+	if !info.IsDir() {
+		return sftpPutFile(client, opt.Src, info, dst, opt.Preserve, prog, resume)
+	}
+	if !opt.IsRecursive {
+		return 0, fmt.Errorf("Not a regular file %v", opt.Src)
+	}
+	return sftpPutTree(client, opt, info, dst, nil, prog, resume)
+}
+
+// sftpPutTree uploads the parts of the local directory opt.Src, described
+// by info, selected by filter to the remote directory dst, carrying on from
+// an earlier attempt with resume. It returns the number of bytes sent, which
+// are also counted in prog.
+func sftpPutTree(client *sftp.Client, opt common.Options, info fs.FileInfo, dst string, filter *treeFilter, prog *hostProgress, resume *sftpResume) (int64, error) {
+	var sent int64
+	err := walkTree(localFS{}, opt.Src, info, opt.Symlinks, treeVisitor{
+		enterDir: func(p, rel string, info fs.FileInfo) error {
+			if !filter.dir(rel) {
+				return fs.SkipDir
+			}
+			target := path.Join(dst, rel)
+			if err := client.MkdirAll(target); err != nil {
+				return fmt.Errorf("failed to create %s: %w", target, err)
+			}
+			return nil
+		},
+		// Directory modes are applied once they are filled, so read-only
+		// ones can be copied too
+		leaveDir: func(p, rel string, info fs.FileInfo) error {
+			target := path.Join(dst, rel)
+			if opt.Preserve {
+				sftpChown(client, target, info)
+			}
+			if err := client.Chmod(target, info.Mode().Perm()); err != nil {
+				return err
+			}
+			if !opt.Preserve {
+				return nil
+			}
+			return client.Chtimes(target, fileAtime(info), info.ModTime())
+		},
+		file: func(p, rel string, info fs.FileInfo) error {
+			if !filter.file(rel) {
+				return nil
+			}
+			n, err := sftpPutFile(client, p, info, path.Join(dst, rel), opt.Preserve, prog, resume)
+			sent += n
+			return err
+		},
+		symlink: func(p, rel, linkTarget string, info fs.FileInfo) error {
+			target := path.Join(dst, rel)
+			client.Remove(target)
+			if err := client.Symlink(linkTarget, target); err != nil {
+				return fmt.Errorf("failed to create symlink %s: %w", target, err)
+			}
+			return nil
+		},
+	})
+	return sent, err
+}
+
+// sftpChown gives the remote file p the owner of the local file described
+// by info. Like cp -p, failures are ignored, as only root can usually give
+// files away.
+func sftpChown(client *sftp.Client, p string, info fs.FileInfo) {
+	if uid, gid, ok := fileOwner(info); ok {
+		client.Chown(p, uid, gid)
+	}
+}
+
+// sftpPutFile uploads the local file src to dst. The contents are written
+// to a partial file next to dst, which is renamed into place once its mode,
+// and with preserve its times, are set, so dst is never left half-written.
+// Without preserve the server sets the times, as with scp. If the contents
+// could not all be sent, the partial file is kept for resume to carry on
+// from if another attempt follows, and removed otherwise. It returns the number of bytes sent, which are also
+// counted in prog.
+func sftpPutFile(client *sftp.Client, src string, info fs.FileInfo, dst string, preserve bool, prog *hostProgress, resume *sftpResume) (int64, error) {
+	if resume != nil && resume.done.has(dst) {
+		prog.add(info.Size())
+		return 0, nil
+	}
+	local, err := os.Open(src)
+	if err != nil {
+		return 0, err
+	}
+	defer local.Close()
+
+	partial := dst + partialSuffix
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	var offset int64
+	if resume != nil {
+		if st, err := client.Stat(partial); err == nil && st.Mode().IsRegular() &&
+			st.Size() > 0 && st.Size() <= info.Size() && resume.partial(partial, local, st.Size()) {
+			flags, offset = os.O_WRONLY, st.Size()
+		}
+	}
+	remote, err := client.OpenFile(partial, flags)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create %s: %w", partial, err)
+	}
+	if offset > 0 {
+		if _, err = remote.Seek(offset, io.SeekStart); err == nil {
+			_, err = local.Seek(offset, io.SeekStart)
+		}
+		if err != nil {
+			remote.Close()
+			return 0, fmt.Errorf("failed to resume %s: %w", partial, err)
+		}
+		prog.add(offset)
+	}
+	n, err := io.Copy(prog.writer(remote), local)
+	if err != nil {
+		remote.Close()
+		if resume == nil || !resume.keep {
+			client.Remove(partial)
+		}
+		return n, fmt.Errorf("failed to upload %s: %w", src, err)
+	}
+	if preserve {
+		sftpChown(client, partial, info)
+	}
+	err = remote.Chmod(info.Mode().Perm())
+	if closeErr := remote.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && preserve {
+		err = client.Chtimes(partial, fileAtime(info), info.ModTime())
+	}
+	if err == nil {
+		err = sftpRename(client, partial, dst)
+	}
+	if err != nil {
+		client.Remove(partial)
+		return 0, fmt.Errorf("failed to upload %s: %w", src, err)
+	}
+	if resume != nil {
+		resume.done.add(dst)
+	}
+	return n, nil
+}
+
+// sftpRename renames oldname to newname, replacing newname atomically when
+// the server supports the posix-rename extension.
+func sftpRename(client *sftp.Client, oldname, newname string) error {
+	if _, ok := client.HasExtension("posix-rename@openssh.com"); ok {
+		return client.PosixRename(oldname, newname)
+	}
+	// Plain SFTP rename fails if newname exists
+	client.Remove(newname)
+	return client.Rename(oldname, newname)
+}
+
+// remoteTimes returns the access and modification times of the remote file
+// described by info, for --preserve.
+func remoteTimes(info fs.FileInfo) (time.Time, time.Time) {
+	if st, ok := info.Sys().(*sftp.FileStat); ok {
+		return time.Unix(int64(st.Atime), 0), info.ModTime()
+	}
+	return time.Now(), info.ModTime()
+}
+
+// localChown gives the local file p the owner of the remote file described
+// by info, ignoring failures like sftpChown.
+func localChown(p string, info fs.FileInfo) {
+	if st, ok := info.Sys().(*sftp.FileStat); ok {
+		os.Lchown(p, int(st.UID), int(st.GID))
+	}
+}
+
+// sftpDownload copies opt.Src from the host into the local directory root,
+// which is created if needed. It returns the number of files and bytes
+// received, counting the bytes in prog as well.
+func sftpDownload(client *sftp.Client, opt common.Options, root string, prog *hostProgress) (int, int64, error) {
+	src := path.Clean(opt.Src)
+	st, err := client.Stat(src)
+	if err != nil {
+		return 0, 0, fmt.Errorf("%s: %w", src, err)
+	}
+	if st.IsDir() && !opt.IsRecursive {
+		return 0, 0, fmt.Errorf("%s: not a regular file", src)
+	}
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return 0, 0, err
+	}
+
+	var (
+		files int
+		bytes int64
+	)
+	getFile := func(p string, info fs.FileInfo, local string) error {
+		prog.expect(info.Size())
+		n, err := sftpGetFile(client, p, info, local, opt.Preserve, prog)
+		if err != nil {
+			return err
+		}
+		files++
+		bytes += n
+		return nil
+	}
+	dst := filepath.Join(root, path.Base(src))
+	if !st.IsDir() {
+		return files, bytes, getFile(src, st, dst)
+	}
+	err = walkTree(client, src, st, opt.Symlinks, treeVisitor{
+		enterDir: func(p, rel string, info fs.FileInfo) error {
+			return os.MkdirAll(filepath.Join(dst, filepath.FromSlash(rel)), 0700)
+		},
+		leaveDir: func(p, rel string, info fs.FileInfo) error {
+			local := filepath.Join(dst, filepath.FromSlash(rel))
+			if opt.Preserve {
+				localChown(local, info)
+			}
+			if err := os.Chmod(local, info.Mode().Perm()); err != nil {
+				return err
+			}
+			if !opt.Preserve {
+				return nil
+			}
+			atime, mtime := remoteTimes(info)
+			return os.Chtimes(local, atime, mtime)
+		},
+		file: func(p, rel string, info fs.FileInfo) error {
+			return getFile(p, info, filepath.Join(dst, filepath.FromSlash(rel)))
+		},
+		symlink: func(p, rel, target string, info fs.FileInfo) error {
+			local := filepath.Join(dst, filepath.FromSlash(rel))
+			os.Remove(local)
+			return os.Symlink(target, local)
+		},
+	})
+	return files, bytes, err
+}
+
+// sftpGetFile downloads the remote file src to local through a partial
+// file, which is renamed into place once complete, counting the bytes
+// received in prog.
+func sftpGetFile(client *sftp.Client, src string, info fs.FileInfo, local string, preserve bool, prog *hostProgress) (int64, error) {
+	remote, err := client.Open(src)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open %s: %w", src, err)
+	}
+	defer remote.Close()
+
+	partial := local + partialSuffix
+	f, err := os.OpenFile(partial, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(prog.writer(f), remote)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && preserve {
+		localChown(partial, info)
+	}
+	if err == nil {
+		err = os.Chmod(partial, info.Mode().Perm())
+	}
+	if err == nil && preserve {
+		atime, mtime := remoteTimes(info)
+		err = os.Chtimes(partial, atime, mtime)
+	}
+	if err == nil {
+		err = os.Rename(partial, local)
+	}
+	if err != nil {
+		os.Remove(partial)
+		return 0, fmt.Errorf("failed to download %s: %w", src, err)
+	}
+	return n, nil
+}
@@ -0,0 +1,325 @@
+// Copyright © 2017 Ricardo Aravena <raravena80@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ops
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/raravena80/ya/common"
+	"github.com/raravena80/ya/test"
+)
+
+var (
+	sftpTestOnce sync.Once
+	sftpTestPort int
+)
+
+// sftpTestServer starts the shared in-process SSH server offering the sftp
+// subsystem and returns its port.
+func sftpTestServer() int {
+	sftpTestOnce.Do(func() {
+		sftpTestPort = test.StartSSHServerForSFTP(testPublicKeys)
+	})
+	return sftpTestPort
+}
+
+// writeTree creates files, relative to root, with mode 0640 and mtime.
+func writeTree(t *testing.T, root string, files map[string]string, mtime time.Time) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0640); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// checkTree verifies that files, relative to root, have the expected
+// contents, mode and, unless zero, mtime, and that no partial files were
+// left behind.
+func checkTree(t *testing.T, root string, files map[string]string, mtime time.Time) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		data, err := os.ReadFile(path)
+		if err != nil || string(data) != content {
+			t.Errorf("%s = %q, %v, want %q", name, data, err, content)
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != 0640 {
+			t.Errorf("%s mode = %o, want 640", name, info.Mode().Perm())
+		}
+		if !mtime.IsZero() && !info.ModTime().Equal(mtime) {
+			t.Errorf("%s mtime = %v, want %v", name, info.ModTime(), mtime)
+		}
+	}
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err == nil && strings.HasSuffix(path, partialSuffix) {
+			t.Errorf("partial file left behind: %s", path)
+		}
+		return nil
+	})
+}
+
+func TestValidateProtocol(t *testing.T) {
+	for _, p := range append(Protocols, "") {
+		if err := validateProtocol(p); err != nil {
+			t.Errorf("validateProtocol(%q) error: %v", p, err)
+		}
+	}
+	if err := validateProtocol("rsync"); err == nil {
+		t.Error("validateProtocol(\"rsync\") expected an error")
+	}
+}
+
+func TestOpenSFTP(t *testing.T) {
+	tests := []struct {
+		name       string
+		port       int
+		protocol   string
+		wantClient bool
+		expectErr  bool
+	}{
+		{name: "Auto with sftp", port: sftpTestServer(), protocol: ProtocolAuto, wantClient: true},
+		{name: "Default with sftp", port: sftpTestServer(), wantClient: true},
+		{name: "Scp with sftp", port: sftpTestServer(), protocol: ProtocolSCP},
+		{name: "Auto falls back to scp", port: execTestServer(), protocol: ProtocolAuto},
+		{name: "Sftp not offered", port: execTestServer(), protocol: ProtocolSFTP, expectErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opt := common.Options{Protocol: tt.protocol}
+			tgt := testTarget(t, opt, fmt.Sprintf("127.0.0.1:%d", tt.port))
+			conn, err := dialHost(opt, tgt, &runEnv{config: execTestConfig()})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			client, err := openSFTP(opt, conn)
+			if (err != nil) != tt.expectErr {
+				t.Fatalf("openSFTP() error = %v, expectErr %v", err, tt.expectErr)
+			}
+			if (client != nil) != tt.wantClient {
+				t.Errorf("openSFTP() client = %v, want client %v", client, tt.wantClient)
+			}
+			if client != nil {
+				client.Close()
+			}
+		})
+	}
+}
+
+func TestExecuteCopySFTP(t *testing.T) {
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	src := t.TempDir()
+	files := map[string]string{"a.txt": "first\n", "nested/b.txt": "second\n"}
+	writeTree(t, filepath.Join(src, "tree"), files, mtime)
+	entry := fmt.Sprintf("127.0.0.1:%d", sftpTestServer())
+
+	tests := []struct {
+		name      string
+		src       string
+		dst       string // Relative to the destination directory
+		recursive bool
+		want      map[string]string
+		expectErr bool
+	}{
+		{name: "Single file to a new name", src: "tree/a.txt", dst: "copy.txt",
+			want: map[string]string{"copy.txt": "first\n"}},
+		{name: "Single file into a directory", src: "tree/a.txt",
+			want: map[string]string{"a.txt": "first\n"}},
+		{name: "Recursive directory", src: "tree", recursive: true,
+			want: map[string]string{"tree/a.txt": "first\n", "tree/nested/b.txt": "second\n"}},
+		{name: "Directory without recursive", src: "tree", expectErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := t.TempDir()
+			opt := common.Options{
+				Src:         filepath.Join(src, tt.src),
+				Dst:         filepath.Join(out, tt.dst),
+				IsRecursive: tt.recursive,
+				Protocol:    ProtocolSFTP,
+			}
+			res := executeCopy(opt, testTarget(t, opt, entry), &runEnv{config: execTestConfig()})
+			if tt.expectErr {
+				if res.err == nil {
+					t.Error("Expected an error, got nil")
+				}
+				return
+			}
+			if res.err != nil {
+				t.Fatalf("executeCopy() error: %v", res.err)
+			}
+			checkTree(t, out, tt.want, time.Time{})
+		})
+	}
+}
+
+func TestExecuteCopySFTPReplace(t *testing.T) {
+	out := t.TempDir()
+	dst := filepath.Join(out, "config")
+	if err := os.WriteFile(dst, []byte("old contents\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2021, 6, 7, 8, 9, 10, 0, time.UTC)
+	src := t.TempDir()
+	writeTree(t, src, map[string]string{"config": "new\n"}, mtime)
+
+	opt := common.Options{Src: filepath.Join(src, "config"), Dst: dst, Protocol: ProtocolAuto}
+	entry := fmt.Sprintf("127.0.0.1:%d", sftpTestServer())
+	res := executeCopy(opt, testTarget(t, opt, entry), &runEnv{config: execTestConfig()})
+	if res.err != nil {
+		t.Fatalf("executeCopy() error: %v", res.err)
+	}
+	checkTree(t, out, map[string]string{"config": "new\n"}, time.Time{})
+}
+
+func TestExecuteFetchSFTP(t *testing.T) {
+	mtime := time.Date(2019, 5, 6, 7, 8, 9, 0, time.UTC)
+	src := t.TempDir()
+	writeTree(t, src, map[string]string{"logs/a.log": "first\n", "logs/nested/b.log": "second\n"}, mtime)
+	entry := fmt.Sprintf("127.0.0.1:%d", sftpTestServer())
+
+	tests := []struct {
+		name      string
+		src       string
+		recursive bool
+		want      map[string]string
+		expectErr bool
+	}{
+		{name: "Single file", src: "logs/a.log",
+			want: map[string]string{"a.log": "first\n"}},
+		{name: "Recursive directory", src: "logs", recursive: true,
+			want: map[string]string{"logs/a.log": "first\n", "logs/nested/b.log": "second\n"}},
+		{name: "Directory without recursive", src: "logs", expectErr: true},
+		{name: "Missing file", src: "missing.log", expectErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := t.TempDir()
+			opt := common.Options{Src: filepath.Join(src, tt.src), Dst: out, IsRecursive: tt.recursive, Protocol: ProtocolSFTP, Preserve: true}
+			res := executeFetch(opt, testTarget(t, opt, entry), &runEnv{config: execTestConfig()})
+			if tt.expectErr {
+				if res.err == nil {
+					t.Error("Expected an error, got nil")
+				}
+				return
+			}
+			if res.err != nil {
+				t.Fatalf("executeFetch() error: %v", res.err)
+			}
+			checkTree(t, filepath.Join(out, hostDir(entry)), tt.want, mtime)
+		})
+	}
+}
+
+func TestExecuteCopySFTPSymlinks(t *testing.T) {
+	src := linkTree(t, false)
+	entry := fmt.Sprintf("127.0.0.1:%d", sftpTestServer())
+
+	tests := []struct {
+		name      string
+		symlinks  string
+		wantLinks map[string]string // Symlinks expected in the copy and their targets
+		wantFiles []string          // Regular files expected in the copy
+		missing   []string          // Entries that should not be copied
+	}{
+		{name: "Follow", symlinks: SymlinksFollow,
+			wantFiles: []string{"a.txt", "a.link", "sub/b.txt", "sub.link/b.txt"}},
+		{name: "Link", symlinks: SymlinksLink,
+			wantLinks: map[string]string{"a.link": "a.txt", "sub.link": "sub"},
+			wantFiles: []string{"a.txt", "sub/b.txt"}},
+		{name: "Skip", symlinks: SymlinksSkip,
+			wantFiles: []string{"a.txt", "sub/b.txt"},
+			missing:   []string{"a.link", "sub.link"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := t.TempDir()
+			opt := common.Options{Src: src, Dst: out, IsRecursive: true, Protocol: ProtocolSFTP, Symlinks: tt.symlinks}
+			res := executeCopy(opt, testTarget(t, opt, entry), &runEnv{config: execTestConfig()})
+			if res.err != nil {
+				t.Fatalf("executeCopy() error: %v", res.err)
+			}
+			copied := filepath.Join(out, "tree")
+			for name, target := range tt.wantLinks {
+				if got, err := os.Readlink(filepath.Join(copied, name)); err != nil || got != target {
+					t.Errorf("%s links to %q, %v, want %q", name, got, err, target)
+				}
+			}
+			for _, name := range tt.wantFiles {
+				if info, err := os.Lstat(filepath.Join(copied, name)); err != nil || !info.Mode().IsRegular() {
+					t.Errorf("%s is not a regular file: %v", name, err)
+				}
+			}
+			for _, name := range tt.missing {
+				if _, err := os.Lstat(filepath.Join(copied, name)); !os.IsNotExist(err) {
+					t.Errorf("%s should not have been copied: %v", name, err)
+				}
+			}
+		})
+	}
+}
+
+func TestExecuteCopySFTPPreserve(t *testing.T) {
+	src := t.TempDir()
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	atime := time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC)
+	writeTree(t, src, map[string]string{"a.txt": "first\n"}, mtime)
+	entry := fmt.Sprintf("127.0.0.1:%d", sftpTestServer())
+
+	for _, preserve := range []bool{false, true} {
+		t.Run(fmt.Sprintf("Preserve %v", preserve), func(t *testing.T) {
+			// Reading the source in a previous run may have updated its atime
+			if err := os.Chtimes(filepath.Join(src, "a.txt"), atime, mtime); err != nil {
+				t.Fatal(err)
+			}
+			out := t.TempDir()
+			opt := common.Options{Src: filepath.Join(src, "a.txt"), Dst: out, Protocol: ProtocolSFTP, Preserve: preserve}
+			res := executeCopy(opt, testTarget(t, opt, entry), &runEnv{config: execTestConfig()})
+			if res.err != nil {
+				t.Fatalf("executeCopy() error: %v", res.err)
+			}
+			info, err := os.Stat(filepath.Join(out, "a.txt"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Without preserve the server sets the times, as with scp
+			if info.ModTime().Equal(mtime) != preserve {
+				t.Errorf("mtime = %v, source mtime %v, preserve %v", info.ModTime(), mtime, preserve)
+			}
+			if got := fileAtime(info); got.Equal(atime) != preserve {
+				t.Errorf("atime = %v, source atime %v, preserve %v", got, atime, preserve)
+			}
+		})
+	}
+}
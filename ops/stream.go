@@ -0,0 +1,130 @@
+// Copyright © 2017 Ricardo Aravena <raravena80@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ops
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// hostColors are the ANSI foreground colors cycled through for host prefixes.
+var hostColors = []int{32, 33, 34, 35, 36, 31}
+
+// lockedWriter serialises writes from concurrent goroutines to w.
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (l *lockedWriter) Write(b []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Write(b)
+}
+
+// prefixWriter writes each complete line to out with prefix in front of it.
+// A trailing partial line is held back until more data or Flush arrives, so
+// lines from different hosts never interleave mid-line.
+type prefixWriter struct {
+	out    io.Writer
+	prefix string
+	buf    []byte
+}
+
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	p.buf = append(p.buf, b...)
+	var lines bytes.Buffer
+	for {
+		i := bytes.IndexByte(p.buf, '\n')
+		if i < 0 {
+			break
+		}
+		lines.WriteString(p.prefix)
+		lines.Write(p.buf[:i+1])
+		p.buf = p.buf[i+1:]
+	}
+	if lines.Len() > 0 {
+		if _, err := p.out.Write(lines.Bytes()); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// Flush writes any buffered partial line, terminated with a newline.
+func (p *prefixWriter) Flush() error {
+	if len(p.buf) == 0 {
+		return nil
+	}
+	_, err := p.out.Write([]byte(p.prefix + string(p.buf) + "\n"))
+	p.buf = nil
+	return err
+}
+
+// streamer writes remote output live as it arrives, one line at a time,
+// prefixed with the padded (and optionally colorized) hostname.
+type streamer struct {
+	stdout *lockedWriter
+	stderr *lockedWriter
+	width  int
+	color  bool
+	index  map[string]int
+}
+
+// newStreamer creates a streamer for hosts writing to stdout and stderr.
+// Host prefixes are padded to the longest hostname so output lines up.
+func newStreamer(hosts []string, stdout, stderr io.Writer, color bool) *streamer {
+	s := &streamer{
+		stdout: &lockedWriter{w: stdout},
+		stderr: &lockedWriter{w: stderr},
+		color:  color,
+		index:  make(map[string]int, len(hosts)),
+	}
+	for i, h := range hosts {
+		if len(h) > s.width {
+			s.width = len(h)
+		}
+		if _, ok := s.index[h]; !ok {
+			s.index[h] = i
+		}
+	}
+	return s
+}
+
+// prefix returns the line prefix for host.
+func (s *streamer) prefix(host string) string {
+	name := fmt.Sprintf("%-*s", s.width, host)
+	if s.color {
+		code := hostColors[s.index[host]%len(hostColors)]
+		name = fmt.Sprintf("\x1b[%dm%s\x1b[0m", code, name)
+	}
+	return name + " | "
+}
+
+// writers returns the stdout and stderr line writers for host.
+// Callers must Flush both once the remote command has finished.
+func (s *streamer) writers(host string) (*prefixWriter, *prefixWriter) {
+	prefix := s.prefix(host)
+	return &prefixWriter{out: s.stdout, prefix: prefix},
+		&prefixWriter{out: s.stderr, prefix: prefix}
+}
+
+// message writes a single prefixed line for host to stderr.
+func (s *streamer) message(host, msg string) {
+	_, errOut := s.writers(host)
+	errOut.Write([]byte(msg + "\n"))
+}
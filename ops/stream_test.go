@@ -0,0 +1,137 @@
+// Copyright © 2017 Ricardo Aravena <raravena80@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ops
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/raravena80/ya/common"
+)
+
+func TestPrefixWriter(t *testing.T) {
+	tests := []struct {
+		name     string
+		writes   []string
+		expected string
+	}{
+		{name: "Single line", writes: []string{"hello\n"}, expected: "h1 | hello\n"},
+		{name: "Multiple lines in one write", writes: []string{"a\nb\n"}, expected: "h1 | a\nh1 | b\n"},
+		{name: "Line split across writes", writes: []string{"hel", "lo\nwor", "ld\n"}, expected: "h1 | hello\nh1 | world\n"},
+		{name: "Partial line flushed", writes: []string{"no newline"}, expected: "h1 | no newline\n"},
+		{name: "Nothing written", writes: nil, expected: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			w := &prefixWriter{out: &buf, prefix: "h1 | "}
+			for _, s := range tt.writes {
+				n, err := w.Write([]byte(s))
+				if err != nil || n != len(s) {
+					t.Fatalf("Write(%q) = %d, %v", s, n, err)
+				}
+			}
+			w.Flush()
+			if buf.String() != tt.expected {
+				t.Errorf("output = %q, want %q", buf.String(), tt.expected)
+			}
+		})
+	}
+}
+
+func TestStreamerPrefix(t *testing.T) {
+	s := newStreamer([]string{"web1", "database"}, &bytes.Buffer{}, &bytes.Buffer{}, false)
+	if p := s.prefix("web1"); p != "web1     | " {
+		t.Errorf("prefix(web1) = %q, want padded prefix", p)
+	}
+	if p := s.prefix("database"); p != "database | " {
+		t.Errorf("prefix(database) = %q", p)
+	}
+
+	c := newStreamer([]string{"web1", "web2"}, &bytes.Buffer{}, &bytes.Buffer{}, true)
+	p1, p2 := c.prefix("web1"), c.prefix("web2")
+	if !strings.HasPrefix(p1, "\x1b[") || !strings.Contains(p1, "web1\x1b[0m") {
+		t.Errorf("Expected colorized prefix, got %q", p1)
+	}
+	if p1[:5] == p2[:5] {
+		t.Errorf("Expected different colors per host, got %q and %q", p1, p2)
+	}
+}
+
+func TestStreamerConcurrentLines(t *testing.T) {
+	var out bytes.Buffer
+	hosts := []string{"h1", "h2", "h3", "h4"}
+	s := newStreamer(hosts, &out, &bytes.Buffer{}, false)
+
+	var wg sync.WaitGroup
+	for _, h := range hosts {
+		wg.Add(1)
+		go func(host string) {
+			defer wg.Done()
+			w, _ := s.writers(host)
+			for i := 0; i < 200; i++ {
+				// Write each line in two pieces to exercise partial buffering
+				w.Write([]byte(fmt.Sprintf("%s-line-", host)))
+				w.Write([]byte(fmt.Sprintf("%d\n", i)))
+			}
+			w.Flush()
+		}(h)
+	}
+	wg.Wait()
+
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if len(lines) != 800 {
+		t.Fatalf("Expected 800 lines, got %d", len(lines))
+	}
+	for _, line := range lines {
+		var host, rest string
+		parts := strings.SplitN(line, " | ", 2)
+		if len(parts) != 2 {
+			t.Fatalf("Malformed line %q", line)
+		}
+		host, rest = parts[0], parts[1]
+		if !strings.HasPrefix(rest, host+"-line-") {
+			t.Errorf("Interleaved line %q", line)
+		}
+	}
+}
+
+func TestExecuteCmdStream(t *testing.T) {
+	var out, errOut bytes.Buffer
+	env := &runEnv{
+		config: execTestConfig(),
+		stream: newStreamer([]string{"127.0.0.1"}, &out, &errOut, false),
+	}
+	opt := common.Options{Port: execTestServer(), Cmd: "echo one; echo two; echo oops >&2; printf tail"}
+
+	res := executeCmd(opt, testTarget(t, opt, "127.0.0.1"), env)
+	if res.err != nil {
+		t.Fatalf("Unexpected error: %v", res.err)
+	}
+	expected := "127.0.0.1 | one\n127.0.0.1 | two\n127.0.0.1 | tail\n"
+	if out.String() != expected {
+		t.Errorf("streamed stdout = %q, want %q", out.String(), expected)
+	}
+	if errOut.String() != "127.0.0.1 | oops\n" {
+		t.Errorf("streamed stderr = %q", errOut.String())
+	}
+	// The structured result still carries the full output
+	if res.stdout != "one\ntwo\ntail" {
+		t.Errorf("result stdout = %q", res.stdout)
+	}
+}
@@ -0,0 +1,401 @@
+// Copyright © 2017 Ricardo Aravena <raravena80@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ops
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/raravena80/ya/common"
+	"golang.org/x/crypto/ssh"
+)
+
+// deleteBatch is the number of paths removed by a single remote rm.
+const deleteBatch = 200
+
+// shellQuote quotes s as a single word for a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// remoteFile is a file in the manifest of a remote tree.
+type remoteFile struct {
+	size  int64
+	mtime int64  // Modification time in Unix seconds
+	sum   string // Hex SHA-256 of the contents, only collected with --checksum
+}
+
+// manifest lists the files and directories of a tree by their slash-separated
+// paths relative to its root.
+type manifest struct {
+	files map[string]*remoteFile
+	dirs  map[string]bool
+}
+
+// manifestScript returns a shell script listing the tree at dst, which is
+// empty if dst does not exist. It prints a "d 0 0 <path>" line per directory,
+// including dst itself,
+// a "f <size> <mtime> <path>" line per file and, with checksum, a
+// "s <sha256> <path>" line per file. It works with GNU and BSD tools.
+func manifestScript(dst string, checksum bool) string {
+	script := "cd " + shellQuote(dst) + " 2>/dev/null || exit 0\n" +
+		"find . -type d -exec printf 'd 0 0 %s\\n' {} + || exit 1\n" +
+		"if stat -c %s . >/dev/null 2>&1; then\n" +
+		"  find . -type f -exec stat -c 'f %s %Y %n' {} + || exit 1\n" +
+		"else\n" +
+		"  find . -type f -exec stat -f 'f %z %m %N' {} + || exit 1\n" +
+		"fi\n"
+	if checksum {
+		script += "if command -v sha256sum >/dev/null 2>&1; then sum=sha256sum; else sum='shasum -a 256'; fi\n" +
+			"find . -type f -exec $sum {} + | sed 's/^/s /'\n"
+	}
+	return script
+}
+
+// parseManifest parses the output of a manifestScript.
+func parseManifest(out []byte) (*manifest, error) {
+	m := &manifest{files: map[string]*remoteFile{}, dirs: map[string]bool{}}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 4)
+		if fields[0] == "s" && len(fields) >= 3 {
+			// sha256sum separates the name with two spaces, or " *"
+			hash, name := fields[1], strings.TrimLeft(strings.Join(fields[2:], " "), " *")
+			if f, ok := m.files[manifestPath(name)]; ok {
+				f.sum = hash
+			}
+			continue
+		}
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("invalid manifest line %q", line)
+		}
+		switch fields[0] {
+		case "d":
+			m.dirs[manifestPath(fields[3])] = true
+		case "f":
+			size, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid size in manifest line %q", line)
+			}
+			mtime, err := strconv.ParseInt(fields[2], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid mtime in manifest line %q", line)
+			}
+			m.files[manifestPath(fields[3])] = &remoteFile{size: size, mtime: mtime}
+		default:
+			return nil, fmt.Errorf("invalid manifest line %q", line)
+		}
+	}
+	return m, scanner.Err()
+}
+
+// manifestPath turns a path printed by find into a manifest key.
+func manifestPath(name string) string {
+	return path.Clean(strings.TrimPrefix(name, "./"))
+}
+
+// localTree is a local tree to sync, with the infos of its files.
+type localTree struct {
+	files map[string]fs.FileInfo
+	paths map[string]string // Local path of every file
+	dirs  map[string]bool
+}
+
+// scanLocal lists the tree at root, following or skipping symlinks.
+func scanLocal(root string, info fs.FileInfo, symlinks string) (*localTree, error) {
+	tree := &localTree{files: map[string]fs.FileInfo{}, paths: map[string]string{}, dirs: map[string]bool{}}
+	err := walkTree(localFS{}, root, info, symlinks, treeVisitor{
+		enterDir: func(p, rel string, info fs.FileInfo) error {
+			tree.dirs[rel] = true
+			return nil
+		},
+		leaveDir: func(p, rel string, info fs.FileInfo) error {
+			return nil
+		},
+		file: func(p, rel string, info fs.FileInfo) error {
+			tree.files[rel], tree.paths[rel] = info, p
+			return nil
+		},
+		symlink: func(p, rel, target string, info fs.FileInfo) error {
+			return fmt.Errorf("cannot sync symlink %s as a link, use --symlinks follow or skip", p)
+		},
+	})
+	return tree, err
+}
+
+// fileSHA256 returns the hex SHA-256 of the contents of the file at p.
+func fileSHA256(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// syncPlan is what a sync has to do on a host.
+type syncPlan struct {
+	filter    treeFilter // The files to send and the directories leading to them
+	extra     []string   // Topmost remote paths missing locally
+	added     int
+	updated   int
+	unchanged int
+	deleted   int // Remote files missing locally
+}
+
+// planSync compares the local tree with the manifest of the remote one. With
+// checksum, files of the same size are compared by contents rather than by
+// modification time.
+func planSync(local *localTree, remote *manifest, checksum bool) (*syncPlan, error) {
+	p := &syncPlan{filter: treeFilter{dirs: map[string]bool{}, files: map[string]bool{}}}
+	for rel, info := range local.files {
+		rf, ok := remote.files[rel]
+		switch {
+		case !ok:
+			p.added++
+		case rf.size != info.Size():
+			p.updated++
+		case checksum:
+			sum, err := fileSHA256(local.paths[rel])
+			if err != nil {
+				return nil, err
+			}
+			if sum == rf.sum {
+				p.unchanged++
+				continue
+			}
+			p.updated++
+		case rf.mtime != info.ModTime().Unix():
+			p.updated++
+		default:
+			p.unchanged++
+			continue
+		}
+		p.filter.files[rel] = true
+		p.needDir(path.Dir(rel))
+	}
+	for rel := range local.dirs {
+		if !remote.dirs[rel] {
+			p.needDir(rel)
+		}
+	}
+
+	// A remote path missing locally is only removed itself if its parent
+	// directory is not removed too
+	extraDirs := map[string]bool{}
+	for rel := range remote.dirs {
+		if !local.dirs[rel] {
+			extraDirs[rel] = true
+		}
+	}
+	for rel := range remote.files {
+		if _, ok := local.files[rel]; ok {
+			continue
+		}
+		p.deleted++
+		if !underAny(rel, extraDirs) {
+			p.extra = append(p.extra, rel)
+		}
+	}
+	for rel := range extraDirs {
+		if !underAny(rel, extraDirs) {
+			p.extra = append(p.extra, rel)
+		}
+	}
+	sort.Strings(p.extra)
+	return p, nil
+}
+
+// underAny reports whether rel is below one of dirs.
+func underAny(rel string, dirs map[string]bool) bool {
+	for dir := path.Dir(rel); dir != "."; dir = path.Dir(dir) {
+		if dirs[dir] {
+			return true
+		}
+	}
+	return false
+}
+
+// needDir marks the directory rel and its parents to be walked.
+func (p *syncPlan) needDir(rel string) {
+	for {
+		p.filter.dirs[rel] = true
+		if rel == "." {
+			return
+		}
+		rel = path.Dir(rel)
+	}
+}
+
+// String reports the counts of the plan.
+func (p *syncPlan) String() string {
+	return fmt.Sprintf("Added %d, updated %d, deleted %d, unchanged %d files\n",
+		p.added, p.updated, p.deleted, p.unchanged)
+}
+
+// runRemote runs cmd on the host and returns its output. The error includes
+// what the command wrote to stderr.
+func runRemote(opt common.Options, conn *ssh.Client, cmd string) ([]byte, error) {
+	session, err := conn.NewSession()
+	if err != nil {
+		//go:nocovline // NewSession failure hard to test without mock SSH server
+		return nil, fmt.Errorf("failed to create SSH session: %w", err)
+	}
+	defer session.Close()
+
+	var stdout, stderr bytes.Buffer
+	session.Stdout = &stdout
+	session.Stderr = &stderr
+	err = session.Start(cmd)
+	if err == nil {
+		err = waitWithTimeout(sessionProcess{session, conn}, commandTimeout(opt), session.Wait)
+	}
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%s: %w", msg, err)
+		}
+		return nil, err
+	}
+	return stdout.Bytes(), nil
+}
+
+// removeRemote removes the paths, relative to dst, from the host.
+func removeRemote(opt common.Options, conn *ssh.Client, dst string, paths []string) error {
+	for len(paths) > 0 {
+		n := min(len(paths), deleteBatch)
+		quoted := make([]string, n)
+		for i, p := range paths[:n] {
+			quoted[i] = shellQuote(p)
+		}
+		cmd := fmt.Sprintf("cd %s && rm -rf -- %s", shellQuote(dst), strings.Join(quoted, " "))
+		if _, err := runRemote(opt, conn, cmd); err != nil {
+			return fmt.Errorf("failed to delete extraneous files: %w", err)
+		}
+		paths = paths[n:]
+	}
+	return nil
+}
+
+// executeSync makes the remote directory opt.Dst a copy of the local
+// directory opt.Src, sending only the files that are new or changed. Files
+// are compared by size and modification time, or by SHA-256 with
+// opt.Checksum, and remote files missing locally are removed with
+// opt.Delete. Times are always preserved, so the next sync can compare them.
+func executeSync(opt common.Options, t target, env *runEnv) executeResult {
+	// Validate source path for security
+	if err := validatePath(opt.Src); err != nil {
+		return makeExecResult(t.name, "", err)
+	}
+	// Validate destination path for security
+	if err := validatePath(opt.Dst); err != nil {
+		return makeExecResult(t.name, "", err)
+	}
+	if opt.Dst == "" {
+		return makeExecResult(t.name, "", fmt.Errorf("sync needs a destination directory"))
+	}
+	info, err := os.Stat(opt.Src)
+	if err != nil {
+		return makeExecResult(t.name, "", err)
+	}
+	if !info.IsDir() {
+		return makeExecResult(t.name, "", fmt.Errorf("sync needs a source directory, %s is not one", opt.Src))
+	}
+	opt.Preserve = true
+	local, err := scanLocal(opt.Src, info, opt.Symlinks)
+	if err != nil {
+		return makeExecResult(t.name, "", err)
+	}
+
+	conn, err := dialHost(opt, t, env)
+	if err != nil {
+		return makeExecResult(t.name, "", err)
+	}
+	defer conn.Close()
+
+	out, err := runRemote(opt, conn, "sh -c "+shellQuote(manifestScript(opt.Dst, opt.Checksum)))
+	if err != nil {
+		return makeExecResult(t.name, "", fmt.Errorf("failed to list %s: %w", opt.Dst, err))
+	}
+	remote, err := parseManifest(out)
+	if err != nil {
+		return makeExecResult(t.name, "", err)
+	}
+	plan, err := planSync(local, remote, opt.Checksum)
+	if err != nil {
+		return makeExecResult(t.name, "", err)
+	}
+
+	if opt.Delete {
+		if err := removeRemote(opt, conn, opt.Dst, plan.extra); err != nil {
+			return makeExecResult(t.name, "", err)
+		}
+	} else {
+		plan.deleted = 0
+	}
+	if len(plan.filter.dirs) > 0 {
+		prog := env.progress.host(t.name)
+		for rel := range plan.filter.files {
+			prog.expect(local.files[rel].Size())
+		}
+		err = syncSend(opt, conn, info, &plan.filter, prog)
+	}
+	return makeExecResult(t.name, plan.String(), err)
+}
+
+// syncSend sends the parts of opt.Src selected by filter into opt.Dst, over
+// SFTP or scp as selected by opt.Protocol, counting the bytes sent in prog.
+func syncSend(opt common.Options, conn *ssh.Client, info fs.FileInfo, filter *treeFilter, prog *hostProgress) error {
+	client, err := openSFTP(opt, conn)
+	if err != nil {
+		return err
+	}
+	if client != nil {
+		defer client.Close()
+		return waitWithTimeout(sftpProcess{client, conn}, commandTimeout(opt), func() error {
+			_, err := sftpPutTree(client, opt, info, opt.Dst, filter, prog, nil)
+			return err
+		})
+	}
+
+	if err := validateSCPPath(DefaultSCPPath); err != nil {
+		return err
+	}
+	// The entries of opt.Src are sent straight into opt.Dst, which has to
+	// exist for the remote scp to treat it as a directory
+	dst := shellQuote(opt.Dst)
+	scpCmd := fmt.Sprintf("mkdir -p -- %s && %s -qprt %s", dst, DefaultSCPPath, dst)
+	return runSCPSink(opt, conn, scpCmd, prog, func(source *scpSource) error {
+		return source.sendTree(opt.Src, info, false, filter)
+	})
+}
@@ -0,0 +1,252 @@
+// Copyright © 2017 Ricardo Aravena <raravena80@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ops
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/raravena80/ya/common"
+)
+
+func TestShellQuote(t *testing.T) {
+	for _, s := range []string{"plain", "with space", "it's", `$HOME "x" \n`, ""} {
+		out, err := exec.Command("sh", "-c", "printf %s "+shellQuote(s)).Output()
+		if err != nil || string(out) != s {
+			t.Errorf("shellQuote(%q) printed %q, %v", s, out, err)
+		}
+	}
+}
+
+func TestParseManifest(t *testing.T) {
+	out := "d 0 0 .\nd 0 0 ./conf\n" +
+		"f 12 1500000000 ./conf/app yaml\nf 0 1600000000 ./empty\n" +
+		"s 2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae  ./conf/app yaml\n" +
+		"s e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855 *./empty\n"
+	m, err := parseManifest([]byte(out))
+	if err != nil {
+		t.Fatalf("parseManifest() error: %v", err)
+	}
+	wantDirs := map[string]bool{".": true, "conf": true}
+	if !reflect.DeepEqual(m.dirs, wantDirs) {
+		t.Errorf("dirs = %v, want %v", m.dirs, wantDirs)
+	}
+	wantFiles := map[string]*remoteFile{
+		"conf/app yaml": {size: 12, mtime: 1500000000, sum: "2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae"},
+		"empty":         {size: 0, mtime: 1600000000, sum: "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"},
+	}
+	if !reflect.DeepEqual(m.files, wantFiles) {
+		t.Errorf("files = %v, want %v", m.files, wantFiles)
+	}
+
+	for _, bad := range []string{"x 1 2 ./a\n", "f one 2 ./a\n", "f 1 two ./a\n", "f 1\n"} {
+		if _, err := parseManifest([]byte(bad)); err == nil {
+			t.Errorf("parseManifest(%q) expected an error", bad)
+		}
+	}
+}
+
+func TestManifestScript(t *testing.T) {
+	root := t.TempDir()
+	mtime := time.Unix(1500000000, 0)
+	writeTree(t, root, map[string]string{"a.txt": "foo", "sub/b c.txt": ""}, mtime)
+
+	for _, checksum := range []bool{false, true} {
+		out, err := exec.Command("sh", "-c", manifestScript(root, checksum)).Output()
+		if err != nil {
+			t.Fatalf("manifest script error: %v", err)
+		}
+		m, err := parseManifest(out)
+		if err != nil {
+			t.Fatalf("parseManifest() error: %v", err)
+		}
+		want := map[string]*remoteFile{
+			"a.txt":       {size: 3, mtime: 1500000000},
+			"sub/b c.txt": {size: 0, mtime: 1500000000},
+		}
+		if checksum {
+			want["a.txt"].sum = "2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae"
+			want["sub/b c.txt"].sum = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+		}
+		if !reflect.DeepEqual(m.files, want) {
+			t.Errorf("checksum %v: files = %v, want %v", checksum, m.files, want)
+		}
+		if !m.dirs["."] || !m.dirs["sub"] || len(m.dirs) != 2 {
+			t.Errorf("checksum %v: dirs = %v", checksum, m.dirs)
+		}
+	}
+
+	out, err := exec.Command("sh", "-c", manifestScript(filepath.Join(root, "missing"), false)).Output()
+	if err != nil || len(out) != 0 {
+		t.Errorf("manifest of a missing directory = %q, %v, want empty", out, err)
+	}
+}
+
+func TestPlanSync(t *testing.T) {
+	root := t.TempDir()
+	mtime := time.Unix(1500000000, 0)
+	writeTree(t, root, map[string]string{
+		"same.txt": "same", "changed.txt": "new", "touched.txt": "abc", "new/added.txt": "added",
+	}, mtime)
+	info, err := os.Stat(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	local, err := scanLocal(root, info, SymlinksFollow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote := &manifest{
+		dirs: map[string]bool{".": true, "old": true, "old/deeper": true},
+		files: map[string]*remoteFile{
+			"same.txt":         {size: 4, mtime: 1500000000, sum: "0967115f2813a3541eaef77de9d9d5773f1c0c04314b0bbfe4ff3b3b1c55b5d5"},
+			"changed.txt":      {size: 7, mtime: 1500000000},
+			"touched.txt":      {size: 3, mtime: 1400000000, sum: "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"},
+			"stale.txt":        {size: 1, mtime: 1},
+			"old/deeper/x.txt": {size: 1, mtime: 1},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		checksum bool
+		files    []string
+		updated  int
+		same     int
+	}{
+		{name: "Size and mtime", files: []string{"changed.txt", "new/added.txt", "touched.txt"}, updated: 2, same: 1},
+		{name: "Checksum", checksum: true, files: []string{"changed.txt", "new/added.txt"}, updated: 1, same: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plan, err := planSync(local, remote, tt.checksum)
+			if err != nil {
+				t.Fatalf("planSync() error: %v", err)
+			}
+			var files []string
+			for rel := range plan.filter.files {
+				files = append(files, rel)
+			}
+			sort.Strings(files)
+			if !reflect.DeepEqual(files, tt.files) {
+				t.Errorf("files to send = %v, want %v", files, tt.files)
+			}
+			if !plan.filter.dirs["."] || !plan.filter.dirs["new"] {
+				t.Errorf("dirs to walk = %v, want . and new", plan.filter.dirs)
+			}
+			if plan.added != 1 || plan.updated != tt.updated || plan.unchanged != tt.same || plan.deleted != 2 {
+				t.Errorf("counts = %s", plan)
+			}
+			if want := []string{"old", "stale.txt"}; !reflect.DeepEqual(plan.extra, want) {
+				t.Errorf("extra = %v, want %v", plan.extra, want)
+			}
+		})
+	}
+}
+
+func TestExecuteSync(t *testing.T) {
+	servers := []struct {
+		name     string
+		port     int
+		protocol string
+	}{
+		{name: "scp", port: execTestServer(), protocol: ProtocolSCP},
+		{name: "sftp", port: sftpTestServer(), protocol: ProtocolSFTP},
+	}
+	for _, srv := range servers {
+		t.Run(srv.name, func(t *testing.T) {
+			src := t.TempDir()
+			dst := filepath.Join(t.TempDir(), "deploy")
+			mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+			files := map[string]string{"a.txt": "first\n", "conf/b.txt": "second\n"}
+			writeTree(t, src, files, mtime)
+			entry := fmt.Sprintf("127.0.0.1:%d", srv.port)
+
+			sync := func(opt common.Options) string {
+				t.Helper()
+				opt.Src, opt.Dst, opt.Protocol = src, dst, srv.protocol
+				res := executeSync(opt, testTarget(t, opt, entry), &runEnv{config: execTestConfig()})
+				if res.err != nil {
+					t.Fatalf("executeSync() error: %v", res.err)
+				}
+				return res.stdout
+			}
+			expect := func(got, want string) {
+				t.Helper()
+				if !strings.Contains(got, want) {
+					t.Errorf("executeSync() = %q, want %q", got, want)
+				}
+			}
+
+			expect(sync(common.Options{}), "Added 2, updated 0, deleted 0, unchanged 0")
+			checkTree(t, dst, files, mtime)
+			expect(sync(common.Options{}), "Added 0, updated 0, deleted 0, unchanged 2")
+
+			// Same size and contents with a new mtime only differs without --checksum
+			later := mtime.Add(time.Hour)
+			if err := os.Chtimes(filepath.Join(src, "a.txt"), later, later); err != nil {
+				t.Fatal(err)
+			}
+			expect(sync(common.Options{Checksum: true}), "Added 0, updated 0, deleted 0, unchanged 2")
+			expect(sync(common.Options{}), "Added 0, updated 1, deleted 0, unchanged 1")
+
+			writeTree(t, dst, map[string]string{"stale.txt": "x", "old/c.txt": "y"}, mtime)
+			writeTree(t, src, map[string]string{"conf/b.txt": "changed\n"}, mtime)
+			expect(sync(common.Options{}), "Added 0, updated 1, deleted 0, unchanged 1")
+			if _, err := os.Stat(filepath.Join(dst, "stale.txt")); err != nil {
+				t.Errorf("stale.txt removed without --delete: %v", err)
+			}
+			expect(sync(common.Options{Delete: true}), "Added 0, updated 0, deleted 2, unchanged 2")
+			for _, name := range []string{"stale.txt", "old"} {
+				if _, err := os.Stat(filepath.Join(dst, name)); !os.IsNotExist(err) {
+					t.Errorf("%s not deleted: %v", name, err)
+				}
+			}
+			checkTree(t, dst, map[string]string{"conf/b.txt": "changed\n"}, mtime)
+		})
+	}
+}
+
+func TestExecuteSyncErrors(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	entry := fmt.Sprintf("127.0.0.1:%d", execTestServer())
+	tests := []struct {
+		name   string
+		opt    common.Options
+		errMsg string
+	}{
+		{name: "Source is a file", opt: common.Options{Src: file, Dst: "/tmp/x"}, errMsg: "needs a source directory"},
+		{name: "No destination", opt: common.Options{Src: t.TempDir()}, errMsg: "needs a destination"},
+		{name: "Links", opt: common.Options{Src: linkTree(t, false), Dst: "/tmp/x", Symlinks: SymlinksLink}, errMsg: "cannot sync symlink"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := executeSync(tt.opt, testTarget(t, tt.opt, entry), &runEnv{config: execTestConfig()})
+			if res.err == nil || !strings.Contains(res.err.Error(), tt.errMsg) {
+				t.Errorf("executeSync() error = %v, want %q", res.err, tt.errMsg)
+			}
+		})
+	}
+}
@@ -0,0 +1,279 @@
+// Copyright © 2017 Ricardo Aravena <raravena80@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ops
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	homedir "github.com/mitchellh/go-homedir"
+	"github.com/raravena80/ya/common"
+	"golang.org/x/crypto/ssh"
+)
+
+// target is a single host to run on, with its connection settings resolved.
+type target struct {
+	name string // Machine entry the host is reported as
+	host string // Hostname or IP address to dial
+	port int
+	user string
+	key  string // Private key for this host only, empty to use the global keys
+	jump string // Comma-separated jump hosts to connect through, if any
+}
+
+// addr returns the host:port address to dial, bracketing IPv6 literals.
+func (t target) addr() string {
+	return net.JoinHostPort(t.host, strconv.Itoa(t.port))
+}
+
+// parseTarget splits a machine entry of the form [user@]host[:port]. IPv6
+// literals must be bracketed to carry a port, e.g. deploy@[2001:db8::1]:2222;
+// a bare IPv6 literal is taken as a host without a port. A zero port means
+// the entry does not set one.
+func parseTarget(entry string) (user, host string, port int, err error) {
+	host = entry
+	if i := strings.LastIndex(host, "@"); i >= 0 {
+		user, host = host[:i], host[i+1:]
+		if user == "" {
+			return "", "", 0, fmt.Errorf("invalid host %q: empty user", entry)
+		}
+	}
+
+	var portStr string
+	hasPort := false
+	switch {
+	case strings.HasPrefix(host, "["):
+		end := strings.Index(host, "]")
+		if end < 0 {
+			return "", "", 0, fmt.Errorf("invalid host %q: missing ']'", entry)
+		}
+		rest := host[end+1:]
+		host = host[1:end]
+		if rest != "" {
+			if !strings.HasPrefix(rest, ":") {
+				return "", "", 0, fmt.Errorf("invalid host %q: unexpected %q after ']'", entry, rest)
+			}
+			portStr, hasPort = rest[1:], true
+		}
+	case strings.Count(host, ":") == 1:
+		host, portStr, hasPort = strings.Cut(host, ":")
+	}
+
+	if host == "" {
+		return "", "", 0, fmt.Errorf("invalid host %q: empty hostname", entry)
+	}
+	if hasPort {
+		port, err = strconv.Atoi(portStr)
+		if err != nil || port <= 0 || port > 65535 {
+			return "", "", 0, fmt.Errorf("invalid host %q: bad port %q", entry, portStr)
+		}
+	}
+	return user, host, port, nil
+}
+
+// defaultPort is the SSH port used when nothing else sets one.
+const defaultPort = 22
+
+// defaultUser returns the local user name, used when nothing else sets one.
+func defaultUser() string {
+	if u := os.Getenv("LOGNAME"); u != "" {
+		return u
+	}
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return ""
+}
+
+// defaultKeyNames are the private keys in ~/.ssh tried when no key is
+// configured, in order of preference.
+var defaultKeyNames = []string{"id_ed25519", "id_ecdsa", "id_rsa"}
+
+// defaultKeyFiles returns the default private keys that exist.
+func defaultKeyFiles() []string {
+	home, err := homedir.Dir()
+	if err != nil {
+		return nil
+	}
+	var files []string
+	for _, name := range defaultKeyNames {
+		f := filepath.Join(home, ".ssh", name)
+		if _, err := os.Stat(f); err == nil {
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+// loadSSHConfig loads the OpenSSH client config named by path. An empty
+// path selects ~/.ssh/config, which may be missing; "none" disables it.
+func loadSSHConfig(path string) (*common.SSHConfig, error) {
+	switch path {
+	case "none":
+		return nil, nil
+	case "":
+		home, err := homedir.Dir()
+		if err != nil {
+			return nil, nil
+		}
+		cfg, err := common.LoadSSHConfig(filepath.Join(home, ".ssh", "config"))
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return cfg, err
+	}
+	return common.LoadSSHConfig(path)
+}
+
+// newTarget resolves the connection settings of a machine entry. From
+// highest to lowest precedence they come from the entry itself, the host's
+// inventory settings, explicit options, the matching ssh_config stanza and
+// finally the defaults.
+func newTarget(opt common.Options, sshConfig *common.SSHConfig, entry string) (target, error) {
+	user, host, port, err := parseTarget(entry)
+	if err != nil {
+		return target{}, err
+	}
+
+	t := target{name: entry, host: host, port: defaultPort, user: defaultUser()}
+	hc := sshConfig.Lookup(host)
+	if hc.HostName != "" {
+		t.host = hc.HostName
+	}
+	if hc.Port != 0 {
+		t.port = hc.Port
+	}
+	if hc.User != "" {
+		t.user = hc.User
+	}
+	if len(opt.Keys) == 0 {
+		for _, f := range hc.IdentityFiles {
+			if _, err := os.Stat(f); err == nil {
+				t.key = f
+				break
+			}
+		}
+	}
+	t.jump = hc.ProxyJump
+
+	if opt.Jump != "" {
+		t.jump = opt.Jump
+	}
+	if opt.Port != 0 {
+		t.port = opt.Port
+	}
+	if opt.User != "" {
+		t.user = opt.User
+	}
+
+	h, ok := opt.Hosts[entry]
+	if !ok {
+		h, ok = opt.Hosts[host]
+	}
+	if ok {
+		if h.Address != "" {
+			t.host = h.Address
+		}
+		if h.Port != 0 {
+			t.port = h.Port
+		}
+		if h.User != "" {
+			t.user = h.User
+		}
+		if h.Key != "" {
+			t.key = h.Key
+		}
+	}
+
+	if user != "" {
+		t.user = user
+	}
+	if port != 0 {
+		t.port = port
+	}
+	return t, nil
+}
+
+// newJumpTarget resolves the connection settings of a jump host from its
+// spec and the matching ssh_config stanza only. Like OpenSSH's -l and -p,
+// --user, --port and the inventory settings apply to the destinations and
+// never to the jump hosts in front of them.
+func newJumpTarget(opt common.Options, sshConfig *common.SSHConfig, hop string) (target, error) {
+	opt.User, opt.Port, opt.Hosts, opt.Jump = "", 0, nil, ""
+	return newTarget(opt, sshConfig, hop)
+}
+
+// clientConfig returns the client config for t, which differs from the
+// shared one when t has its own user or key.
+func (env *runEnv) clientConfig(opt common.Options, t target) *ssh.ClientConfig {
+	if t.user == env.config.User && t.key == "" {
+		return env.config
+	}
+	config := *env.config
+	config.User = t.user
+	if t.key != "" {
+		config.Auth = append([]ssh.AuthMethod{env.keyAuth(t.key)}, env.passAuth...)
+	}
+	return &config
+}
+
+// dialHost connects to t, directly or through its jump hosts. Connections to
+// jump hosts are shared with every other host of the run using them. When
+// authentication fails, the reason a user certificate was left out is
+// reported with it. Cancelling the run abandons the dial and closes the
+// connection, which stops whatever runs over it.
+func dialHost(opt common.Options, t target, env *runEnv) (*ssh.Client, error) {
+	client, err := dialTarget(opt, t, env)
+	if err != nil && strings.Contains(err.Error(), "unable to authenticate") {
+		if certErr := env.certError(t); certErr != nil {
+			err = fmt.Errorf("%w: %v", err, certErr)
+		}
+	}
+	if err == nil && env.ctx != nil {
+		stop := context.AfterFunc(env.ctx, func() { client.Close() })
+		go func() {
+			client.Wait()
+			stop()
+		}()
+	}
+	return client, err
+}
+
+// dialTarget connects to t for dialHost.
+func dialTarget(opt common.Options, t target, env *runEnv) (*ssh.Client, error) {
+	config := env.clientConfig(opt, t)
+	if t.jump == "" {
+		return dialVia(env.ctx, nil, t.addr(), config)
+	}
+	via, err := env.jumps.client(splitJumps(t.jump), func(via *ssh.Client, hop string) (*ssh.Client, error) {
+		jt, err := newJumpTarget(opt, env.sshConfig, hop)
+		if err != nil {
+			return nil, err
+		}
+		return dialVia(env.ctx, via, jt.addr(), env.clientConfig(opt, jt))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return dialVia(env.ctx, via, t.addr(), config)
+}
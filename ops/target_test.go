@@ -0,0 +1,317 @@
+// Copyright © 2017 Ricardo Aravena <raravena80@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ops
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	homedir "github.com/mitchellh/go-homedir"
+	"github.com/raravena80/ya/common"
+)
+
+func TestParseTarget(t *testing.T) {
+	tests := []struct {
+		entry     string
+		user      string
+		host      string
+		port      int
+		expectErr bool
+	}{
+		{entry: "host1", host: "host1"},
+		{entry: "host1:2222", host: "host1", port: 2222},
+		{entry: "deploy@host1", user: "deploy", host: "host1"},
+		{entry: "deploy@host1:2222", user: "deploy", host: "host1", port: 2222},
+		{entry: "10.0.0.1:22", host: "10.0.0.1", port: 22},
+		{entry: "[2001:db8::1]:2222", host: "2001:db8::1", port: 2222},
+		{entry: "root@[2001:db8::1]", user: "root", host: "2001:db8::1"},
+		{entry: "2001:db8::1", host: "2001:db8::1"},
+		{entry: "fe80::", host: "fe80::"},
+		{entry: "me@corp@host1", user: "me@corp", host: "host1"},
+		{entry: "host1:", expectErr: true},
+		{entry: "host1:ssh", expectErr: true},
+		{entry: "host1:70000", expectErr: true},
+		{entry: "@host1", expectErr: true},
+		{entry: "deploy@", expectErr: true},
+		{entry: "[2001:db8::1", expectErr: true},
+		{entry: "[2001:db8::1]2222", expectErr: true},
+		{entry: "[::1]:", expectErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.entry, func(t *testing.T) {
+			user, host, port, err := parseTarget(tt.entry)
+			if tt.expectErr {
+				if err == nil {
+					t.Errorf("Expected error, got %q %q %d", user, host, port)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if user != tt.user || host != tt.host || port != tt.port {
+				t.Errorf("parseTarget() = %q %q %d, want %q %q %d",
+					user, host, port, tt.user, tt.host, tt.port)
+			}
+		})
+	}
+}
+
+func TestNewTarget(t *testing.T) {
+	opt := common.Options{
+		User: "global",
+		Port: 22,
+		Hosts: map[string]common.Host{
+			"web1": {Name: "web1", Address: "10.0.0.1", User: "inv", Port: 2200, Key: "/keys/web"},
+		},
+	}
+	tests := []struct {
+		entry string
+		want  target
+	}{
+		{entry: "host1",
+			want: target{name: "host1", host: "host1", port: 22, user: "global"}},
+		{entry: "web1",
+			want: target{name: "web1", host: "10.0.0.1", port: 2200, user: "inv", key: "/keys/web"}},
+		{entry: "admin@web1:2222",
+			want: target{name: "admin@web1:2222", host: "10.0.0.1", port: 2222, user: "admin", key: "/keys/web"}},
+		{entry: "[::1]:2022",
+			want: target{name: "[::1]:2022", host: "::1", port: 2022, user: "global"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.entry, func(t *testing.T) {
+			got, err := newTarget(opt, nil, tt.entry)
+			if err != nil {
+				t.Fatalf("newTarget() error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("newTarget() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTargetAddr(t *testing.T) {
+	tests := []struct {
+		t    target
+		addr string
+	}{
+		{t: target{host: "host1", port: 22}, addr: "host1:22"},
+		{t: target{host: "10.0.0.1", port: 2222}, addr: "10.0.0.1:2222"},
+		{t: target{host: "2001:db8::1", port: 22}, addr: "[2001:db8::1]:22"},
+	}
+	for _, tt := range tests {
+		if got := tt.t.addr(); got != tt.addr {
+			t.Errorf("addr() = %q, want %q", got, tt.addr)
+		}
+	}
+}
+
+func TestExecuteCmd_TargetPort(t *testing.T) {
+	// The global port is wrong; the port in the entry must be used
+	opt := common.Options{Port: 1, User: "testuser", Cmd: "echo ok"}
+	entry := fmt.Sprintf("deploy@127.0.0.1:%d", execTestServer())
+
+	res := executeCmd(opt, testTarget(t, opt, entry), &runEnv{config: execTestConfig()})
+	if res.err != nil {
+		t.Fatalf("executeCmd() error: %v", res.err)
+	}
+	if res.host != entry || res.stdout != "ok\n" {
+		t.Errorf("executeCmd() = host %q stdout %q, want %q and ok", res.host, res.stdout, entry)
+	}
+}
+
+func TestSSHSessionInvalidTarget(t *testing.T) {
+	ok := SSHSession(
+		common.SetMachines([]string{"host1:notaport"}),
+		common.SetOp("ssh"),
+		common.SetCmd("true"),
+		common.SetInsecureHost(true),
+		common.SetOutputFormat("json"),
+	)
+	if ok {
+		t.Error("Expected failure for an invalid machine entry")
+	}
+}
+
+// writeSSHConfig writes an ssh_config file and returns it parsed.
+func writeSSHConfig(t *testing.T, content string) *common.SSHConfig {
+	path := filepath.Join(t.TempDir(), "config")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := common.LoadSSHConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func TestNewTarget_SSHConfig(t *testing.T) {
+	cfg := writeSSHConfig(t, `
+Host web1
+    HostName 10.0.0.9
+    User cfguser
+    Port 2022
+    ProxyJump bastion:2200
+`)
+	tests := []struct {
+		name  string
+		opt   common.Options
+		entry string
+		want  target
+	}{
+		{name: "ssh_config applies",
+			entry: "web1",
+			want:  target{name: "web1", host: "10.0.0.9", port: 2022, user: "cfguser", jump: "bastion:2200"}},
+		{name: "Explicit options win",
+			opt:   common.Options{User: "flaguser", Port: 22},
+			entry: "web1",
+			want:  target{name: "web1", host: "10.0.0.9", port: 22, user: "flaguser", jump: "bastion:2200"}},
+		{name: "Entry wins over everything",
+			opt:   common.Options{User: "flaguser", Port: 22},
+			entry: "me@web1:2222",
+			want:  target{name: "me@web1:2222", host: "10.0.0.9", port: 2222, user: "me", jump: "bastion:2200"}},
+		{name: "Defaults for unknown hosts",
+			entry: "other",
+			want:  target{name: "other", host: "other", port: defaultPort, user: defaultUser()}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := newTarget(tt.opt, cfg, tt.entry)
+			if err != nil {
+				t.Fatalf("newTarget() error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("newTarget() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewJumpTarget(t *testing.T) {
+	cfg := writeSSHConfig(t, `
+Host bastion
+    User jumper
+`)
+	// Options and inventory settings meant for the destinations
+	opt := common.Options{User: "deploy", Port: 2222, Jump: "outer",
+		Hosts: map[string]common.Host{"bastion": {Address: "10.0.0.1", Port: 2200}}}
+	tests := []struct {
+		hop  string
+		want target
+	}{
+		{hop: "bastion", want: target{name: "bastion", host: "bastion", port: defaultPort, user: "jumper"}},
+		{hop: "admin@other:2200", want: target{name: "admin@other:2200", host: "other", port: 2200, user: "admin"}},
+	}
+	for _, tt := range tests {
+		got, err := newJumpTarget(opt, cfg, tt.hop)
+		if err != nil {
+			t.Fatalf("newJumpTarget(%q) error: %v", tt.hop, err)
+		}
+		if got != tt.want {
+			t.Errorf("newJumpTarget(%q) = %+v, want %+v", tt.hop, got, tt.want)
+		}
+	}
+}
+
+func TestExecuteCmd_SSHConfigProxyJump(t *testing.T) {
+	port := execTestServer()
+	cfg := writeSSHConfig(t, fmt.Sprintf(`
+Host behind
+    HostName 127.0.0.1
+    Port %d
+    ProxyJump jump1,jump2
+
+Host jump*
+    HostName 127.0.0.1
+    Port %d
+
+Host broken
+    HostName 127.0.0.1
+    Port %d
+    ProxyJump 127.0.0.1:1
+`, port, port, port))
+	opt := common.Options{Cmd: "echo through"}
+	env := &runEnv{config: execTestConfig(), sshConfig: cfg}
+	defer env.jumps.close()
+
+	tgt, err := newTarget(opt, cfg, "behind")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := executeCmd(opt, tgt, env)
+	if res.err != nil {
+		t.Fatalf("executeCmd() through jump hosts error: %v", res.err)
+	}
+	if res.stdout != "through\n" {
+		t.Errorf("stdout = %q, want %q", res.stdout, "through\n")
+	}
+
+	tgt, err = newTarget(opt, cfg, "broken")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res = executeCmd(opt, tgt, env)
+	if res.err == nil || !strings.Contains(res.err.Error(), "jump host") {
+		t.Errorf("Expected jump host error, got %v", res.err)
+	}
+}
+
+func TestLoadSSHConfigDefault(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	homedir.DisableCache = true
+	defer func() { homedir.DisableCache = false }()
+	cfg, err := loadSSHConfig("")
+	if err != nil || cfg != nil {
+		t.Errorf("loadSSHConfig() with no ~/.ssh/config = %v, %v, want nil, nil", cfg, err)
+	}
+	if cfg, err := loadSSHConfig("none"); err != nil || cfg != nil {
+		t.Errorf("loadSSHConfig(none) = %v, %v, want nil, nil", cfg, err)
+	}
+	if _, err := loadSSHConfig(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("Expected error for a missing explicit config file")
+	}
+}
+
+func TestDefaultKeyFiles(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	homedir.DisableCache = true
+	defer func() { homedir.DisableCache = false }()
+
+	if files := defaultKeyFiles(); len(files) != 0 {
+		t.Errorf("defaultKeyFiles() with no keys = %v, want none", files)
+	}
+	sshDir := filepath.Join(home, ".ssh")
+	if err := os.Mkdir(sshDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"id_rsa", "id_ed25519", "id_dsa"} {
+		if err := os.WriteFile(filepath.Join(sshDir, name), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []string{filepath.Join(sshDir, "id_ed25519"), filepath.Join(sshDir, "id_rsa")}
+	if files := defaultKeyFiles(); !reflect.DeepEqual(files, want) {
+		t.Errorf("defaultKeyFiles() = %v, want %v", files, want)
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright © 2017 Ricardo Aravena <raravena80@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ops
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/raravena80/ya/common"
+	"golang.org/x/crypto/ssh"
+)
+
+// VerifySHA256 is the digest --verify checks copies with.
+const VerifySHA256 = "sha256"
+
+// transferStats describes how a file got to a host.
+type transferStats struct {
+	bytes    int64
+	peer     string // Host that sent the file, empty when ya sent it unless a relay failed
+	path     string // Path of the file on the host, with --verify or --relay
+	digest   string // SHA-256 of the file on the host, with --verify
+	verified bool   // Whether digest matches the source
+}
+
+// String reports the transfer on one line.
+func (s *transferStats) String() string {
+	from := "local"
+	if s.peer != "" {
+		from = s.peer
+	}
+	out := fmt.Sprintf("Copied %d bytes from %s", s.bytes, from)
+	if s.digest != "" {
+		status := "verified"
+		if !s.verified {
+			status = "mismatch"
+		}
+		out += fmt.Sprintf(", sha256 %s %s", s.digest, status)
+	}
+	return out + "\n"
+}
+
+// validateTransfer checks the options of --verify and --relay, which only
+// apply to copies of a single file to the hosts.
+func validateTransfer(opt common.Options) error {
+	if opt.Verify == "" && opt.Relay <= 0 {
+		return nil
+	}
+	if opt.Verify != "" && opt.Verify != VerifySHA256 {
+		return fmt.Errorf("unknown verify digest %q, use %s", opt.Verify, VerifySHA256)
+	}
+	if opt.Op != "scp" || opt.FromRemote {
+		return errors.New("--verify and --relay only apply to copies to the servers")
+	}
+	if opt.Relay > 0 && opt.Jump != "" {
+		// Peers would have to go through the jump hosts ya dials
+		return errors.New("--relay cannot be used with --jump")
+	}
+	info, err := os.Stat(opt.Src)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("--verify and --relay need a single file source, %s is not one", opt.Src)
+	}
+	return nil
+}
+
+// artifactScript returns a shell script printing the path the file copied
+// as base to dst ended up at and, with digest, its SHA-256 on the next
+// line. It works with GNU and BSD tools.
+func artifactScript(dst, base string, digest bool) string {
+	script := "f=" + shellQuote(dst) + "\n" +
+		"if [ -d \"$f\" ]; then f=\"$f\"/" + shellQuote(base) + "; fi\n" +
+		"[ -f \"$f\" ] || { echo \"$f: not a regular file\" >&2; exit 1; }\n" +
+		"printf '%s\\n' \"$f\"\n"
+	if digest {
+		script += sha256Command + " < \"$f\"\n"
+	}
+	return script
+}
+
+// checkArtifact finds the file copied to the host and, with --verify,
+// checks its digest against env.digest.
+func checkArtifact(opt common.Options, conn *ssh.Client, env *runEnv, stats *transferStats) error {
+	verify := opt.Verify != ""
+	out, err := runRemote(opt, conn, "sh -c "+shellQuote(artifactScript(opt.Dst, filepath.Base(opt.Src), verify)))
+	if err != nil {
+		return fmt.Errorf("failed to check the copy: %w", err)
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	if !scanner.Scan() {
+		return fmt.Errorf("failed to check the copy: no output")
+	}
+	stats.path = scanner.Text()
+	if !verify {
+		return nil
+	}
+	var sum string
+	if scanner.Scan() {
+		sum, _, _ = strings.Cut(scanner.Text(), " ")
+	}
+	if sum == "" {
+		return fmt.Errorf("failed to compute the sha256 of %s", stats.path)
+	}
+	stats.digest = sum
+	stats.verified = sum == env.digest
+	if !stats.verified {
+		return fmt.Errorf("sha256 mismatch for %s: got %s, want %s", stats.path, sum, env.digest)
+	}
+	return nil
+}
+
+// transferResult makes the result of a copy to a host. With --verify or
+// --relay it first checks the copy and reports how it got there.
+func transferResult(opt common.Options, t target, conn *ssh.Client, env *runEnv, stats *transferStats, err error) executeResult {
+	check := opt.Verify != "" || opt.Relay > 0
+	if err == nil && check {
+		err = checkArtifact(opt, conn, env, stats)
+	}
+	out := "Finished\n"
+	if check {
+		out = stats.String()
+	}
+	res := makeExecResult(t.name, out, err)
+	res.transfer = stats
+	return res
+}
@@ -0,0 +1,113 @@
+// Copyright © 2017 Ricardo Aravena <raravena80@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ops
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/raravena80/ya/common"
+)
+
+func TestValidateTransfer(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(file, []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		opt    common.Options
+		errMsg string
+	}{
+		{name: "Neither", opt: common.Options{Op: "scp", Src: t.TempDir()}},
+		{name: "Verify", opt: common.Options{Op: "scp", Src: file, Verify: "sha256"}},
+		{name: "Relay", opt: common.Options{Op: "scp", Src: file, Relay: 3}},
+		{name: "Unknown digest", opt: common.Options{Op: "scp", Src: file, Verify: "md5"}, errMsg: "unknown verify digest"},
+		{name: "Directory", opt: common.Options{Op: "scp", Src: t.TempDir(), Verify: "sha256"}, errMsg: "single file"},
+		{name: "From remote", opt: common.Options{Op: "scp", Src: file, Relay: 2, FromRemote: true}, errMsg: "copies to the servers"},
+		{name: "Relay through jump hosts", opt: common.Options{Op: "scp", Src: file, Relay: 2, Jump: "bastion"}, errMsg: "--jump"},
+		{name: "Missing source", opt: common.Options{Op: "scp", Src: file + ".missing", Verify: "sha256"}, errMsg: "no such file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateTransfer(tt.opt)
+			if tt.errMsg == "" {
+				if err != nil {
+					t.Errorf("validateTransfer() error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.errMsg) {
+				t.Errorf("validateTransfer() error = %v, want %q", err, tt.errMsg)
+			}
+		})
+	}
+}
+
+func TestExecuteCopyVerify(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "artifact.bin")
+	if err := os.WriteFile(src, []byte("artifact"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	digest, err := fileSHA256(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := fmt.Sprintf("127.0.0.1:%d", execTestServer())
+
+	tests := []struct {
+		name     string
+		protocol string
+		digest   string
+		errMsg   string
+	}{
+		{name: "scp", protocol: ProtocolSCP, digest: digest},
+		{name: "Mismatch", protocol: ProtocolSCP, digest: strings.Repeat("0", 64), errMsg: "sha256 mismatch"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dst := t.TempDir()
+			opt := common.Options{Src: src, Dst: dst, Verify: VerifySHA256, Protocol: tt.protocol}
+			res := executeCopy(opt, testTarget(t, opt, entry), &runEnv{config: execTestConfig(), digest: tt.digest})
+			rec := newResultRecord(res)
+			out, _ := json.Marshal(rec)
+			if tt.errMsg != "" {
+				if res.err == nil || !strings.Contains(res.err.Error(), tt.errMsg) {
+					t.Errorf("executeCopy() error = %v, want %q", res.err, tt.errMsg)
+				}
+				if !strings.Contains(string(out), `"verified":false`) {
+					t.Errorf("result record %s does not report the mismatch", out)
+				}
+				return
+			}
+			if res.err != nil {
+				t.Fatalf("executeCopy() error: %v", res.err)
+			}
+			want := fmt.Sprintf("Copied 8 bytes from local, sha256 %s verified\n", digest)
+			if res.stdout != want {
+				t.Errorf("executeCopy() output = %q, want %q", res.stdout, want)
+			}
+			wantRec := fmt.Sprintf(`"transfer":{"bytes":8,"path":"%s","sha256":"%s","verified":true}`,
+				filepath.Join(dst, "artifact.bin"), digest)
+			if !strings.Contains(string(out), wantRec) {
+				t.Errorf("result record %s does not contain %s", out, wantRec)
+			}
+		})
+	}
+}
@@ -0,0 +1,221 @@
+// Copyright © 2017 Ricardo Aravena <raravena80@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ops
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Symlink handling modes selectable with common.SetSymlinks.
+const (
+	SymlinksFollow = "follow" // Copy what the link points to
+	SymlinksLink   = "link"   // Recreate the link itself, SFTP only
+	SymlinksSkip   = "skip"   // Leave links out of the copy
+)
+
+// SymlinkModes lists the supported symlink handling modes.
+var SymlinkModes = []string{SymlinksFollow, SymlinksLink, SymlinksSkip}
+
+// validateSymlinks returns an error for an unknown symlink handling mode.
+// An empty mode is the same as follow.
+func validateSymlinks(mode string) error {
+	switch mode {
+	case "", SymlinksFollow, SymlinksLink, SymlinksSkip:
+		return nil
+	}
+	return fmt.Errorf("unknown symlink mode %q, use one of %v", mode, SymlinkModes)
+}
+
+// treeFS is a filesystem a directory tree can be walked on. *sftp.Client
+// implements it for remote trees and localFS for local ones.
+type treeFS interface {
+	Lstat(name string) (fs.FileInfo, error)
+	Stat(name string) (fs.FileInfo, error)
+	ReadDir(name string) ([]fs.FileInfo, error)
+	ReadLink(name string) (string, error)
+	RealPath(name string) (string, error)
+	Join(elem ...string) string
+}
+
+// localFS is the local filesystem.
+type localFS struct{}
+
+func (localFS) Lstat(name string) (fs.FileInfo, error) { return os.Lstat(name) }
+func (localFS) Stat(name string) (fs.FileInfo, error)  { return os.Stat(name) }
+func (localFS) ReadLink(name string) (string, error)   { return os.Readlink(name) }
+func (localFS) Join(elem ...string) string             { return filepath.Join(elem...) }
+
+func (localFS) ReadDir(name string) ([]fs.FileInfo, error) {
+	entries, err := os.ReadDir(name)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]fs.FileInfo, 0, len(entries))
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+func (localFS) RealPath(name string) (string, error) {
+	real, err := filepath.EvalSymlinks(name)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Abs(real)
+}
+
+// treeVisitor receives the entries of a tree from walkTree. Every function
+// gets the entry's path, its slash-separated path relative to the root of
+// the walk and its info.
+type treeVisitor struct {
+	enterDir func(p, rel string, info fs.FileInfo) error
+	leaveDir func(p, rel string, info fs.FileInfo) error
+	file     func(p, rel string, info fs.FileInfo) error
+	symlink  func(p, rel, target string, info fs.FileInfo) error
+}
+
+// treeWalk is the state of a walkTree call.
+type treeWalk struct {
+	fsys     treeFS
+	symlinks string
+	v        treeVisitor
+	walking  []string // Resolved paths of the directories being walked
+}
+
+// walkTree walks the directory root, whose info is given, in lexical order,
+// entering every directory before its entries and leaving it after them.
+// Symlinks below root are handled according to symlinks: followed, passed
+// to v.symlink or skipped. A followed link to a directory that is being
+// walked, or to one above it, is reported as a loop. Entries that are
+// neither regular files, directories nor symlinks, such as sockets, are
+// skipped, and so are the directories for which v.enterDir returns
+// fs.SkipDir.
+func walkTree(fsys treeFS, root string, info fs.FileInfo, symlinks string, v treeVisitor) error {
+	real, err := fsys.RealPath(root)
+	if err != nil {
+		return err
+	}
+	w := &treeWalk{fsys: fsys, symlinks: symlinks, v: v}
+	return w.dir(root, ".", real, info)
+}
+
+// dir walks the directory p, whose resolved path is real.
+func (w *treeWalk) dir(p, rel, real string, info fs.FileInfo) error {
+	if err := w.v.enterDir(p, rel, info); err != nil {
+		if err == fs.SkipDir {
+			return nil
+		}
+		return err
+	}
+	entries, err := w.fsys.ReadDir(p)
+	if err != nil {
+		return err
+	}
+	w.walking = append(w.walking, real)
+	defer func() { w.walking = w.walking[:len(w.walking)-1] }()
+	for _, e := range entries {
+		name := e.Name()
+		if err := w.entry(w.fsys.Join(p, name), path.Join(rel, name), w.fsys.Join(real, name)); err != nil {
+			return err
+		}
+	}
+	return w.v.leaveDir(p, rel, info)
+}
+
+// entry walks the entry p of a directory being walked.
+func (w *treeWalk) entry(p, rel, real string) error {
+	info, err := w.fsys.Lstat(p)
+	if err != nil {
+		return err
+	}
+	if info.Mode()&fs.ModeSymlink != 0 {
+		switch w.symlinks {
+		case SymlinksSkip:
+			return nil
+		case SymlinksLink:
+			target, err := w.fsys.ReadLink(p)
+			if err != nil {
+				return err
+			}
+			return w.v.symlink(p, rel, target, info)
+		}
+		if info, err = w.fsys.Stat(p); err != nil {
+			return fmt.Errorf("broken symlink %s: %w", p, err)
+		}
+		if info.IsDir() {
+			target, err := w.fsys.RealPath(p)
+			if err != nil {
+				return err
+			}
+			if w.loops(target) {
+				return fmt.Errorf("symlink loop at %s", p)
+			}
+			real = target
+		}
+	}
+	switch {
+	case info.IsDir():
+		return w.dir(p, rel, real, info)
+	case info.Mode().IsRegular():
+		return w.v.file(p, rel, info)
+	}
+	return nil
+}
+
+// loops reports whether walking the resolved directory target would walk
+// one of the directories being walked again. Checking every directory on
+// the way down, not just the link's parent, also catches links that point
+// at each other, such as A/toB -> ../B and B/toA -> ../A.
+func (w *treeWalk) loops(target string) bool {
+	for _, dir := range w.walking {
+		if isWithin(dir, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// isWithin reports whether the resolved path p is dir or below it.
+func isWithin(p, dir string) bool {
+	p, dir = filepath.ToSlash(p), strings.TrimSuffix(filepath.ToSlash(dir), "/")
+	return p == dir || strings.HasPrefix(p, dir+"/")
+}
+
+// treeFilter selects the parts of a local tree to send. A nil filter
+// selects everything.
+type treeFilter struct {
+	dirs  map[string]bool // Directories to walk, by path relative to the root
+	files map[string]bool // Files to send, by path relative to the root
+}
+
+// dir reports whether the directory rel should be walked.
+func (f *treeFilter) dir(rel string) bool {
+	return f == nil || f.dirs[rel]
+}
+
+// file reports whether the file rel should be sent.
+func (f *treeFilter) file(rel string) bool {
+	return f == nil || f.files[rel]
+}
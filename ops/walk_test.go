@@ -0,0 +1,188 @@
+// Copyright © 2017 Ricardo Aravena <raravena80@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ops
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// linkTree creates a tree with a file, a subdirectory, a symlink to the
+// file, a symlink to the subdirectory and, with loop, a symlink back to the
+// root. It returns the root.
+func linkTree(t *testing.T, loop bool) string {
+	t.Helper()
+	root := filepath.Join(t.TempDir(), "tree")
+	if err := os.MkdirAll(filepath.Join(root, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a.txt", "sub/b.txt"} {
+		if err := os.WriteFile(filepath.Join(root, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{"a.link": "a.txt", "sub.link": "sub"}
+	if loop {
+		links["sub/up"] = ".."
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(root, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+// recordWalk walks root and returns the events seen by the visitor.
+func recordWalk(root, symlinks string) ([]string, error) {
+	var events []string
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	err = walkTree(localFS{}, root, info, symlinks, treeVisitor{
+		enterDir: func(p, rel string, info fs.FileInfo) error {
+			events = append(events, "D "+rel)
+			return nil
+		},
+		leaveDir: func(p, rel string, info fs.FileInfo) error {
+			events = append(events, "E "+rel)
+			return nil
+		},
+		file: func(p, rel string, info fs.FileInfo) error {
+			events = append(events, "F "+rel)
+			return nil
+		},
+		symlink: func(p, rel, target string, info fs.FileInfo) error {
+			events = append(events, "L "+rel+" -> "+target)
+			return nil
+		},
+	})
+	return events, err
+}
+
+func TestWalkTree(t *testing.T) {
+	tests := []struct {
+		name     string
+		symlinks string
+		loop     bool
+		want     []string
+		errMsg   string
+	}{
+		{name: "Follow", symlinks: SymlinksFollow, want: []string{
+			"D .", "F a.link", "F a.txt", "D sub", "F sub/b.txt", "E sub",
+			"D sub.link", "F sub.link/b.txt", "E sub.link", "E ."}},
+		{name: "Default follows", want: []string{
+			"D .", "F a.link", "F a.txt", "D sub", "F sub/b.txt", "E sub",
+			"D sub.link", "F sub.link/b.txt", "E sub.link", "E ."}},
+		{name: "Link", symlinks: SymlinksLink, want: []string{
+			"D .", "L a.link -> a.txt", "F a.txt", "D sub", "F sub/b.txt", "E sub",
+			"L sub.link -> sub", "E ."}},
+		{name: "Skip", symlinks: SymlinksSkip, want: []string{
+			"D .", "F a.txt", "D sub", "F sub/b.txt", "E sub", "E ."}},
+		{name: "Loop", symlinks: SymlinksFollow, loop: true, errMsg: "symlink loop"},
+		{name: "Loop skipped", symlinks: SymlinksSkip, loop: true, want: []string{
+			"D .", "F a.txt", "D sub", "F sub/b.txt", "E sub", "E ."}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			events, err := recordWalk(linkTree(t, tt.loop), tt.symlinks)
+			if tt.errMsg != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.errMsg) {
+					t.Errorf("walkTree() error = %v, want %q", err, tt.errMsg)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("walkTree() error: %v", err)
+			}
+			if !reflect.DeepEqual(events, tt.want) {
+				t.Errorf("walkTree() events = %q, want %q", events, tt.want)
+			}
+		})
+	}
+}
+
+func TestWalkTreeBrokenLink(t *testing.T) {
+	root := t.TempDir()
+	if err := os.Symlink("missing", filepath.Join(root, "broken")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := recordWalk(root, SymlinksFollow); err == nil || !strings.Contains(err.Error(), "broken symlink") {
+		t.Errorf("walkTree() error = %v, want broken symlink", err)
+	}
+	if _, err := recordWalk(root, SymlinksSkip); err != nil {
+		t.Errorf("walkTree() skipping links error: %v", err)
+	}
+}
+
+func TestWalkTreeLinkCycle(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{"A", "B"} {
+		if err := os.Mkdir(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(root, "A", "a.txt"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../B", filepath.Join(root, "A", "toB")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../A", filepath.Join(root, "B", "toA")); err != nil {
+		t.Fatal(err)
+	}
+	events, err := recordWalk(filepath.Join(root, "A"), SymlinksFollow)
+	if err == nil || !strings.Contains(err.Error(), "symlink loop") {
+		t.Errorf("walkTree() error = %v, want symlink loop", err)
+	}
+	want := []string{"D .", "F a.txt", "D toB"}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("walkTree() events = %q, want %q", events, want)
+	}
+}
+
+func TestValidateSymlinks(t *testing.T) {
+	for _, mode := range append(SymlinkModes, "") {
+		if err := validateSymlinks(mode); err != nil {
+			t.Errorf("validateSymlinks(%q) error: %v", mode, err)
+		}
+	}
+	if err := validateSymlinks("copy"); err == nil {
+		t.Error("validateSymlinks(\"copy\") expected an error")
+	}
+}
+
+func TestIsWithin(t *testing.T) {
+	tests := []struct {
+		p, dir string
+		want   bool
+	}{
+		{"/a/b", "/a/b", true},
+		{"/a/b/c", "/a/b", true},
+		{"/a/bc", "/a/b", false},
+		{"/a", "/a/b", false},
+		{"/a", "/", true},
+	}
+	for _, tt := range tests {
+		if got := isWithin(tt.p, tt.dir); got != tt.want {
+			t.Errorf("isWithin(%q, %q) = %v, want %v", tt.p, tt.dir, got, tt.want)
+		}
+	}
+}
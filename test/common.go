@@ -17,6 +17,7 @@ package test
 import (
 	"fmt"
 	glssh "github.com/gliderlabs/ssh"
+	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
 	"io"
@@ -24,6 +25,7 @@ import (
 	"os"
 	"os/exec"
 	"regexp"
+	"sync/atomic"
 	"syscall"
 	"unsafe"
 )
@@ -156,3 +158,194 @@ func StartSSHServerForScp(publicKeys map[string]ssh.PublicKey) {
 	}(done)
 	<-done
 }
+
+// publicKeyHandler returns a public key handler accepting any of publicKeys
+func publicKeyHandler(publicKeys map[string]ssh.PublicKey) glssh.PublicKeyHandler {
+	return func(ctx glssh.Context, key glssh.PublicKey) bool {
+		for _, pubk := range publicKeys {
+			if glssh.KeysEqual(key, pubk) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// execHandler runs the session command with sh, wiring stdin, stdout and
+// stderr to the session and reporting the command's exit status. When the
+// client forwards its agent, the command gets it through SSH_AUTH_SOCK.
+func execHandler(s glssh.Session) {
+	cmd := exec.Command("sh", "-c", s.RawCommand())
+	if glssh.AgentRequested(s) {
+		l, err := glssh.NewAgentListener()
+		if err != nil {
+			s.Exit(255)
+			return
+		}
+		defer l.Close()
+		go glssh.ForwardAgentConnections(l, s)
+		cmd.Env = append(os.Environ(), "SSH_AUTH_SOCK="+l.Addr().String())
+	}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		s.Exit(255)
+		return
+	}
+	cmd.Stdout = s
+	cmd.Stderr = s.Stderr()
+	if err := cmd.Start(); err != nil {
+		io.WriteString(s.Stderr(), err.Error())
+		s.Exit(127)
+		return
+	}
+	go func() {
+		io.Copy(stdin, s)
+		stdin.Close()
+	}()
+	// Forward signals from the client and kill the command if the session goes away
+	signals := make(chan glssh.Signal, 1)
+	s.Signals(signals)
+	exited := make(chan struct{})
+	defer close(exited)
+	go func() {
+		for {
+			select {
+			case sig := <-signals:
+				if sig == glssh.SIGTERM {
+					cmd.Process.Signal(syscall.SIGTERM)
+				}
+			case <-s.Context().Done():
+				cmd.Process.Kill()
+				return
+			case <-exited:
+				return
+			}
+		}
+	}()
+	err = cmd.Wait()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			s.Exit(128 + int(status.Signal()))
+			return
+		}
+		s.Exit(exitErr.ExitCode())
+		return
+	}
+	s.Exit(0)
+}
+
+// newExecServer returns an SSH server that runs session commands with sh and
+// allows forwarding connections, so it can also act as a jump host.
+func newExecServer(publicKeys map[string]ssh.PublicKey) *glssh.Server {
+	return &glssh.Server{
+		Handler:          execHandler,
+		PublicKeyHandler: publicKeyHandler(publicKeys),
+		LocalPortForwardingCallback: func(ctx glssh.Context, host string, port uint32) bool {
+			return true
+		},
+		ChannelHandlers: map[string]glssh.ChannelHandler{
+			"session":      glssh.DefaultSessionHandler,
+			"direct-tcpip": glssh.DirectTCPIPHandler,
+		},
+	}
+}
+
+// serveLocal serves server on a random local port and returns the port.
+func serveLocal(server *glssh.Server, name string) int {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("Couldn't listen for %s tests %v", name, err))
+	}
+	go server.Serve(ln)
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+// StartSSHServerForExec Starts an SSH server on a random local port that runs
+// session commands with sh and can act as a jump host. Returns the port the
+// server listens on.
+func StartSSHServerForExec(publicKeys map[string]ssh.PublicKey) int {
+	return serveLocal(newExecServer(publicKeys), "exec")
+}
+
+// sftpHandler serves the sftp subsystem on the local filesystem.
+func sftpHandler(s glssh.Session) {
+	server, err := sftp.NewServer(s)
+	if err != nil {
+		s.Exit(255)
+		return
+	}
+	defer server.Close()
+	if err := server.Serve(); err != nil && err != io.EOF {
+		s.Exit(1)
+		return
+	}
+	s.Exit(0)
+}
+
+// StartSSHServerForSFTP Starts an exec SSH server on a random local port that
+// also offers the sftp subsystem. Returns the port the server listens on.
+func StartSSHServerForSFTP(publicKeys map[string]ssh.PublicKey) int {
+	server := newExecServer(publicKeys)
+	server.SubsystemHandlers = map[string]glssh.SubsystemHandler{
+		"sftp": sftpHandler,
+	}
+	return serveLocal(server, "sftp")
+}
+
+// StartSSHServerForJump Starts an exec SSH server to be used as a jump host.
+// Returns the port the server listens on and a function reporting how many
+// connections it has accepted so far.
+func StartSSHServerForJump(publicKeys map[string]ssh.PublicKey) (int, func() int) {
+	var conns int32
+	server := newExecServer(publicKeys)
+	server.ConnCallback = func(ctx glssh.Context, conn net.Conn) net.Conn {
+		atomic.AddInt32(&conns, 1)
+		return conn
+	}
+	port := serveLocal(server, "jump")
+	return port, func() int { return int(atomic.LoadInt32(&conns)) }
+}
+
+// StartSSHServerForCerts Starts an exec SSH server on a random local port
+// that presents hostKey, which may be a host certificate signer, and only
+// accepts users presenting a certificate signed by userCA. Returns the port
+// the server listens on.
+func StartSSHServerForCerts(hostKey ssh.Signer, userCA ssh.PublicKey) int {
+	checker := &ssh.CertChecker{
+		IsUserAuthority: func(auth ssh.PublicKey) bool {
+			return glssh.KeysEqual(auth, userCA)
+		},
+	}
+	server := newExecServer(nil)
+	server.PublicKeyHandler = func(ctx glssh.Context, key glssh.PublicKey) bool {
+		cert, ok := key.(*ssh.Certificate)
+		if !ok || cert.CertType != ssh.UserCert || !checker.IsUserAuthority(cert.SignatureKey) {
+			return false
+		}
+		return checker.CheckCert(ctx.User(), cert) == nil
+	}
+	server.AddHostKey(hostKey)
+	return serveLocal(server, "cert")
+}
+
+// StartSSHServerForPassword Starts an exec SSH server on a random local port
+// that only accepts password. When otp is not empty, password authentication
+// is disabled and keyboard-interactive authentication asks for both the
+// password and otp as a verification code instead. Returns the port the
+// server listens on.
+func StartSSHServerForPassword(password, otp string) int {
+	server := newExecServer(nil)
+	server.PublicKeyHandler = nil
+	if otp == "" {
+		server.PasswordHandler = func(ctx glssh.Context, pass string) bool {
+			return pass == password
+		}
+		return serveLocal(server, "password")
+	}
+	server.KeyboardInteractiveHandler = func(ctx glssh.Context, challenge ssh.KeyboardInteractiveChallenge) bool {
+		answers, err := challenge(ctx.User(), "Two-factor login",
+			[]string{"Password: ", "Verification code: "}, []bool{false, false})
+		return err == nil && len(answers) == 2 && answers[0] == password && answers[1] == otp
+	}
+	return serveLocal(server, "keyboard-interactive")
+}